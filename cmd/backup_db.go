@@ -20,25 +20,92 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 
+	"github.com/patrick-ogrady/snowplow/pkg/avalanchego"
+	"github.com/patrick-ogrady/snowplow/pkg/backup"
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
 	"github.com/patrick-ogrady/snowplow/pkg/compression"
-	"github.com/patrick-ogrady/snowplow/pkg/storage"
+	"github.com/patrick-ogrady/snowplow/pkg/snapshot"
+	"github.com/patrick-ogrady/snowplow/pkg/transfer"
+	"github.com/patrick-ogrady/snowplow/pkg/utils"
 )
 
 // backupDbCmd represents the backup db command
 var backupDbCmd = &cobra.Command{
-	Use:   "backup [bucket] [name]",
-	Short: "backup db to google cloud storage",
-	Args:  cobra.ExactArgs(2), // nolint:gomnd
+	Use:   "backup [destination]... [name]",
+	Short: "backup db to one or more storage destinations",
+	Args:  cobra.MinimumNArgs(2), // nolint:gomnd
 	RunE:  backupDbFunc,
 }
 
+var (
+	backupDbCompression  string
+	backupDbResumable    bool
+	backupDbWorkers      int
+	backupDbMaxBandwidth string
+	backupDbIncremental  bool
+	backupDbConsistent   bool
+	backupDbSigningKey   string
+	backupDbQuorum       int
+)
+
 func init() {
 	dbCmd.AddCommand(backupDbCmd)
+	backupDbCmd.Flags().StringVar(
+		&backupDbCompression,
+		"compression",
+		string(compression.Gzip),
+		"compression format of the backup (gzip or zstd)",
+	)
+	backupDbCmd.Flags().BoolVar(
+		&backupDbResumable,
+		"resumable",
+		false,
+		"record progress so an interrupted upload can be resumed by running the same command again",
+	)
+	backupDbCmd.Flags().IntVar(
+		&backupDbWorkers,
+		"workers",
+		transfer.DefaultWorkers,
+		"number of parts (or files of an incremental backup) to upload concurrently (each worker holds a part in memory)",
+	)
+	backupDbCmd.Flags().StringVar(
+		&backupDbMaxBandwidth,
+		"max-bandwidth",
+		"",
+		"maximum combined bandwidth of all workers (ex: 50MiB/s)",
+	)
+	backupDbCmd.Flags().BoolVar(
+		&backupDbIncremental,
+		"incremental",
+		false,
+		"only upload files that changed since an earlier incremental backup",
+	)
+	backupDbCmd.Flags().BoolVar(
+		&backupDbConsistent,
+		"consistent",
+		false,
+		"briefly stop the avalanchego node managed by snowplow run to back up a consistent snapshot of the db",
+	)
+	backupDbCmd.Flags().StringVar(
+		&backupDbSigningKey,
+		"signing-key",
+		"",
+		"sign the manifest with the private key in this file instead of the staking key (if present)",
+	)
+	backupDbCmd.Flags().IntVar(
+		&backupDbQuorum,
+		"quorum",
+		1,
+		"number of destinations the backup must succeed in",
+	)
 
 	// Here you will define your flags and configuration settings.
 
@@ -51,34 +118,175 @@ func init() {
 	// backupCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
+// dbBackupOptions describes how the db is backed up.
+type dbBackupOptions struct {
+	format      compression.Format
+	incremental bool
+	consistent  bool
+	transfer    *transfer.Options
+
+	// quorum is the number of destinations the backup must
+	// succeed in.
+	quorum int
+
+	// signer signs the manifest (if not nil).
+	signer *catalog.Signer
+}
+
+// backupDb backs up dbDirectory (relative to base) to every
+// destination as name and fails unless the backup succeeded
+// in at least opts.quorum destinations. If opts.consistent, a
+// snapshot of the db is taken by snowplow run and backed up
+// instead.
+func backupDb(
+	ctx context.Context,
+	destinations []string,
+	name string,
+	nodeID string,
+	base string,
+	opts *dbBackupOptions,
+) (*replication, error) {
+	// Check if destinations are valid
+	if err := validateDestinations(destinations, opts.quorum); err != nil {
+		return nil, err
+	}
+
+	// Create storage backends
+	objectName := name + opts.format.Extension()
+	if opts.incremental {
+		objectName = snapshot.Name(name)
+	}
+	targets := newReplication(ctx, objectName, destinations)
+	defer targets.close()
+
+	// Take a consistent snapshot of the db (which is
+	// backed up instead of the live db)
+	if opts.consistent {
+		fmt.Println("requesting db snapshot...")
+		var err error
+		base, err = avalanchego.RequestSnapshot(ctx, filepath.Join(homeDir, controlSocket))
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not take db snapshot", err)
+		}
+		defer os.RemoveAll(base)
+	}
+
+	// Backup db
+	if opts.incremental {
+		// Each destination stores a different set of
+		// files, so incremental backups are uploaded to
+		// each destination separately.
+		targets.each(func(d *backupDestination) error {
+			var err error
+			d.result, err = snapshot.Backup(
+				ctx,
+				d.backend,
+				objectName,
+				base,
+				dbDirectory,
+				&snapshot.Options{
+					Format:  opts.format,
+					Workers: opts.transfer.Workers,
+					Limiter: opts.transfer.Limiter,
+				},
+			)
+			return err
+		})
+	} else {
+		if err := targets.backup(
+			ctx,
+			base,
+			dbDirectory,
+			&backup.Options{Format: opts.format},
+			func(destination string) backup.ReplicaUploader {
+				return transferUploader(destination, opts.transfer)
+			},
+		); err != nil {
+			return nil, fmt.Errorf("%w: unable to back up %s", err, objectName)
+		}
+	}
+
+	// Write manifest
+	targets.each(func(d *backupDestination) error {
+		if err := catalog.Write(ctx, d.backend, newManifest(
+			catalog.DB,
+			objectName,
+			nodeID,
+			d.result,
+			catalog.NoEncryption,
+			opts.format,
+		), opts.signer); err != nil {
+			return fmt.Errorf("%w: unable to write manifest of %s", err, objectName)
+		}
+
+		return nil
+	})
+
+	if err := targets.check(opts.quorum); err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
 func backupDbFunc(cmd *cobra.Command, args []string) error {
 	// Check if dbDirectory is empty
 	if _, err := os.Stat(dbDirectory); os.IsNotExist(err) {
 		return fmt.Errorf("%s is an empty directory", dbDirectory)
 	}
 
-	// Tar db
-	name := args[1]
-	tarFile := fmt.Sprintf("%s.tar.gz", name)
-	if err := compression.Compress(dbDirectory, tarFile); err != nil {
-		return fmt.Errorf("%w: could not compress db", err)
+	// Check if compression format is supported
+	format, err := compression.ParseFormat(backupDbCompression)
+	if err != nil {
+		return err
 	}
 
-	// Backup db
-	bucket := args[0]
-	if err := storage.Upload(
-		Context,
-		bucket,
-		tarFile,
-	); err != nil {
-		return fmt.Errorf("%w: unable to upload %s", err, tarFile)
+	// Check if incremental backups are requested with
+	// resumable transfers (incremental backups never upload
+	// a file that was already uploaded)
+	if backupDbIncremental && backupDbResumable {
+		return errors.New("--resumable cannot be used with --incremental")
 	}
 
-	// Cleanup
-	if err := os.Remove(tarFile); err != nil {
-		return fmt.Errorf("%w: unable to delete %s", err, tarFile)
+	// Check if transfer options are valid
+	transferOpts, err := transferOptions(backupDbWorkers, backupDbMaxBandwidth, backupDbResumable)
+	if err != nil {
+		return err
+	}
+
+	// Load manifest signer
+	signer, err := loadSigner(backupDbSigningKey, false)
+	if err != nil {
+		return err
+	}
+
+	// Load NodeID (if staking credentials are present)
+	// to include in the manifest
+	var printableNodeID string
+	if nodeID, err := utils.LoadNodeID(stakingCertPath); err == nil {
+		printableNodeID = utils.PrintableNodeID(nodeID)
+	}
+
+	// Backup db
+	destinations := args[:len(args)-1]
+	name := args[len(args)-1]
+	targets, err := backupDb(Context, destinations, name, printableNodeID, ".", &dbBackupOptions{
+		format:      format,
+		incremental: backupDbIncremental,
+		consistent:  backupDbConsistent,
+		transfer:    transferOpts,
+		signer:      signer,
+		quorum:      backupDbQuorum,
+	})
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("successfully backed up %s to %s\n", name, bucket)
+	fmt.Printf(
+		"successfully backed up %s to %d of %d destinations\n",
+		name,
+		targets.succeeded(),
+		len(destinations),
+	)
 	return nil
 }
@@ -20,11 +20,18 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/spf13/cobra"
 
+	"github.com/patrick-ogrady/snowplow/pkg/backup"
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
 	"github.com/patrick-ogrady/snowplow/pkg/compression"
 	"github.com/patrick-ogrady/snowplow/pkg/encryption"
 	"github.com/patrick-ogrady/snowplow/pkg/storage"
@@ -33,24 +40,163 @@ import (
 
 // backupKeysCmd represents the backup keys command
 var backupKeysCmd = &cobra.Command{
-	Use:   "backup [bucket]",
-	Short: "backup staking credentials to google cloud storage",
-	Args:  cobra.ExactArgs(1),
+	Use:   "backup [destination]...",
+	Short: "backup staking credentials to one or more storage destinations",
+	Args:  cobra.MinimumNArgs(1),
 	RunE:  backupKeysFunc,
 }
 
+var (
+	backupRecipients     []string
+	backupRecipientsFile string
+	backupKeysSigningKey string
+	backupKeysQuorum     int
+)
+
 func init() {
 	stakingCmd.AddCommand(backupKeysCmd)
 
-	// Here you will define your flags and configuration settings.
+	backupKeysCmd.Flags().StringArrayVar(
+		&backupRecipients,
+		"recipient",
+		[]string{},
+		"encrypt to the OpenPGP public key in this file instead of a passphrase (can be repeated)",
+	)
+	backupKeysCmd.Flags().StringVar(
+		&backupRecipientsFile,
+		"recipients-file",
+		"",
+		"encrypt to every OpenPGP public key in this keyring file instead of a passphrase",
+	)
+	backupKeysCmd.Flags().StringVar(
+		&backupKeysSigningKey,
+		"signing-key",
+		"",
+		"sign the manifest with the private key in this file instead of the staking key",
+	)
+	backupKeysCmd.Flags().IntVar(
+		&backupKeysQuorum,
+		"quorum",
+		1,
+		"number of destinations the backup must succeed in",
+	)
+}
+
+// keysExtension is the extension of encrypted staking
+// credential backups.
+var keysExtension = compression.Gzip.Extension() + encryption.Extension
+
+// legacyKeysObjectName returns the name of the staking
+// credentials backup of printableNodeID created before
+// backups were versioned.
+func legacyKeysObjectName(printableNodeID string) string {
+	return printableNodeID + keysExtension
+}
+
+// loadRecipients returns the public keys provided
+// with --recipient and --recipients-file.
+func loadRecipients() (openpgp.EntityList, error) {
+	paths := append([]string{}, backupRecipients...)
+	if len(backupRecipientsFile) > 0 {
+		paths = append(paths, backupRecipientsFile)
+	}
+
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	return encryption.LoadKeys(paths...)
+}
+
+// backupKeys encrypts the staking credentials in path
+// (relative to base) of nodeID to recipients (or with
+// passphrase if there are none) and backs them up to every
+// destination as a new version (with a manifest signed by
+// signer). It returns the version and fails unless the
+// backup succeeded in at least quorum destinations.
+func backupKeys(
+	ctx context.Context,
+	destinations []string,
+	quorum int,
+	nodeID string,
+	base string,
+	path string,
+	recipients openpgp.EntityList,
+	passphrase []byte,
+	signer *catalog.Signer,
+) (string, *replication, error) {
+	// Check if destinations are valid
+	if err := validateDestinations(destinations, quorum); err != nil {
+		return "", nil, err
+	}
+
+	// Create storage backends
+	version := catalog.NewVersion(time.Now())
+	name := catalog.VersionedName(nodeID, version, keysExtension)
+	targets := newReplication(ctx, name, destinations)
+	defer targets.close()
+
+	// Check if version already exists
+	targets.each(func(d *backupDestination) error {
+		_, err := d.backend.Stat(ctx, name)
+		if err == nil {
+			return fmt.Errorf("%s already exists", name)
+		}
+		if !errors.Is(err, storage.ErrObjectNotFound) {
+			return fmt.Errorf("%w: could not check if %s exists", err, name)
+		}
+
+		return nil
+	})
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// backupCmd.PersistentFlags().String("foo", "", "A help for foo")
+	// Backup Credentials (encrypted once for all
+	// destinations)
+	encrypt := func(r io.Reader, w io.Writer) error {
+		if len(recipients) > 0 {
+			return encryption.EncryptToRecipients(r, w, recipients)
+		}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// backupCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+		return encryption.Encrypt(r, w, passphrase)
+	}
+	if err := targets.backup(ctx, base, path, &backup.Options{
+		Format:  compression.Gzip,
+		Encrypt: encrypt,
+	}, nil); err != nil {
+		return "", nil, fmt.Errorf("%w: unable to back up %s", err, name)
+	}
+
+	// Write manifest and update latest (only once the new
+	// version is stored)
+	scheme := catalog.PassphraseEncryption
+	if len(recipients) > 0 {
+		scheme = catalog.RecipientsEncryption
+	}
+	targets.each(func(d *backupDestination) error {
+		manifest := newManifest(
+			catalog.Staking,
+			name,
+			nodeID,
+			d.result,
+			scheme,
+			compression.Gzip,
+		)
+		manifest.Version = version
+		if err := catalog.Write(ctx, d.backend, manifest, signer); err != nil {
+			return fmt.Errorf("%w: unable to write manifest of %s", err, name)
+		}
+
+		if err := catalog.WriteLatest(ctx, d.backend, nodeID, version); err != nil {
+			return fmt.Errorf("%w: unable to update latest version of %s", err, nodeID)
+		}
+
+		return nil
+	})
+
+	if err := targets.check(quorum); err != nil {
+		return "", nil, err
+	}
+
+	return version, targets, nil
 }
 
 func backupKeysFunc(cmd *cobra.Command, args []string) error {
@@ -76,36 +222,48 @@ func backupKeysFunc(cmd *cobra.Command, args []string) error {
 	}
 	printableNodeID := utils.PrintableNodeID(nodeID)
 
-	// Tar Credentials
-	tarFile := fmt.Sprintf("%s.tar.gz", printableNodeID)
-	if err := compression.Compress(stakingDirectory, tarFile); err != nil {
-		return fmt.Errorf("%w: could not compress credentials", err)
+	// Load recipients (or passphrase if there are none)
+	recipients, err := loadRecipients()
+	if err != nil {
+		return fmt.Errorf("%w: could not load recipients", err)
 	}
 
-	// Encrypt Credentials
-	encryptedFilePath := fmt.Sprintf("%s.gpg", tarFile)
-	if err := encryption.Encrypt(tarFile, encryptedFilePath); err != nil {
-		return fmt.Errorf("%w: could not encrypt credentials", err)
+	var passphrase []byte
+	if len(recipients) == 0 {
+		passphrase, err = encryption.LoadPassphrase(true)
+		if err != nil {
+			return fmt.Errorf("%w: could not load passphrase", err)
+		}
 	}
 
-	// Backup Credentials
-	bucket := args[0]
-	if err := storage.Upload(
-		Context,
-		bucket,
-		encryptedFilePath,
-	); err != nil {
-		return fmt.Errorf("%w: unable to upload %s", err, encryptedFilePath)
+	// Load manifest signer
+	signer, err := loadSigner(backupKeysSigningKey, true)
+	if err != nil {
+		return err
 	}
 
-	// Cleanup
-	if err := os.Remove(tarFile); err != nil {
-		return fmt.Errorf("%w: unable to delete %s", err, tarFile)
-	}
-	if err := os.Remove(encryptedFilePath); err != nil {
-		return fmt.Errorf("%w: unable to delete %s", err, encryptedFilePath)
+	// Backup Credentials
+	version, targets, err := backupKeys(
+		Context,
+		args,
+		backupKeysQuorum,
+		printableNodeID,
+		".",
+		stakingDirectory,
+		recipients,
+		passphrase,
+		signer,
+	)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("successfully backed up %s to %s\n", printableNodeID, bucket)
+	fmt.Printf(
+		"successfully backed up %s (version %s) to %d of %d destinations\n",
+		printableNodeID,
+		version,
+		targets.succeeded(),
+		len(args),
+	)
 	return nil
 }
@@ -0,0 +1,134 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/patrick-ogrady/snowplow/pkg/backup"
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/shamir"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+	"github.com/patrick-ogrady/snowplow/pkg/utils"
+)
+
+// combineKeysCmd represents the combine keys command
+var combineKeysCmd = &cobra.Command{
+	Use:   "combine [node ID] [share files...]",
+	Short: "restore staking credentials from shares created with split",
+	Args:  cobra.MinimumNArgs(2), // nolint:gomnd
+	RunE:  combineKeysFunc,
+}
+
+func init() {
+	stakingCmd.AddCommand(combineKeysCmd)
+
+	// Here you will define your flags and configuration settings.
+
+	// Cobra supports Persistent Flags which will work for this command
+	// and all subcommands, e.g.:
+	// combineCmd.PersistentFlags().String("foo", "", "A help for foo")
+
+	// Cobra supports local flags which will only run when this command
+	// is called directly, e.g.:
+	// combineCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+}
+
+// combinedDownloader returns a backup.Downloader that writes
+// archive (so shares can be restored like a backup).
+func combinedDownloader(archive []byte) backup.Downloader {
+	return func(ctx context.Context, backend storage.Backend, name string, w io.Writer) error {
+		_, err := w.Write(archive)
+		return err
+	}
+}
+
+func combineKeysFunc(cmd *cobra.Command, args []string) error {
+	// Check if stakingDirectory is empty
+	if _, err := os.Stat(stakingDirectory); !os.IsNotExist(err) {
+		return fmt.Errorf("%s is not empty directory", stakingDirectory)
+	}
+
+	// Load Shares
+	printableNodeID := args[0]
+	shares := make([]*shamir.Share, len(args)-1)
+	for i, sharePath := range args[1:] {
+		blob, err := ioutil.ReadFile(sharePath)
+		if err != nil {
+			return fmt.Errorf("%w: could not read %s", err, sharePath)
+		}
+
+		shares[i], err = shamir.Decode(string(blob))
+		if err != nil {
+			return fmt.Errorf("%w: could not decode %s", err, sharePath)
+		}
+	}
+
+	// Combine Shares
+	archive, err := shamir.Combine(shares)
+	if err != nil {
+		return fmt.Errorf("%w: could not combine shares", err)
+	}
+
+	// Restore credentials (only moved into place once the
+	// recovered NodeID matches the requested NodeID, which is
+	// not read from the shares as they are not authenticated)
+	verify := func(root string) error {
+		nodeID, err := utils.LoadNodeID(filepath.Join(root, stakingCertPath))
+		if err != nil {
+			return fmt.Errorf("%w: could not calculate recovered NodeID", err)
+		}
+
+		recoveredNodeID := utils.PrintableNodeID(nodeID)
+		if printableNodeID != recoveredNodeID {
+			return fmt.Errorf(
+				"recovered NodeID %s does not match requested NodeID %s",
+				recoveredNodeID,
+				printableNodeID,
+			)
+		}
+
+		return nil
+	}
+	if err := backup.Restore(
+		Context,
+		nil,
+		"shares",
+		".",
+		stakingDirectory,
+		&backup.Options{
+			Format:   compression.Gzip,
+			Download: combinedDownloader(archive),
+			Verify:   verify,
+		},
+	); err != nil {
+		return fmt.Errorf("%w: could not restore credentials", err)
+	}
+
+	fmt.Printf("successfully restored %s to %s\n", printableNodeID, stakingDirectory)
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
+)
+
+// inspectDbCmd represents the inspect db command
+var inspectDbCmd = &cobra.Command{
+	Use:   "inspect [destination] [name]",
+	Short: "show the manifest of a db backup in a storage destination",
+	Args:  cobra.ExactArgs(2), // nolint:gomnd
+	RunE:  inspectDbFunc,
+}
+
+var (
+	inspectDbJSON        bool
+	inspectDbTrustedKeys []string
+	inspectDbNodeID      string
+)
+
+func init() {
+	dbCmd.AddCommand(inspectDbCmd)
+
+	inspectDbCmd.Flags().BoolVar(
+		&inspectDbJSON,
+		"json",
+		false,
+		"print the manifest as JSON",
+	)
+	inspectDbCmd.Flags().StringArrayVar(
+		&inspectDbTrustedKeys,
+		"trusted-key",
+		[]string{},
+		"require the manifest to be signed by the public key (or certificate) in this file (can be repeated)",
+	)
+	inspectDbCmd.Flags().StringVar(
+		&inspectDbNodeID,
+		"node-id",
+		"",
+		"require the manifest to be signed by the staking key of this NodeID",
+	)
+}
+
+func inspectDbFunc(cmd *cobra.Command, args []string) error {
+	return inspectBackup(args[0], args[1], catalog.DB, inspectDbTrustedKeys, inspectDbNodeID, inspectDbJSON)
+}
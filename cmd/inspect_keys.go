@@ -0,0 +1,67 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
+)
+
+// inspectKeysCmd represents the inspect keys command
+var inspectKeysCmd = &cobra.Command{
+	Use:   "inspect [destination] [name]",
+	Short: "show the manifest of a staking credential backup in a storage destination",
+	Args:  cobra.ExactArgs(2), // nolint:gomnd
+	RunE:  inspectKeysFunc,
+}
+
+var (
+	inspectKeysJSON        bool
+	inspectKeysTrustedKeys []string
+	inspectKeysNodeID      string
+)
+
+func init() {
+	stakingCmd.AddCommand(inspectKeysCmd)
+
+	inspectKeysCmd.Flags().BoolVar(
+		&inspectKeysJSON,
+		"json",
+		false,
+		"print the manifest as JSON",
+	)
+	inspectKeysCmd.Flags().StringArrayVar(
+		&inspectKeysTrustedKeys,
+		"trusted-key",
+		[]string{},
+		"require the manifest to be signed by the public key (or certificate) in this file (can be repeated)",
+	)
+	inspectKeysCmd.Flags().StringVar(
+		&inspectKeysNodeID,
+		"node-id",
+		"",
+		"require the manifest to be signed by the staking key of this NodeID",
+	)
+}
+
+func inspectKeysFunc(cmd *cobra.Command, args []string) error {
+	return inspectBackup(args[0], args[1], catalog.Staking, inspectKeysTrustedKeys, inspectKeysNodeID, inspectKeysJSON)
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
+)
+
+// listDbCmd represents the list db command
+var listDbCmd = &cobra.Command{
+	Use:   "list [destination]",
+	Short: "list db backups in a storage destination",
+	Args:  cobra.ExactArgs(1),
+	RunE:  listDbFunc,
+}
+
+var listDbJSON bool
+
+func init() {
+	dbCmd.AddCommand(listDbCmd)
+
+	listDbCmd.Flags().BoolVar(
+		&listDbJSON,
+		"json",
+		false,
+		"print the full manifest of each backup as JSON",
+	)
+}
+
+func listDbFunc(cmd *cobra.Command, args []string) error {
+	return listBackups(args[0], catalog.DB, listDbJSON)
+}
@@ -0,0 +1,311 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cmd
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
+	"github.com/patrick-ogrady/snowplow/pkg/client"
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/integrity"
+	"github.com/patrick-ogrady/snowplow/pkg/snapshot"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+// newManifest returns the manifest of a backup that
+// was just uploaded.
+func newManifest(
+	kind catalog.Kind,
+	name string,
+	nodeID string,
+	result *storage.UploadResult,
+	encryption catalog.Encryption,
+	format compression.Format,
+) *catalog.Manifest {
+	return &catalog.Manifest{
+		Name:               name,
+		Kind:               kind,
+		NodeID:             nodeID,
+		SnowplowVersion:    snowplowVersion,
+		AvalancheGoVersion: avalancheGoVersion(),
+		CreatedAt:          time.Now().UTC(),
+		Size:               result.Size,
+		Checksum:           result.Checksum,
+		Encryption:         encryption,
+		Compression:        format,
+	}
+}
+
+// loadSigner returns the signer of new manifests: the key at
+// signingKey if provided or else the staking key (with its
+// certificate, so the manifest can be verified against the
+// NodeID). If neither is available, nil is returned unless
+// required.
+func loadSigner(signingKey string, required bool) (*catalog.Signer, error) {
+	if len(signingKey) > 0 {
+		key, err := integrity.LoadPrivateKey(signingKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not load signing key", err)
+		}
+
+		return &catalog.Signer{Key: key}, nil
+	}
+
+	if _, err := os.Stat(stakingKeyPath); os.IsNotExist(err) && !required {
+		return nil, nil
+	}
+
+	key, err := integrity.LoadPrivateKey(stakingKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not load staking key", err)
+	}
+
+	cert, err := ioutil.ReadFile(stakingCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read staking certificate", err)
+	}
+
+	return &catalog.Signer{Key: key, Certificate: cert}, nil
+}
+
+// loadVerifier returns a *catalog.Verifier that trusts the
+// public keys (or certificates) in trustedKeys or, if there
+// are none, the staking certificate of nodeID. If neither is
+// provided, nil is returned.
+func loadVerifier(trustedKeys []string, nodeID string) (*catalog.Verifier, error) {
+	if len(trustedKeys) == 0 && len(nodeID) == 0 {
+		return nil, nil
+	}
+
+	keys := []crypto.PublicKey{}
+	for _, path := range trustedKeys {
+		key, err := integrity.LoadPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not load trusted key", err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return &catalog.Verifier{TrustedKeys: keys, NodeID: nodeID}, nil
+}
+
+// avalancheGoVersion returns the version of the local
+// avalanchego node or catalog.UnknownVersion if it is
+// not running.
+func avalancheGoVersion() string {
+	version, err := client.NewClient().NodeVersion()
+	if err != nil || len(version) == 0 {
+		return catalog.UnknownVersion
+	}
+
+	return version
+}
+
+// printManifests prints a table describing manifests.
+func printManifests(manifests []*catalog.Manifest) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) // nolint:gomnd
+	fmt.Fprintln(w, "NAME\tNODE ID\tCREATED AT\tSIZE\tENCRYPTION\tAVALANCHEGO\tSNOWPLOW")
+	for _, m := range manifests {
+		if m.Legacy {
+			fmt.Fprintf(
+				w,
+				"%s\t-\t%s\t%d\t-\t-\t-\n",
+				m.Name,
+				m.CreatedAt.Format(time.RFC3339),
+				m.Size,
+			)
+			continue
+		}
+
+		nodeID := m.NodeID
+		if len(nodeID) == 0 {
+			nodeID = "-"
+		}
+
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			m.Name,
+			nodeID,
+			m.CreatedAt.Format(time.RFC3339),
+			m.Size,
+			m.Encryption,
+			m.AvalancheGoVersion,
+			m.SnowplowVersion,
+		)
+	}
+
+	return w.Flush()
+}
+
+// listBackups prints the backups of kind stored at
+// destination (as JSON if asJSON is true).
+func listBackups(destination string, kind catalog.Kind, asJSON bool) error {
+	// Create storage backend
+	backend, err := storage.NewBackend(Context, destination)
+	if err != nil {
+		return fmt.Errorf("%w: could not create storage backend for %s", err, destination)
+	}
+	defer backend.Close()
+
+	// List manifests
+	manifests, err := catalog.List(Context, backend, kind)
+	if err != nil {
+		return fmt.Errorf("%w: could not list backups in %s", err, destination)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(manifests)
+	}
+
+	return printManifests(manifests)
+}
+
+// backupInspection is printed by inspectBackup. Files are
+// only populated for incremental db backups.
+type backupInspection struct {
+	*catalog.Inspection
+
+	Files []*snapshot.Entry `json:"files,omitempty"`
+}
+
+// printInspection writes a description of inspection to out.
+func printInspection(out io.Writer, inspection *backupInspection) error {
+	m := inspection.Manifest
+	signer := "-"
+	switch {
+	case len(inspection.SignerNodeID) > 0:
+		signer = inspection.SignerNodeID
+	case inspection.Signed:
+		signer = "signing key"
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0) // nolint:gomnd
+	fmt.Fprintf(w, "NAME\t%s\n", m.Name)
+	fmt.Fprintf(w, "KIND\t%s\n", m.Kind)
+	if len(m.NodeID) > 0 {
+		fmt.Fprintf(w, "NODE ID\t%s\n", m.NodeID)
+	}
+	if len(m.Version) > 0 {
+		fmt.Fprintf(w, "VERSION\t%s\n", m.Version)
+	}
+	fmt.Fprintf(w, "CREATED AT\t%s\n", m.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "SIZE\t%d\n", m.Size)
+	fmt.Fprintf(w, "CHECKSUM\t%s\n", m.Checksum)
+	fmt.Fprintf(w, "ENCRYPTION\t%s\n", m.Encryption)
+	fmt.Fprintf(w, "COMPRESSION\t%s\n", m.Compression)
+	fmt.Fprintf(w, "AVALANCHEGO\t%s\n", m.AvalancheGoVersion)
+	fmt.Fprintf(w, "SNOWPLOW\t%s\n", m.SnowplowVersion)
+	fmt.Fprintf(w, "SIGNED BY\t%s\n", signer)
+	fmt.Fprintf(w, "VERIFIED\t%t\n", inspection.Verified)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(inspection.Files) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0) // nolint:gomnd
+	fmt.Fprintln(w, "PATH\tMODE\tSIZE\tBLOB")
+	for _, entry := range inspection.Files {
+		blob := entry.Blob
+		if len(blob) == 0 {
+			blob = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", entry.Path, entry.Mode, entry.Size, blob)
+	}
+
+	return w.Flush()
+}
+
+// inspectBackup prints the manifest of the backup name of kind
+// stored at destination (and the files of incremental db
+// backups). If trustedKeys or nodeID are provided, the
+// manifest must be signed by them.
+func inspectBackup(
+	destination string,
+	name string,
+	kind catalog.Kind,
+	trustedKeys []string,
+	nodeID string,
+	asJSON bool,
+) error {
+	// Send all progress (ex: while downloading a snapshot) to
+	// stderr, so stdout only contains the manifest
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	// Create storage backend
+	backend, err := storage.NewBackend(Context, destination)
+	if err != nil {
+		return fmt.Errorf("%w: could not create storage backend for %s", err, destination)
+	}
+	defer backend.Close()
+
+	// Read manifest (verifying its signature if requested)
+	verifier, err := loadVerifier(trustedKeys, nodeID)
+	if err != nil {
+		return err
+	}
+	inspection, err := catalog.Inspect(Context, backend, name, verifier)
+	if err != nil {
+		return fmt.Errorf("%w: could not inspect %s", err, name)
+	}
+	if inspection.Manifest.Kind != kind {
+		return fmt.Errorf("%s is a %s backup, not a %s backup", name, inspection.Manifest.Kind, kind)
+	}
+
+	// Read files of incremental backups (only the snapshot
+	// matching the manifest is read)
+	result := &backupInspection{Inspection: inspection}
+	if kind == catalog.DB && strings.HasPrefix(name, snapshot.Prefix) {
+		s, err := snapshot.ReadExpected(Context, backend, name, inspection.Manifest.Checksum)
+		if err != nil {
+			return err
+		}
+		result.Files = s.Entries
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	return printInspection(stdout, result)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
+	"github.com/patrick-ogrady/snowplow/pkg/snapshot"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+// pruneDbCmd represents the prune db command
+var pruneDbCmd = &cobra.Command{
+	Use:   "prune [destination]",
+	Short: "remove db backups that are not selected by a retention policy",
+	Args:  cobra.ExactArgs(1),
+	RunE:  pruneDbFunc,
+}
+
+var (
+	pruneDbPolicy catalog.Policy
+	pruneDbDryRun bool
+)
+
+func init() {
+	dbCmd.AddCommand(pruneDbCmd)
+
+	pruneDbCmd.Flags().IntVar(
+		&pruneDbPolicy.KeepLast,
+		"keep-last",
+		0,
+		"keep the n most recent backups",
+	)
+	pruneDbCmd.Flags().IntVar(
+		&pruneDbPolicy.KeepDaily,
+		"keep-daily",
+		0,
+		"keep the most recent backup of each of the n most recent days",
+	)
+	pruneDbCmd.Flags().IntVar(
+		&pruneDbPolicy.KeepWeekly,
+		"keep-weekly",
+		0,
+		"keep the most recent backup of each of the n most recent weeks",
+	)
+	pruneDbCmd.Flags().BoolVar(
+		&pruneDbDryRun,
+		"dry-run",
+		false,
+		"print the backups that would be removed without removing them",
+	)
+}
+
+// pruneDb removes the db backups in destination that are
+// not selected by policy (and any blobs that are no longer
+// referenced) and returns the number of backups removed.
+// If dryRun, nothing is removed.
+func pruneDb(ctx context.Context, destination string, policy *catalog.Policy, dryRun bool) (int, error) {
+	// Create storage backend
+	backend, err := storage.NewBackend(ctx, destination)
+	if err != nil {
+		return 0, fmt.Errorf("%w: could not create storage backend for %s", err, destination)
+	}
+	defer backend.Close()
+
+	// Apply policy
+	manifests, err := catalog.List(ctx, backend, catalog.DB)
+	if err != nil {
+		return 0, fmt.Errorf("%w: could not list backups in %s", err, destination)
+	}
+	keep, remove := policy.Apply(manifests)
+
+	// Remove backups
+	for _, manifest := range remove {
+		if dryRun {
+			fmt.Printf("would remove %s\n", manifest.Name)
+			continue
+		}
+
+		if err := catalog.Delete(ctx, backend, manifest.Name); err != nil {
+			return 0, fmt.Errorf("%w: could not remove %s", err, manifest.Name)
+		}
+		fmt.Printf("removed %s\n", manifest.Name)
+	}
+
+	if dryRun {
+		fmt.Printf("would keep %d and remove %d backups in %s\n", len(keep), len(remove), destination)
+		return len(remove), nil
+	}
+
+	fmt.Printf("kept %d and removed %d backups in %s\n", len(keep), len(remove), destination)
+
+	// Remove blobs of incremental backups that are no
+	// longer referenced
+	blobs, size, err := snapshot.GC(ctx, backend, false)
+	if err != nil {
+		return 0, fmt.Errorf("%w: could not remove unreferenced blobs in %s", err, destination)
+	}
+	if blobs > 0 {
+		fmt.Printf("removed %d unreferenced blobs (%d bytes) in %s\n", blobs, size, destination)
+	}
+
+	return len(remove), nil
+}
+
+func pruneDbFunc(cmd *cobra.Command, args []string) error {
+	// Check if policy is valid
+	if err := pruneDbPolicy.Validate(); err != nil {
+		return fmt.Errorf("%w: invalid retention policy", err)
+	}
+
+	// Prune backups
+	_, err := pruneDb(Context, args[0], &pruneDbPolicy, pruneDbDryRun)
+	return err
+}
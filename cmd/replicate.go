@@ -0,0 +1,215 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/patrick-ogrady/snowplow/pkg/backup"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+// backupDestination is one of the destinations a backup is
+// replicated to.
+type backupDestination struct {
+	url     string
+	backend storage.Backend
+	result  *storage.UploadResult
+
+	// err is the first failure of the backup to url (nil if
+	// it succeeded).
+	err error
+}
+
+// replication is the outcome of a backup of object to
+// several destinations.
+type replication struct {
+	object       string
+	destinations []*backupDestination
+}
+
+// validateDestinations checks that destinations are unique
+// and that quorum of them can succeed.
+func validateDestinations(destinations []string, quorum int) error {
+	if len(destinations) == 0 {
+		return errors.New("at least 1 destination is required")
+	}
+
+	seen := map[string]struct{}{}
+	for _, destination := range destinations {
+		if _, ok := seen[destination]; ok {
+			return fmt.Errorf("destination %s is provided more than once", destination)
+		}
+		seen[destination] = struct{}{}
+	}
+
+	if quorum < 1 || quorum > len(destinations) {
+		return fmt.Errorf("quorum must be between 1 and %d (got %d)", len(destinations), quorum)
+	}
+
+	return nil
+}
+
+// newReplication creates a backend for each destination. A
+// destination without a backend is recorded as failed.
+func newReplication(ctx context.Context, object string, destinations []string) *replication {
+	r := &replication{object: object}
+	for _, url := range destinations {
+		d := &backupDestination{url: url}
+		backend, err := storage.NewBackend(ctx, url)
+		if err != nil {
+			d.err = fmt.Errorf("%w: could not create storage backend", err)
+		} else {
+			d.backend = backend
+		}
+		r.destinations = append(r.destinations, d)
+	}
+
+	return r
+}
+
+// close closes every backend.
+func (r *replication) close() {
+	for _, d := range r.destinations {
+		if d.backend != nil {
+			_ = d.backend.Close()
+		}
+	}
+}
+
+// live returns the destinations that have not failed.
+func (r *replication) live() []*backupDestination {
+	live := []*backupDestination{}
+	for _, d := range r.destinations {
+		if d.err == nil {
+			live = append(live, d)
+		}
+	}
+
+	return live
+}
+
+// each calls f for every destination that has not failed
+// (concurrently) and records any failure.
+func (r *replication) each(f func(d *backupDestination) error) {
+	var wg sync.WaitGroup
+	for _, d := range r.live() {
+		wg.Add(1)
+		go func(d *backupDestination) {
+			defer wg.Done()
+			d.err = f(d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+// backup streams an archive of path (relative to base) to
+// every destination that has not failed with
+// backup.Replicate. upload returns the uploader of each
+// destination (if nil, storage.UploadWithChecksum is used).
+func (r *replication) backup(
+	ctx context.Context,
+	base string,
+	path string,
+	opts *backup.Options,
+	upload func(destination string) backup.ReplicaUploader,
+) error {
+	live := r.live()
+	if len(live) == 0 {
+		return nil
+	}
+
+	replicas := make([]*backup.Replica, len(live))
+	for i, d := range live {
+		replicas[i] = &backup.Replica{Destination: d.url, Backend: d.backend}
+		if upload != nil {
+			replicas[i].Upload = upload(d.url)
+		}
+	}
+
+	results, err := backup.Replicate(ctx, replicas, r.object, base, path, opts)
+	if err != nil {
+		return err
+	}
+
+	for i, result := range results {
+		live[i].result, live[i].err = result.Result, result.Err
+	}
+
+	return nil
+}
+
+// succeeded returns the number of destinations that have
+// not failed.
+func (r *replication) succeeded() int {
+	return len(r.live())
+}
+
+// check prints the outcome of each destination and returns
+// an error if fewer than quorum destinations succeeded.
+func (r *replication) check(quorum int) error {
+	for _, d := range r.destinations {
+		if d.err != nil {
+			fmt.Printf("failed to back up %s to %s: %s\n", r.object, d.url, d.err.Error())
+			continue
+		}
+
+		fmt.Printf("backed up %s to %s\n", r.object, d.url)
+	}
+
+	if r.succeeded() < quorum {
+		return fmt.Errorf(
+			"%s was backed up to %d of %d destinations (quorum is %d): %s",
+			r.object,
+			r.succeeded(),
+			len(r.destinations),
+			quorum,
+			r.failures(),
+		)
+	}
+
+	return nil
+}
+
+// failures describes every failed destination.
+func (r *replication) failures() string {
+	failures := []string{}
+	for _, d := range r.destinations {
+		if d.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", d.url, d.err.Error()))
+		}
+	}
+
+	return strings.Join(failures, ", ")
+}
+
+// String summarizes the outcome of the backup (ex: to
+// include in a notification).
+func (r *replication) String() string {
+	summary := fmt.Sprintf("%s to %d of %d destinations", r.object, r.succeeded(), len(r.destinations))
+	if r.succeeded() == len(r.destinations) {
+		return summary
+	}
+
+	return fmt.Sprintf("%s (failed: %s)", summary, r.failures())
+}
@@ -20,25 +20,89 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
 	"github.com/spf13/cobra"
 
+	"github.com/patrick-ogrady/snowplow/pkg/backup"
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
 	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/snapshot"
 	"github.com/patrick-ogrady/snowplow/pkg/storage"
+	"github.com/patrick-ogrady/snowplow/pkg/transfer"
 )
 
 // restoreDbCmd represents the restore db command
 var restoreDbCmd = &cobra.Command{
-	Use:   "restore [bucket] [name]",
-	Short: "restore db from google cloud storage",
+	Use:   "restore [destination] [name]",
+	Short: "restore db from a storage destination",
 	RunE:  restoreDbFunc,
 	Args:  cobra.ExactArgs(2), // nolint:gomnd
 }
 
+var (
+	restoreDbCompression   string
+	restoreDbResumable     bool
+	restoreDbWorkers       int
+	restoreDbMaxBandwidth  string
+	restoreDbIncremental   bool
+	restoreDbTrustedKeys   []string
+	restoreDbNodeID        string
+	restoreDbAllowUnsigned bool
+)
+
 func init() {
 	dbCmd.AddCommand(restoreDbCmd)
+	restoreDbCmd.Flags().StringVar(
+		&restoreDbCompression,
+		"compression",
+		string(compression.Gzip),
+		"compression format of the backup (gzip or zstd)",
+	)
+	restoreDbCmd.Flags().BoolVar(
+		&restoreDbResumable,
+		"resumable",
+		false,
+		"download to a local file first so an interrupted download can be resumed by running the same command again",
+	)
+	restoreDbCmd.Flags().IntVar(
+		&restoreDbWorkers,
+		"workers",
+		transfer.DefaultWorkers,
+		"number of parts (or files of an incremental backup) to download concurrently (each worker holds a part in memory)",
+	)
+	restoreDbCmd.Flags().StringVar(
+		&restoreDbMaxBandwidth,
+		"max-bandwidth",
+		"",
+		"maximum combined bandwidth of all workers (ex: 50MiB/s)",
+	)
+	restoreDbCmd.Flags().BoolVar(
+		&restoreDbIncremental,
+		"incremental",
+		false,
+		"restore an incremental backup",
+	)
+	restoreDbCmd.Flags().StringArrayVar(
+		&restoreDbTrustedKeys,
+		"trusted-key",
+		[]string{},
+		"require the manifest to be signed by the public key (or certificate) in this file (can be repeated)",
+	)
+	restoreDbCmd.Flags().StringVar(
+		&restoreDbNodeID,
+		"node-id",
+		"",
+		"require the manifest to be signed by the staking key of this NodeID",
+	)
+	restoreDbCmd.Flags().BoolVar(
+		&restoreDbAllowUnsigned,
+		"allow-unsigned",
+		false,
+		"restore backups without a signed manifest (ex: backups created before manifests were signed)",
+	)
 
 	// Here you will define your flags and configuration settings.
 
@@ -57,28 +121,116 @@ func restoreDbFunc(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("%s is not empty directory", dbDirectory)
 	}
 
-	// Download backup
-	bucket := args[0]
+	// Check if compression format is supported
+	format, err := compression.ParseFormat(restoreDbCompression)
+	if err != nil {
+		return err
+	}
+
+	// Check if transfer options are valid
+	transferOpts, err := transferOptions(restoreDbWorkers, restoreDbMaxBandwidth, restoreDbResumable)
+	if err != nil {
+		return err
+	}
+
+	// Create storage backend
+	destination := args[0]
+	backend, err := storage.NewBackend(Context, destination)
+	if err != nil {
+		return fmt.Errorf("%w: could not create storage backend for %s", err, destination)
+	}
+	defer backend.Close()
+
+	// Check if the manifest is signed by a trusted key before
+	// downloading anything (the download is verified against
+	// the checksum in the signed manifest)
 	name := args[1]
-	tarFilePath := fmt.Sprintf("%s.tar.gz", name)
-	if err := storage.Download(
-		Context,
-		bucket,
-		tarFilePath,
-	); err != nil {
-		return fmt.Errorf("%w: unable to download %s", err, tarFilePath)
+	objectName := name + format.Extension()
+	if restoreDbIncremental {
+		objectName = snapshot.Name(name)
+	}
+	transferOpts.Expected, err = verifyDbManifest(backend, objectName)
+	if err != nil {
+		return err
 	}
 
-	// Untar credentials
-	if err := compression.Decompress(tarFilePath, "."); err != nil {
-		return fmt.Errorf("%w: could not decompress %s", err, tarFilePath)
+	// Restore incremental backup
+	if restoreDbIncremental {
+		if err := snapshot.Restore(
+			Context,
+			backend,
+			objectName,
+			".",
+			dbDirectory,
+			&snapshot.Options{
+				Workers:  transferOpts.Workers,
+				Limiter:  transferOpts.Limiter,
+				Checksum: transferOpts.Expected,
+			},
+		); err != nil {
+			return fmt.Errorf("%w: unable to restore %s", err, objectName)
+		}
+
+		fmt.Printf("successfully restored %s to %s\n", name, dbDirectory)
+		return nil
 	}
 
-	// Cleanup
-	if err := os.Remove(tarFilePath); err != nil {
-		return fmt.Errorf("%w: unable to delete %s", err, tarFilePath)
+	// Restore db (downloading to a local file first
+	// if resumable)
+	opts := &backup.Options{
+		Format:   format,
+		Download: streamDownloader(transferOpts),
+	}
+	if restoreDbResumable {
+		opts.Download = resumableDownloader(destination, transferOpts)
+	}
+	if err := backup.Restore(
+		Context,
+		backend,
+		objectName,
+		".",
+		dbDirectory,
+		opts,
+	); err != nil {
+		return fmt.Errorf("%w: unable to restore %s", err, objectName)
 	}
 
 	fmt.Printf("successfully restored %s to %s\n", name, dbDirectory)
 	return nil
 }
+
+// verifyDbManifest checks that the manifest of name was signed
+// by a key trusted with --trusted-key or --node-id and returns
+// the checksum in the manifest (which the download must
+// match). Unless --allow-unsigned is provided, name is never
+// restored without a signed manifest. If it is provided and
+// the manifest is not signed (or no key is trusted), an empty
+// checksum is returned.
+func verifyDbManifest(backend storage.Backend, name string) (string, error) {
+	verifier, err := loadVerifier(restoreDbTrustedKeys, restoreDbNodeID)
+	if err != nil {
+		return "", err
+	}
+	if verifier == nil {
+		if !restoreDbAllowUnsigned {
+			return "", fmt.Errorf(
+				"cannot verify signature of %s (use --trusted-key or --node-id, or --allow-unsigned)",
+				name,
+			)
+		}
+
+		fmt.Printf("WARNING: restoring %s without verifying its signature\n", name)
+		return "", nil
+	}
+
+	manifest, err := catalog.ReadVerified(Context, backend, name, verifier)
+	switch {
+	case err == nil:
+		return manifest.Checksum, nil
+	case restoreDbAllowUnsigned && (errors.Is(err, catalog.ErrUnsigned) || errors.Is(err, storage.ErrObjectNotFound)):
+		fmt.Printf("WARNING: restoring %s without verifying its signature\n", name)
+		return "", nil
+	default:
+		return "", fmt.Errorf("%w: could not verify signature of %s", err, name)
+	}
+}
@@ -20,37 +20,96 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 
+	"github.com/patrick-ogrady/snowplow/pkg/backup"
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
 	"github.com/patrick-ogrady/snowplow/pkg/compression"
 	"github.com/patrick-ogrady/snowplow/pkg/encryption"
+	"github.com/patrick-ogrady/snowplow/pkg/integrity"
 	"github.com/patrick-ogrady/snowplow/pkg/storage"
 	"github.com/patrick-ogrady/snowplow/pkg/utils"
 )
 
 // restoreKeysCmd represents the restore keys command
 var restoreKeysCmd = &cobra.Command{
-	Use:   "restore [bucket] [node ID]",
-	Short: "restore staking credentials from google cloud storage",
+	Use:   "restore [destination] [node ID]",
+	Short: "restore staking credentials from a storage destination",
 	RunE:  restoreKeysFunc,
 	Args:  cobra.ExactArgs(2), // nolint:gomnd
 }
 
+var (
+	restoreIdentities    []string
+	restoreVersion       string
+	restoreTrustedKeys   []string
+	restoreAllowUnsigned bool
+)
+
 func init() {
 	stakingCmd.AddCommand(restoreKeysCmd)
 
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// restoreCmd.PersistentFlags().String("foo", "", "A help for foo")
+	restoreKeysCmd.Flags().StringArrayVar(
+		&restoreIdentities,
+		"identity",
+		[]string{},
+		"decrypt with the OpenPGP private key in this file instead of a passphrase (can be repeated)",
+	)
+	restoreKeysCmd.Flags().StringVar(
+		&restoreVersion,
+		"version",
+		"",
+		"version of the backup to restore (defaults to the latest)",
+	)
+	restoreKeysCmd.Flags().StringArrayVar(
+		&restoreTrustedKeys,
+		"trusted-key",
+		[]string{},
+		"require the manifest to be signed by the public key (or certificate) in this file instead of the staking key of the NodeID (can be repeated)",
+	)
+	restoreKeysCmd.Flags().BoolVar(
+		&restoreAllowUnsigned,
+		"allow-unsigned",
+		false,
+		"restore backups without a signed manifest (ex: backups created before manifests were signed)",
+	)
+}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// restoreCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+// verifiedDownloader returns a backup.Downloader that
+// downloads the entire object into memory and only writes
+// it once its checksum matches checksum (from a verified
+// manifest), so nothing is decrypted before it is verified.
+func verifiedDownloader(checksum string) backup.Downloader {
+	return func(ctx context.Context, backend storage.Backend, name string, w io.Writer) error {
+		var buf bytes.Buffer
+		if err := storage.Download(ctx, backend, name, &buf); err != nil {
+			return err
+		}
+
+		downloaded, err := integrity.Checksum(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return err
+		}
+		if downloaded != checksum {
+			return fmt.Errorf(
+				"%w: expected checksum %s (from signed manifest) but got %s",
+				storage.ErrChecksumMismatch,
+				checksum,
+				downloaded,
+			)
+		}
+
+		_, err = io.Copy(w, &buf)
+		return err
+	}
 }
 
 func restoreKeysFunc(cmd *cobra.Command, args []string) error {
@@ -59,51 +118,118 @@ func restoreKeysFunc(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("%s is not empty directory", stakingDirectory)
 	}
 
-	// Download credentials
-	bucket := args[0]
-	printableNodeID := args[1]
-	encryptedFilePath := fmt.Sprintf("%s.tar.gz.gpg", printableNodeID)
-	if err := storage.Download(
-		Context,
-		bucket,
-		encryptedFilePath,
-	); err != nil {
-		return fmt.Errorf("%w: unable to download %s", err, encryptedFilePath)
+	// Load identities and passphrase (only needed if there are no
+	// identities or the identities are encrypted)
+	identities, err := encryption.LoadKeys(restoreIdentities...)
+	if err != nil {
+		return fmt.Errorf("%w: could not load identities", err)
 	}
 
-	// Decrypt
-	tarFile := fmt.Sprintf("%s.tar.gz", printableNodeID)
-	if err := encryption.Decrypt(encryptedFilePath, tarFile); err != nil {
-		return fmt.Errorf("%w: could not decrypt credentials", err)
+	var passphrase []byte
+	if len(identities) == 0 || encryption.HasEncryptedPrivateKeys(identities) {
+		passphrase, err = encryption.LoadPassphrase(false)
+		if err != nil {
+			return fmt.Errorf("%w: could not load passphrase", err)
+		}
 	}
 
-	// Untar credentials
-	if err := compression.Decompress(tarFile, "."); err != nil {
-		return fmt.Errorf("%w: could not decompress %s", err, tarFile)
+	// Create storage backend
+	destination := args[0]
+	backend, err := storage.NewBackend(Context, destination)
+	if err != nil {
+		return fmt.Errorf("%w: could not create storage backend for %s", err, destination)
+	}
+	defer backend.Close()
+
+	// Resolve version (falling back to an unversioned backup
+	// if no versioned backups exist)
+	printableNodeID := args[1]
+	name, err := keysObjectName(backend, printableNodeID)
+	if err != nil {
+		return fmt.Errorf("%w: could not find backup of %s", err, printableNodeID)
 	}
 
-	// Verify Credential Matches
-	nodeID, err := utils.LoadNodeID(stakingCertPath)
+	// Check if the manifest was signed by the requested NodeID
+	// (or a trusted key) before downloading anything
+	verifier, err := loadVerifier(restoreTrustedKeys, printableNodeID)
 	if err != nil {
-		return fmt.Errorf("%w: could not calculate recovered NodeID", err)
+		return err
 	}
-	recoveredNodeID := utils.PrintableNodeID(nodeID)
-	if printableNodeID != recoveredNodeID {
-		return fmt.Errorf(
-			"recovered NodeID %s does not match requested NodeID %s",
-			recoveredNodeID,
-			printableNodeID,
-		)
+	var download backup.Downloader
+	manifest, err := catalog.ReadVerified(Context, backend, name, verifier)
+	switch {
+	case err == nil:
+		download = verifiedDownloader(manifest.Checksum)
+	case restoreAllowUnsigned && (errors.Is(err, catalog.ErrUnsigned) || errors.Is(err, storage.ErrObjectNotFound)):
+		fmt.Printf("WARNING: restoring %s without verifying its signature\n", name)
+	default:
+		return fmt.Errorf("%w: could not verify signature of %s", err, name)
 	}
 
-	// Cleanup
-	if err := os.Remove(tarFile); err != nil {
-		return fmt.Errorf("%w: unable to delete %s", err, tarFile)
+	// Restore credentials (only moved into place once the
+	// recovered NodeID matches the requested NodeID)
+	decrypt := func(r io.Reader, w io.Writer) error {
+		if len(identities) > 0 {
+			return encryption.DecryptWithIdentities(r, w, identities, passphrase)
+		}
+
+		return encryption.Decrypt(r, w, passphrase)
+	}
+	verify := func(root string) error {
+		nodeID, err := utils.LoadNodeID(filepath.Join(root, stakingCertPath))
+		if err != nil {
+			return fmt.Errorf("%w: could not calculate recovered NodeID", err)
+		}
+
+		recoveredNodeID := utils.PrintableNodeID(nodeID)
+		if printableNodeID != recoveredNodeID {
+			return fmt.Errorf(
+				"recovered NodeID %s does not match requested NodeID %s",
+				recoveredNodeID,
+				printableNodeID,
+			)
+		}
+
+		return nil
 	}
-	if err := os.Remove(encryptedFilePath); err != nil {
-		return fmt.Errorf("%w: unable to delete %s", err, encryptedFilePath)
+	if err := backup.Restore(
+		Context,
+		backend,
+		name,
+		".",
+		stakingDirectory,
+		&backup.Options{
+			Format:   compression.Gzip,
+			Decrypt:  decrypt,
+			Verify:   verify,
+			Download: download,
+		},
+	); err != nil {
+		return fmt.Errorf("%w: unable to restore %s", err, name)
 	}
 
-	fmt.Printf("successfully restored %s to %s\n", printableNodeID, stakingDirectory)
+	fmt.Printf("successfully restored %s from %s to %s\n", printableNodeID, name, stakingDirectory)
 	return nil
 }
+
+// keysObjectName returns the name of the backup of
+// printableNodeID to restore.
+func keysObjectName(backend storage.Backend, printableNodeID string) (string, error) {
+	if len(restoreVersion) > 0 {
+		if err := catalog.ValidateVersion(restoreVersion); err != nil {
+			return "", err
+		}
+
+		return catalog.VersionedName(printableNodeID, restoreVersion, keysExtension), nil
+	}
+
+	version, err := catalog.ReadLatest(Context, backend, printableNodeID)
+	if errors.Is(err, catalog.ErrNoLatest) {
+		return legacyKeysObjectName(printableNodeID), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return catalog.VersionedName(printableNodeID, version, keysExtension), nil
+}
@@ -63,6 +63,13 @@ var (
 		fmt.Sprintf(".%s", constants.AppName),
 		"db",
 	)
+
+	// controlSocket is the unix socket (relative to homeDir)
+	// that snowplow run listens on for db snapshot requests.
+	controlSocket = filepath.Join(
+		fmt.Sprintf(".%s", constants.AppName),
+		"snowplow.sock",
+	)
 )
 
 var (
@@ -25,8 +25,10 @@ import (
 	"path/filepath"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
 	"github.com/patrick-ogrady/snowplow/pkg/avalanchego"
+	"github.com/patrick-ogrady/snowplow/pkg/health"
 	"github.com/patrick-ogrady/snowplow/pkg/metrics"
 	"github.com/patrick-ogrady/snowplow/pkg/notifier"
 	"github.com/patrick-ogrady/snowplow/pkg/utils"
@@ -53,7 +55,27 @@ func init() {
 	// runCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
+// loadMonitorConfig returns the monitor section of
+// .snowplow.yaml (populated from the profile of its network).
+func loadMonitorConfig() (*health.Config, error) {
+	config := &health.Config{}
+	if err := viper.UnmarshalKey("monitor", config); err != nil {
+		return nil, fmt.Errorf("%w: could not parse monitor config", err)
+	}
+
+	config, err := config.WithDefaults()
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid monitor config", err)
+	}
+
+	return config, nil
+}
+
 func runFunc(cmd *cobra.Command, args []string) error {
+	// Scheduled backups archive stakingDirectory relative
+	// to homeDir
+	backupStakingDirectory := stakingDirectory
+
 	// Modify staking paths (avalanchego binary assumes all in homeDir)
 	stakingDirectory = filepath.Join(homeDir, stakingDirectory)
 	stakingKeyPath = filepath.Join(homeDir, stakingKeyPath)
@@ -92,9 +114,29 @@ func runFunc(cmd *cobra.Command, args []string) error {
 		defer writer.Close()
 	}
 
+	// Load monitor config
+	monitorConfig, err := loadMonitorConfig()
+	if err != nil {
+		return err
+	}
+
+	// Schedule backups
+	scheduler, err := newScheduler(printableNodeID, notifier, writer, backupStakingDirectory)
+	if err != nil {
+		return fmt.Errorf("%w: could not schedule backups", err)
+	}
+
 	// Run avalanchego
 	notifier.Info("starting")
-	runErr := avalanchego.Run(Context, printableNodeID, notifier, writer)
+	node := &health.Node{
+		ID:              printableNodeID,
+		SnowplowVersion: snowplowVersion,
+	}
+	runErr := avalanchego.Run(Context, node, notifier, writer, &avalanchego.Paths{
+		Home:          homeDir,
+		DBDirectory:   dbDirectory,
+		ControlSocket: controlSocket,
+	}, monitorConfig, scheduler)
 	if runErr == nil || (runErr != nil && SignalReceived) {
 		notifier.Info("stopping")
 		return nil
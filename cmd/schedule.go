@@ -0,0 +1,275 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/spf13/viper"
+
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/encryption"
+	"github.com/patrick-ogrady/snowplow/pkg/scheduler"
+	"github.com/patrick-ogrady/snowplow/pkg/transfer"
+)
+
+// backupConfig is the backup section of .snowplow.yaml.
+type backupConfig struct {
+	DB      *dbScheduleConfig      `mapstructure:"db"`
+	Staking *stakingScheduleConfig `mapstructure:"staking"`
+}
+
+// dbScheduleConfig describes scheduled db backups (see
+// snowplow db backup and snowplow db prune).
+type dbScheduleConfig struct {
+	Schedule     string          `mapstructure:"schedule"`
+	Destination  string          `mapstructure:"destination"`
+	Destinations []string        `mapstructure:"destinations"`
+	Quorum       int             `mapstructure:"quorum"`
+	Compression  string          `mapstructure:"compression"`
+	Incremental  bool            `mapstructure:"incremental"`
+	Consistent   bool            `mapstructure:"consistent"`
+	Workers      int             `mapstructure:"workers"`
+	MaxBandwidth string          `mapstructure:"maxBandwidth"`
+	SigningKey   string          `mapstructure:"signingKey"`
+	Retention    *catalog.Policy `mapstructure:"retention"`
+}
+
+// stakingScheduleConfig describes scheduled staking
+// credential backups (see snowplow staking backup).
+type stakingScheduleConfig struct {
+	Schedule     string   `mapstructure:"schedule"`
+	Destination  string   `mapstructure:"destination"`
+	Destinations []string `mapstructure:"destinations"`
+	Quorum       int      `mapstructure:"quorum"`
+	Recipients   []string `mapstructure:"recipients"`
+	SigningKey   string   `mapstructure:"signingKey"`
+}
+
+// scheduleDestinations returns every configured destination
+// (destination is the single destination supported before
+// backups could be replicated) and the quorum (which
+// defaults to 1).
+func scheduleDestinations(destination string, destinations []string, quorum int) ([]string, int, error) {
+	all := append([]string{}, destinations...)
+	if len(destination) > 0 {
+		all = append([]string{destination}, all...)
+	}
+
+	if len(all) == 0 {
+		return nil, 0, errors.New("destinations are required")
+	}
+
+	if quorum == 0 {
+		quorum = 1
+	}
+
+	if err := validateDestinations(all, quorum); err != nil {
+		return nil, 0, err
+	}
+
+	return all, quorum, nil
+}
+
+// newScheduler returns a *scheduler.Scheduler running the
+// backups configured in the backup section of .snowplow.yaml.
+// The staking credentials of nodeID are read from path
+// (relative to homeDir).
+func newScheduler(
+	nodeID string,
+	notifier scheduler.Notifier,
+	metricWriter scheduler.MetricWriter,
+	path string,
+) (*scheduler.Scheduler, error) {
+	s := scheduler.NewScheduler(notifier, metricWriter)
+
+	config := &backupConfig{}
+	if err := viper.UnmarshalKey("backup", config); err != nil {
+		return nil, fmt.Errorf("%w: could not parse backup config", err)
+	}
+
+	if config.DB != nil {
+		job, err := dbBackupJob(nodeID, config.DB)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid backup.db config", err)
+		}
+
+		if err := s.Add(job); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Staking != nil {
+		job, err := stakingBackupJob(nodeID, path, config.Staking)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid backup.staking config", err)
+		}
+
+		if err := s.Add(job); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// dbBackupJob returns a job that backs up the db and then
+// applies the retention policy (if any).
+func dbBackupJob(nodeID string, config *dbScheduleConfig) (*scheduler.Job, error) {
+	// Check if destinations are valid
+	destinations, quorum, err := scheduleDestinations(config.Destination, config.Destinations, config.Quorum)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if compression format is supported
+	format := compression.Gzip
+	if len(config.Compression) > 0 {
+		var err error
+		format, err = compression.ParseFormat(config.Compression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check if transfer options are valid
+	workers := config.Workers
+	if workers == 0 {
+		workers = transfer.DefaultWorkers
+	}
+	transferOpts, err := transferOptions(workers, config.MaxBandwidth, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if retention policy is valid
+	if config.Retention != nil {
+		if err := config.Retention.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: invalid retention policy", err)
+		}
+	}
+
+	// Load manifest signer
+	signer, err := loadSigner(config.SigningKey, false)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &dbBackupOptions{
+		format:      format,
+		incremental: config.Incremental,
+		consistent:  config.Consistent,
+		transfer:    transferOpts,
+		signer:      signer,
+		quorum:      quorum,
+	}
+	return &scheduler.Job{
+		Kind:     string(catalog.DB),
+		Schedule: config.Schedule,
+		Run: func(ctx context.Context) (string, error) {
+			name := fmt.Sprintf("%s-%s", catalog.DB, catalog.NewVersion(time.Now()))
+			targets, err := backupDb(ctx, destinations, name, nodeID, homeDir, opts)
+			if err != nil {
+				return "", err
+			}
+
+			if config.Retention == nil {
+				return targets.String(), nil
+			}
+
+			// Only destinations the new backup is stored
+			// in are pruned
+			removed := 0
+			for _, d := range targets.live() {
+				n, err := pruneDb(ctx, d.url, config.Retention, false)
+				if err != nil {
+					return "", fmt.Errorf("%w: backed up %s but could not prune %s", err, targets, d.url)
+				}
+				removed += n
+			}
+
+			return fmt.Sprintf("%s (pruned %d backups)", targets, removed), nil
+		},
+	}, nil
+}
+
+// stakingBackupJob returns a job that backs up the staking
+// credentials in path (relative to homeDir). Credentials are
+// encrypted to the configured recipients or, if there are
+// none, with the passphrase in encryption.PassphraseEnv.
+func stakingBackupJob(nodeID string, path string, config *stakingScheduleConfig) (*scheduler.Job, error) {
+	// Check if destinations are valid
+	destinations, quorum, err := scheduleDestinations(config.Destination, config.Destinations, config.Quorum)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load recipients (or passphrase if there are none)
+	var (
+		recipients openpgp.EntityList
+		passphrase []byte
+	)
+	if len(config.Recipients) > 0 {
+		recipients, err = encryption.LoadKeys(config.Recipients...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not load recipients", err)
+		}
+	} else {
+		passphrase = []byte(os.Getenv(encryption.PassphraseEnv))
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("recipients or %s is required", encryption.PassphraseEnv)
+		}
+	}
+
+	// Load manifest signer
+	signer, err := loadSigner(config.SigningKey, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scheduler.Job{
+		Kind:     string(catalog.Staking),
+		Schedule: config.Schedule,
+		Run: func(ctx context.Context) (string, error) {
+			version, targets, err := backupKeys(
+				ctx,
+				destinations,
+				quorum,
+				nodeID,
+				homeDir,
+				path,
+				recipients,
+				passphrase,
+				signer,
+			)
+			if err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("%s version %s: %s", nodeID, version, targets), nil
+		},
+	}, nil
+}
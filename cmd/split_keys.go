@@ -0,0 +1,145 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/shamir"
+	"github.com/patrick-ogrady/snowplow/pkg/utils"
+)
+
+// splitKeysCmd represents the split keys command
+var splitKeysCmd = &cobra.Command{
+	Use:   "split [threshold] [shares]",
+	Short: "split staking credentials into shares using Shamir's Secret Sharing",
+	Args:  cobra.ExactArgs(2), // nolint:gomnd
+	RunE:  splitKeysFunc,
+}
+
+var splitOutputDirectory string
+
+func init() {
+	stakingCmd.AddCommand(splitKeysCmd)
+
+	splitKeysCmd.Flags().StringVar(
+		&splitOutputDirectory,
+		"output",
+		".",
+		"directory to write shares to",
+	)
+}
+
+func splitKeysFunc(cmd *cobra.Command, args []string) error {
+	threshold, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("%w: invalid threshold %s", err, args[0])
+	}
+
+	shareCount, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("%w: invalid shares %s", err, args[1])
+	}
+
+	// Check if stakingDirectory is empty
+	if _, err := os.Stat(stakingDirectory); os.IsNotExist(err) {
+		return fmt.Errorf("%s is an empty directory", stakingDirectory)
+	}
+
+	// Check if staking key exists
+	if _, err := os.Stat(stakingKeyPath); os.IsNotExist(err) {
+		return fmt.Errorf("staking key at %s does not exist", stakingKeyPath)
+	}
+
+	// Check if staking certificate exists
+	if _, err := os.Stat(stakingCertPath); os.IsNotExist(err) {
+		return fmt.Errorf("staking certificate at %s does not exist", stakingCertPath)
+	}
+
+	// Load NodeID
+	nodeID, err := utils.LoadNodeID(stakingCertPath)
+	if err != nil {
+		return fmt.Errorf("%w: could not calculate NodeID", err)
+	}
+	printableNodeID := utils.PrintableNodeID(nodeID)
+
+	// Tar Credentials
+	var archive bytes.Buffer
+	if err := compression.Compress(&archive, ".", stakingDirectory, compression.Gzip); err != nil {
+		return fmt.Errorf("%w: could not compress credentials", err)
+	}
+
+	// Split Credentials
+	shares, err := shamir.Split(printableNodeID, archive.Bytes(), shareCount, threshold)
+	if err != nil {
+		return fmt.Errorf("%w: could not split credentials", err)
+	}
+
+	// Write Shares
+	if err := os.MkdirAll(splitOutputDirectory, 0700); err != nil { // nolint:gomnd
+		return fmt.Errorf("%w: could not create %s", err, splitOutputDirectory)
+	}
+	for _, share := range shares {
+		blob, err := share.Encode()
+		if err != nil {
+			return fmt.Errorf("%w: could not encode share %d", err, share.Index)
+		}
+
+		sharePath := filepath.Join(
+			splitOutputDirectory,
+			fmt.Sprintf("%s.share-%d-of-%d.txt", printableNodeID, share.Index, shareCount),
+		)
+		if err := writeShare(sharePath, blob); err != nil {
+			return fmt.Errorf("%w: could not write %s", err, sharePath)
+		}
+		fmt.Printf("wrote share %d of %d to %s\n", share.Index, shareCount, sharePath)
+	}
+
+	fmt.Printf(
+		"successfully split %s into %d shares (%d required to combine)\n",
+		printableNodeID,
+		shareCount,
+		threshold,
+	)
+	return nil
+}
+
+// writeShare writes blob to sharePath (failing if sharePath
+// already exists so existing shares are never overwritten).
+func writeShare(sharePath string, blob string) error {
+	f, err := os.OpenFile(sharePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600) // nolint:gomnd
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(blob + "\n"); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
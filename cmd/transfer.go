@@ -0,0 +1,114 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/patrick-ogrady/snowplow/pkg/backup"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+	"github.com/patrick-ogrady/snowplow/pkg/transfer"
+)
+
+// transferOptions returns the options of a db transfer that
+// uses workers workers and is limited to maxBandwidth (ex:
+// 50MiB/s) if it is not empty. If resumable, progress is
+// recorded in the working directory.
+func transferOptions(workers int, maxBandwidth string, resumable bool) (*transfer.Options, error) {
+	if workers <= 0 {
+		return nil, fmt.Errorf("workers must be positive (got %d)", workers)
+	}
+
+	opts := &transfer.Options{Workers: workers}
+	if len(maxBandwidth) > 0 {
+		bytesPerSecond, err := transfer.ParseBandwidth(maxBandwidth)
+		if err != nil {
+			return nil, err
+		}
+
+		opts.Limiter, err = transfer.NewLimiter(bytesPerSecond)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resumable {
+		opts.StateDir = "."
+	}
+
+	return opts, nil
+}
+
+// transferUploader returns a backup.ReplicaUploader that
+// uploads to destination in parallel parts.
+func transferUploader(destination string, opts *transfer.Options) backup.ReplicaUploader {
+	return func(
+		ctx context.Context,
+		backend storage.Backend,
+		name string,
+		r io.Reader,
+		checksum func() string,
+	) (*storage.UploadResult, error) {
+		o := *opts
+		o.Checksum = checksum
+		return transfer.Upload(ctx, backend, destination, name, r, &o)
+	}
+}
+
+// streamDownloader returns a backup.Downloader that downloads
+// parallel parts and streams them in order.
+func streamDownloader(opts *transfer.Options) backup.Downloader {
+	return func(ctx context.Context, backend storage.Backend, name string, w io.Writer) error {
+		return transfer.Stream(ctx, backend, name, w, opts)
+	}
+}
+
+// resumableDownloader returns a backup.Downloader that
+// downloads to a local file (so interrupted downloads from
+// destination can be resumed) and then streams the file.
+// The file is removed once it has been read.
+func resumableDownloader(destination string, opts *transfer.Options) backup.Downloader {
+	return func(ctx context.Context, backend storage.Backend, name string, w io.Writer) error {
+		local := fmt.Sprintf(".snowplow-download-%s", path.Base(name))
+		if err := transfer.Download(ctx, backend, destination, name, local, opts); err != nil {
+			return err
+		}
+
+		f, err := os.Open(local)
+		if err != nil {
+			return fmt.Errorf("%w: could not open %s", err, local)
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(w, f); err != nil {
+			return fmt.Errorf("%w: could not read %s", err, local)
+		}
+
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("%w: could not close %s", err, local)
+		}
+
+		return os.Remove(local)
+	}
+}
@@ -0,0 +1,457 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/patrick-ogrady/snowplow/pkg/backup"
+	"github.com/patrick-ogrady/snowplow/pkg/catalog"
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/encryption"
+	"github.com/patrick-ogrady/snowplow/pkg/snapshot"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+	"github.com/patrick-ogrady/snowplow/pkg/transfer"
+	"github.com/patrick-ogrady/snowplow/pkg/utils"
+	"github.com/patrick-ogrady/snowplow/pkg/verify"
+)
+
+const (
+	// verifyObjectFile is the name of the downloaded object
+	// in the sandbox.
+	verifyObjectFile = "object"
+
+	reportPerm = 0600
+
+	// maxStakingArchiveSize is the maximum size of the
+	// decompressed staking credentials (which are read into
+	// memory).
+	maxStakingArchiveSize = 1 << 20
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [destination] [object]",
+	Short: "restore a backup into a temporary sandbox to verify it",
+	Args:  cobra.ExactArgs(2), // nolint:gomnd
+	RunE:  verifyFunc,
+}
+
+var (
+	verifyIdentities   []string
+	verifySandboxDir   string
+	verifyReport       string
+	verifyTrustedKeys  []string
+	verifyNodeID       string
+	verifyWorkers      int
+	verifyMaxBandwidth string
+)
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringArrayVar(
+		&verifyIdentities,
+		"identity",
+		[]string{},
+		"decrypt staking credentials with the OpenPGP private key in this file instead of a passphrase (can be repeated)",
+	)
+	verifyCmd.Flags().StringVar(
+		&verifySandboxDir,
+		"sandbox-dir",
+		os.TempDir(),
+		"directory to create the sandbox in (must have room for the backup and its contents)",
+	)
+	verifyCmd.Flags().StringVar(
+		&verifyReport,
+		"report",
+		"",
+		"write the JSON report to this file instead of stdout",
+	)
+	verifyCmd.Flags().StringArrayVar(
+		&verifyTrustedKeys,
+		"trusted-key",
+		[]string{},
+		"require the manifest to be signed by the public key (or certificate) in this file (can be repeated)",
+	)
+	verifyCmd.Flags().StringVar(
+		&verifyNodeID,
+		"node-id",
+		"",
+		"require the manifest to be signed by the staking key of this NodeID (defaults to the NodeID of staking credential backups)",
+	)
+	verifyCmd.Flags().IntVar(
+		&verifyWorkers,
+		"workers",
+		transfer.DefaultWorkers,
+		"number of files of an incremental backup to download concurrently",
+	)
+	verifyCmd.Flags().StringVar(
+		&verifyMaxBandwidth,
+		"max-bandwidth",
+		"",
+		"maximum combined bandwidth of all workers (ex: 50MiB/s)",
+	)
+}
+
+// verifyTarget describes the backup being verified.
+type verifyTarget struct {
+	kind     catalog.Kind
+	nodeID   string
+	manifest *catalog.Manifest
+
+	// incremental is true for snapshots (whose manifest
+	// size is the size of the db rather than the object).
+	incremental bool
+}
+
+// loadVerifyTarget determines what kind of backup name is
+// (using its manifest if it has one).
+func loadVerifyTarget(ctx context.Context, backend storage.Backend, name string) (*verifyTarget, error) {
+	manifest, err := catalog.Read(ctx, backend, name)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, err
+	}
+
+	// Staking credentials are stored as [node ID]/[version]
+	// or (before they were versioned) [node ID].tar.gz.gpg, so
+	// the expected NodeID never depends on the manifest.
+	target := &verifyTarget{
+		kind:        catalog.DB,
+		incremental: strings.HasPrefix(name, snapshot.Prefix),
+		manifest:    manifest,
+	}
+	if err == nil {
+		target.kind = manifest.Kind
+	} else if strings.HasSuffix(name, encryption.Extension) {
+		target.kind = catalog.Staking
+	}
+
+	if target.kind == catalog.Staking {
+		target.nodeID = strings.TrimSuffix(strings.Split(name, "/")[0], keysExtension)
+	}
+
+	return target, nil
+}
+
+// fileDownloader returns a backup.Downloader that reads the
+// local file at p instead of downloading.
+func fileDownloader(p string) backup.Downloader {
+	return func(ctx context.Context, backend storage.Backend, name string, w io.Writer) error {
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("%w: could not open %s", err, p)
+		}
+		defer f.Close()
+
+		_, err = io.Copy(w, f)
+		return err
+	}
+}
+
+// verifyStaking decrypts and decompresses the staking
+// credentials in the downloaded object in memory (so they are
+// never written to disk) and checks that they belong to
+// target.nodeID.
+func verifyStaking(
+	sandbox string,
+	target *verifyTarget,
+	report *verify.Report,
+) error {
+	// Load identities and passphrase (only needed if there are no
+	// identities or the identities are encrypted)
+	identities, err := encryption.LoadKeys(verifyIdentities...)
+	if err != nil {
+		return fmt.Errorf("%w: could not load identities", err)
+	}
+
+	var passphrase []byte
+	if len(identities) == 0 || encryption.HasEncryptedPrivateKeys(identities) {
+		passphrase, err = encryption.LoadPassphrase(false)
+		if err != nil {
+			return fmt.Errorf("%w: could not load passphrase", err)
+		}
+	}
+
+	// Decrypt and decompress credentials (read into memory)
+	f, err := os.Open(filepath.Join(sandbox, verifyObjectFile))
+	if err != nil {
+		return fmt.Errorf("%w: could not open downloaded object", err)
+	}
+	defer f.Close()
+
+	g := &errgroup.Group{}
+	pr, pw := io.Pipe()
+	g.Go(func() error {
+		var err error
+		if len(identities) > 0 {
+			err = encryption.DecryptWithIdentities(f, pw, identities, passphrase)
+		} else {
+			err = encryption.Decrypt(f, pw, passphrase)
+		}
+		_ = pw.CloseWithError(err)
+		return err
+	})
+	files, err := compression.ReadFiles(pr, compression.Gzip, maxStakingArchiveSize)
+	_ = pr.CloseWithError(err)
+	if decryptErr := g.Wait(); decryptErr != nil {
+		err = decryptErr
+	}
+	if !report.Add("restore", err, "decrypted in memory") {
+		return nil
+	}
+
+	// Check if the archive contains credentials
+	cert, ok := files[filepath.ToSlash(stakingCertPath)]
+	if !ok {
+		report.Add("nodeID", fmt.Errorf("%s is missing", stakingCertPath), "")
+		return nil
+	}
+	key, ok := files[filepath.ToSlash(stakingKeyPath)]
+	if !ok {
+		report.Add("keyPair", fmt.Errorf("%s is missing", stakingKeyPath), "")
+		return nil
+	}
+	defer func() {
+		for i := range key {
+			key[i] = 0
+		}
+	}()
+
+	// Check if the recovered NodeID matches
+	parsed, err := utils.ParseStakingCertificate(cert)
+	if err == nil {
+		var nodeID ids.ShortID
+		nodeID, err = utils.CertificateNodeID(parsed)
+		if err == nil {
+			report.NodeID = utils.PrintableNodeID(nodeID)
+		}
+	}
+	if err == nil && len(target.nodeID) > 0 && target.nodeID != report.NodeID {
+		err = fmt.Errorf("recovered NodeID %s does not match expected NodeID %s", report.NodeID, target.nodeID)
+	}
+	report.Add("nodeID", err, report.NodeID)
+
+	// Check if the staking key matches the certificate
+	_, err = tls.X509KeyPair(cert, key)
+	report.Add("keyPair", err, "")
+	return nil
+}
+
+// verifyDb extracts the db in the downloaded object (which
+// matched checksum) into sandbox and reads every database in
+// it.
+func verifyDb(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	checksum string,
+	sandbox string,
+	target *verifyTarget,
+	report *verify.Report,
+) error {
+	transferOpts, err := transferOptions(verifyWorkers, verifyMaxBandwidth, false)
+	if err != nil {
+		return err
+	}
+
+	// Incremental backups are restored from the snapshot
+	// matching checksum (which was verified against the
+	// manifest), so the restored db is bound to the manifest
+	if target.incremental {
+		err = snapshot.Restore(ctx, backend, name, sandbox, dbDirectory, &snapshot.Options{
+			Workers:  transferOpts.Workers,
+			Limiter:  transferOpts.Limiter,
+			Checksum: checksum,
+		})
+	} else {
+		var format compression.Format
+		format, err = compression.FormatFromName(name)
+		if err != nil {
+			return err
+		}
+
+		err = backup.Restore(ctx, backend, name, sandbox, dbDirectory, &backup.Options{
+			Format:   format,
+			Download: fileDownloader(filepath.Join(sandbox, verifyObjectFile)),
+		})
+	}
+	if !report.Add("restore", err, dbDirectory) {
+		return nil
+	}
+
+	// Check if every database is readable
+	entries, err := verify.LevelDB(filepath.Join(sandbox, dbDirectory))
+	details := []string{}
+	for db, n := range entries {
+		details = append(details, fmt.Sprintf("%s: %d entries", path.Join(dbDirectory, filepath.ToSlash(db)), n))
+	}
+	report.Add("leveldb", err, strings.Join(details, ", "))
+	return nil
+}
+
+// writeReport prints every check in report to stderr and
+// writes report as JSON to verifyReport (or stdout, which
+// only ever contains the report).
+func writeReport(report *verify.Report, stdout io.Writer) error {
+	for _, check := range report.Checks {
+		fmt.Fprintf(os.Stderr, "%s passed=%t %s\n", check.Name, check.Passed, check.Detail)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w: could not marshal report", err)
+	}
+
+	if len(verifyReport) == 0 {
+		fmt.Fprintln(stdout, string(data))
+		return nil
+	}
+
+	if err := ioutil.WriteFile(verifyReport, data, reportPerm); err != nil {
+		return fmt.Errorf("%w: could not write report to %s", err, verifyReport)
+	}
+
+	return nil
+}
+
+func verifyFunc(cmd *cobra.Command, args []string) error {
+	// Send all progress (including progress printed while
+	// downloading and restoring) to stderr, so stdout only
+	// contains the report
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	// Create sandbox (never inside .avalanchego)
+	sandbox, err := verify.Sandbox(
+		verifySandboxDir,
+		filepath.Dir(dbDirectory),
+		filepath.Join(homeDir, filepath.Dir(dbDirectory)),
+	)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(sandbox)
+
+	// Create storage backend
+	destination := args[0]
+	backend, err := storage.NewBackend(Context, destination)
+	if err != nil {
+		return fmt.Errorf("%w: could not create storage backend for %s", err, destination)
+	}
+	defer backend.Close()
+
+	// Determine kind of backup
+	name := args[1]
+	target, err := loadVerifyTarget(Context, backend, name)
+	if err != nil {
+		return fmt.Errorf("%w: could not load manifest of %s", err, name)
+	}
+
+	report := verify.NewReport(destination, name)
+	report.Kind = string(target.kind)
+	if err := verifyBackup(Context, backend, name, sandbox, target, report); err != nil {
+		return err
+	}
+	report.Finish()
+
+	if err := writeReport(report, stdout); err != nil {
+		return err
+	}
+
+	if !report.Passed {
+		return fmt.Errorf("verification of %s failed", name)
+	}
+
+	return nil
+}
+
+// verifyBackup downloads name into sandbox, checks its
+// checksum and then restores it into sandbox.
+func verifyBackup(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	sandbox string,
+	target *verifyTarget,
+	report *verify.Report,
+) error {
+	// Check if the manifest is signed by a trusted key (always
+	// checked for staking credentials)
+	nodeID := verifyNodeID
+	if len(nodeID) == 0 {
+		nodeID = target.nodeID
+	}
+	verifier, err := loadVerifier(verifyTrustedKeys, nodeID)
+	if err != nil {
+		return err
+	}
+	if verifier != nil {
+		manifest, err := catalog.ReadVerified(ctx, backend, name, verifier)
+		if !report.Add("signature", err, "") {
+			return nil
+		}
+		target.manifest = manifest
+	}
+
+	// Download object into sandbox
+	local := filepath.Join(sandbox, verifyObjectFile)
+	size, err := verify.Download(ctx, backend, name, local)
+	if err == nil && target.manifest != nil && !target.incremental && target.manifest.Size != size {
+		err = fmt.Errorf("expected %d bytes (from manifest) but got %d", target.manifest.Size, size)
+	}
+	if !report.Add("download", err, fmt.Sprintf("%d bytes", size)) {
+		return nil
+	}
+
+	// Check if the checksum matches the .checksum sidecar
+	// (and the manifest)
+	checksum, err := verify.Checksum(ctx, backend, name, local)
+	if err == nil && target.manifest != nil && target.manifest.Checksum != checksum {
+		err = fmt.Errorf("checksum %s does not match manifest checksum %s", checksum, target.manifest.Checksum)
+	}
+	if !report.Add("checksum", err, checksum) {
+		return nil
+	}
+
+	// Decrypt, decompress and check contents
+	if target.kind == catalog.Staking {
+		return verifyStaking(sandbox, target, report)
+	}
+
+	return verifyDb(ctx, backend, name, checksum, sandbox, target, report)
+}
@@ -25,12 +25,16 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// snowplowVersion is the version of snowplow recorded
+// in backup manifests.
+const snowplowVersion = "v0.0.15"
+
 // versionCmd represents the version command
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print out version of snowplow",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("v0.0.15")
+		fmt.Println(snowplowVersion)
 	},
 }
 
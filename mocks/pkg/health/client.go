@@ -2,7 +2,10 @@
 
 package health
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	client "github.com/patrick-ogrady/snowplow/pkg/client"
+	mock "github.com/stretchr/testify/mock"
+)
 
 // Client is an autogenerated mock type for the Client type
 type Client struct {
@@ -30,15 +33,38 @@ func (_m *Client) IsBootstrapped(chain string) (bool, error) {
 	return r0, r1
 }
 
-// IsHealthy provides a mock function with given fields:
-func (_m *Client) IsHealthy() (bool, error) {
+// Liveness provides a mock function with given fields:
+func (_m *Client) Liveness() (*client.Liveness, error) {
 	ret := _m.Called()
 
-	var r0 bool
-	if rf, ok := ret.Get(0).(func() bool); ok {
+	var r0 *client.Liveness
+	if rf, ok := ret.Get(0).(func() *client.Liveness); ok {
 		r0 = rf()
 	} else {
-		r0 = ret.Get(0).(bool)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*client.Liveness)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// NodeVersion provides a mock function with given fields:
+func (_m *Client) NodeVersion() (string, error) {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
 	}
 
 	var r1 error
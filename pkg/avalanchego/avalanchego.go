@@ -21,32 +21,75 @@ package avalanchego
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 
 	"github.com/patrick-ogrady/snowplow/pkg/client"
 	"github.com/patrick-ogrady/snowplow/pkg/health"
 	"github.com/patrick-ogrady/snowplow/pkg/metrics"
 	"github.com/patrick-ogrady/snowplow/pkg/notifier"
+	"github.com/patrick-ogrady/snowplow/pkg/scheduler"
 	"github.com/patrick-ogrady/snowplow/pkg/server"
+	"github.com/patrick-ogrady/snowplow/pkg/utils"
 )
 
 const (
 	avalanchegoBin  = "/app/avalanchego"
 	avalancheConfig = "/app/avalanchego-config.json"
 
-	// TODO: move to config file
-	healthInterval     = 10 * time.Second
-	statusInterval     = 1 * time.Hour
-	unhealthyThreshold = 1 * time.Minute
-	minPeers           = 400
+	// stopTimeout is how long avalanchego is given to
+	// shut down before it is killed.
+	stopTimeout = 5 * time.Minute
 
-	healthPort = 8080
+	// restartGrace is how long alerts are suppressed after
+	// avalanchego is restarted (unless it becomes healthy
+	// sooner).
+	restartGrace = 10 * time.Minute
+
+	snapshotPattern = ".snowplow-snapshot-"
+	snapshotPath    = "/snapshot"
+	snapshotPerm    = 0700
 )
 
-// Run starts an avalanchego node.
-func Run(ctx context.Context, nodeID string, notifier *notifier.Notifier, metricWriter *metrics.MetricWriter) error {
+// Paths are the locations of the files used by Run.
+type Paths struct {
+	// Home is the directory all other paths are
+	// relative to.
+	Home string
+
+	// DBDirectory is the directory avalanchego stores
+	// its db in.
+	DBDirectory string
+
+	// ControlSocket is the unix socket used to request
+	// snapshots from Run.
+	ControlSocket string
+}
+
+// SnapshotResponse is returned by the control socket once
+// a snapshot has been taken.
+type SnapshotResponse struct {
+	// Root is a directory containing a copy of the db at
+	// Paths.DBDirectory (relative to Root).
+	Root string `json:"root"`
+}
+
+// process is a running avalanchego process.
+type process struct {
+	cmd  *exec.Cmd
+	done chan error
+}
+
+// startProcess starts avalanchego.
+func startProcess() (*process, error) {
 	cmd := exec.Command(
 		avalanchegoBin,
 		"--config-file",
@@ -55,29 +98,217 @@ func Run(ctx context.Context, nodeID string, notifier *notifier.Notifier, metric
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%w: could not start avalanchego", err)
+	}
 
-	// Send interrupt signal if context is
-	// done
+	p := &process{cmd: cmd, done: make(chan error, 1)}
 	go func() {
-		<-ctx.Done()
-		if cmd.Process != nil {
-			_ = cmd.Process.Signal(os.Interrupt)
-		}
+		p.done <- cmd.Wait()
 	}()
 
+	return p, nil
+}
+
+// stop interrupts p and waits for it to exit (killing it if
+// it does not exit within stopTimeout).
+func (p *process) stop() error {
+	_ = p.cmd.Process.Signal(os.Interrupt)
+
+	timer := time.NewTimer(stopTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-p.done:
+		return err
+	case <-timer.C:
+		_ = p.cmd.Process.Kill()
+		return <-p.done
+	}
+}
+
+// snapshotRequest asks the node to copy the db into dst.
+type snapshotRequest struct {
+	dst    string
+	result chan error
+}
+
+// node manages an avalanchego process.
+type node struct {
+	paths     *Paths
+	notifier  *notifier.Notifier
+	monitor   *health.Monitor
+	snapshots chan *snapshotRequest
+}
+
+// run starts avalanchego and restarts it whenever a snapshot
+// is requested until ctx is done or avalanchego exits.
+func (n *node) run(ctx context.Context) error {
+	p, err := startProcess()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case err := <-p.done:
+			return err
+		case <-ctx.Done():
+			_ = p.cmd.Process.Signal(os.Interrupt)
+			return <-p.done
+		case req := <-n.snapshots:
+			p, err = n.snapshot(p, req)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// snapshot stops p, copies the db into req.dst and returns
+// a new avalanchego process. Alerts are suppressed until
+// the new process is healthy.
+func (n *node) snapshot(p *process, req *snapshotRequest) (*process, error) {
+	n.monitor.Pause("stopping avalanchego to take a db snapshot")
+	defer n.monitor.Resume(restartGrace)
+
+	start := time.Now()
+	_ = p.stop()
+	req.result <- cloneDirectory(filepath.Join(n.paths.Home, n.paths.DBDirectory), req.dst)
+
+	p, err := startProcess()
+	if err != nil {
+		return nil, err
+	}
+
+	n.notifier.Info(fmt.Sprintf("restarted avalanchego after db snapshot (%s)", time.Since(start)))
+	return p, nil
+}
+
+// ServeHTTP takes a snapshot of the db for each POST
+// request to snapshotPath.
+func (n *node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != snapshotPath || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	root, err := n.takeSnapshot(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(&SnapshotResponse{Root: root})
+}
+
+// takeSnapshot copies the db into a new directory next to
+// the db (so that files can be hard linked) and returns it.
+func (n *node) takeSnapshot(ctx context.Context) (string, error) {
+	db := filepath.Join(n.paths.Home, n.paths.DBDirectory)
+	root, err := ioutil.TempDir(filepath.Dir(db), snapshotPattern)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not create snapshot directory", err)
+	}
+
+	dst := filepath.Join(root, n.paths.DBDirectory)
+	if err := os.MkdirAll(filepath.Dir(dst), snapshotPerm); err != nil {
+		_ = os.RemoveAll(root)
+		return "", fmt.Errorf("%w: could not create snapshot directory", err)
+	}
+
+	req := &snapshotRequest{dst: dst, result: make(chan error, 1)}
+	select {
+	case n.snapshots <- req:
+	case <-ctx.Done():
+		_ = os.RemoveAll(root)
+		return "", ctx.Err()
+	}
+
+	// The snapshot is always completed once requested
+	if err := <-req.result; err != nil {
+		_ = os.RemoveAll(root)
+		return "", fmt.Errorf("%w: could not copy db", err)
+	}
+
+	return root, nil
+}
+
+// RequestSnapshot asks the avalanchego node managed by Run
+// (listening on socket) to take a consistent snapshot of its
+// db and returns the directory containing the snapshot (which
+// the caller must remove).
+func RequestSnapshot(ctx context.Context, socket string) (string, error) {
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://snowplow"+snapshotPath, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not connect to %s (is snowplow running?)", err, socket)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return "", errors.New(string(message))
+	}
+
+	snapshot := &SnapshotResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(snapshot); err != nil {
+		return "", fmt.Errorf("%w: could not parse snapshot response", err)
+	}
+
+	return snapshot.Root, nil
+}
+
+// Run starts the avalanchego node described by monitored
+// (monitored with monitorConfig) and runs the backups in scheduler. Snapshots
+// of the db can be requested on paths.ControlSocket with
+// RequestSnapshot.
+func Run(
+	ctx context.Context,
+	monitored *health.Node,
+	notifier *notifier.Notifier,
+	metricWriter *metrics.MetricWriter,
+	paths *Paths,
+	monitorConfig *health.Config,
+	scheduler *scheduler.Scheduler,
+) error {
 	// Periodically check health and send
 	// notifications as needed
 	m := health.NewMonitor(
+		monitored,
 		notifier,
 		client.NewClient(),
 		metricWriter,
-		healthInterval,
-		statusInterval,
-		unhealthyThreshold,
-		minPeers,
+		monitorConfig,
+		utils.RealClock{},
 	)
 	go m.MonitorHealth(ctx)
-	go server.StartServer(ctx, "health", m, healthPort)
+	go scheduler.Run(ctx)
+	go server.StartServer(ctx, "health", m, monitorConfig.Port)
+
+	n := &node{
+		paths:     paths,
+		notifier:  notifier,
+		monitor:   m,
+		snapshots: make(chan *snapshotRequest),
+	}
+	socket := filepath.Join(paths.Home, paths.ControlSocket)
+	if err := server.StartUnixServer(ctx, "control", n, socket); err != nil {
+		return err
+	}
 
-	return cmd.Run()
+	return n.run(ctx)
 }
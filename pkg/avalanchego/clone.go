@@ -0,0 +1,101 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package avalanchego
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// immutableExtensions are the extensions of LevelDB files
+// that are never modified once they are written (so they
+// can be hard linked instead of copied).
+var immutableExtensions = map[string]bool{
+	".ldb": true,
+	".sst": true,
+}
+
+// cloneDirectory creates a point-in-time copy of the directory
+// src at dst (which must not exist) while avalanchego is
+// stopped. Files are cloned with a reflink (copy-on-write) if
+// the filesystem supports it. Otherwise, immutable LevelDB
+// tables are hard linked and all other files (which may be
+// modified once avalanchego restarts) are copied.
+func cloneDirectory(src string, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(target, info.Mode().Perm()); err != nil {
+				return fmt.Errorf("%w: could not create directory %s", err, target)
+			}
+
+			return nil
+		case !info.Mode().IsRegular():
+			return fmt.Errorf("%s is not a regular file or directory", p)
+		}
+
+		if err := reflink(p, target, info.Mode().Perm()); err == nil {
+			return nil
+		}
+
+		if immutableExtensions[filepath.Ext(p)] {
+			if err := os.Link(p, target); err != nil {
+				return fmt.Errorf("%w: could not link %s", err, p)
+			}
+
+			return nil
+		}
+
+		return copyFile(p, target, info.Mode().Perm())
+	})
+}
+
+// copyFile copies the file at src to a new file at dst.
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("%w: could not open %s", err, src)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return fmt.Errorf("%w: could not create %s", err, dst)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("%w: could not copy %s", err, src)
+	}
+
+	return out.Close()
+}
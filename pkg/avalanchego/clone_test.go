@@ -0,0 +1,61 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package avalanchego
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloneDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clone")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "v1.0.0"), 0700))
+	files := map[string]string{
+		filepath.Join("v1.0.0", "000001.ldb"): "table",
+		filepath.Join("v1.0.0", "000002.log"): "log",
+		filepath.Join("v1.0.0", "MANIFEST"):   "manifest",
+	}
+	for name, contents := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(src, name), []byte(contents), 0600))
+	}
+
+	dst := filepath.Join(dir, "dst")
+	assert.NoError(t, cloneDirectory(src, dst))
+
+	// Mutable files in the clone are not affected by
+	// writes to the source
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "v1.0.0", "000002.log"), []byte("changed"), 0600))
+	for name, contents := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dst, name))
+		assert.NoError(t, err)
+		assert.Equal(t, contents, string(data))
+	}
+
+	// The clone cannot be created twice
+	assert.Error(t, cloneDirectory(src, dst))
+}
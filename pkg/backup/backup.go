@@ -0,0 +1,241 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+const (
+	// stagingPattern is the pattern used to name the
+	// directory a restore is extracted into.
+	stagingPattern = ".snowplow-restore-"
+
+	directoryPerm = 0700
+)
+
+// Transform reads from r and writes a transformed stream
+// to w (ex: encryption.Encrypt with a passphrase).
+type Transform func(r io.Reader, w io.Writer) error
+
+// Verify is called with the root of the staging directory
+// a restore was extracted into before it is moved into place.
+type Verify func(root string) error
+
+// Uploader stores everything read from r as name in
+// backend (ex: storage.Upload).
+type Uploader func(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	r io.Reader,
+) (*storage.UploadResult, error)
+
+// Downloader writes the verified contents of name in
+// backend to w (ex: storage.Download).
+type Downloader func(ctx context.Context, backend storage.Backend, name string, w io.Writer) error
+
+// Options describes how a backup is encoded.
+type Options struct {
+	// Format is the compression format of the archive.
+	Format compression.Format
+
+	// Encrypt is applied to the compressed archive during
+	// a backup. If nil, the archive is not encrypted.
+	Encrypt Transform
+
+	// Decrypt is applied to the downloaded object during a
+	// restore. If nil, the object is assumed to be a
+	// plain archive.
+	Decrypt Transform
+
+	// Verify is called before a restore is moved into
+	// place. If nil, no verification is performed.
+	Verify Verify
+
+	// Upload stores a backup. Defaults to storage.Upload.
+	Upload Uploader
+
+	// Download retrieves a backup. Defaults to
+	// storage.Download.
+	Download Downloader
+}
+
+// stage runs f in g and returns a reader over everything
+// f writes. If f fails, the error is returned to the reader.
+func stage(g *errgroup.Group, f func(w io.Writer) error) *io.PipeReader {
+	pr, pw := io.Pipe()
+	g.Go(func() error {
+		err := f(pw)
+		_ = pw.CloseWithError(err)
+		return err
+	})
+
+	return pr
+}
+
+// transform runs t over r in g. Once t returns, r is closed
+// so that earlier stages never block on a stage that has
+// stopped reading.
+func transform(g *errgroup.Group, r *io.PipeReader, t Transform) *io.PipeReader {
+	return stage(g, func(w io.Writer) error {
+		err := t(r, w)
+		if err != nil {
+			_ = r.CloseWithError(err)
+		} else {
+			_ = r.Close()
+		}
+
+		return err
+	})
+}
+
+// Backup streams an archive of the directory path (relative
+// to base) to name in backend through a pipeline of stages
+// (tar -> compress -> encrypt -> hash -> upload) connected by
+// io.Pipe, so nothing is written to local disk.
+func Backup(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	base string,
+	path string,
+	opts *Options,
+) (*storage.UploadResult, error) {
+	g, gctx := errgroup.WithContext(ctx)
+	r := stage(g, func(w io.Writer) error {
+		return compression.Compress(w, base, path, opts.Format)
+	})
+	if opts.Encrypt != nil {
+		r = transform(g, r, opts.Encrypt)
+	}
+
+	upload := opts.Upload
+	if upload == nil {
+		upload = storage.Upload
+	}
+
+	var result *storage.UploadResult
+	g.Go(func() error {
+		var err error
+		result, err = upload(gctx, backend, name, r)
+		if err != nil {
+			_ = r.CloseWithError(err)
+			return err
+		}
+
+		return r.Close()
+	})
+
+	if err := g.Wait(); err != nil {
+		return nil, fmt.Errorf("%w: could not back up %s", err, path)
+	}
+
+	return result, nil
+}
+
+// Restore streams name from backend through the reverse of
+// the Backup pipeline and extracts it into a staging
+// directory in base. Only the directory path (relative to
+// base) is moved into place, and only once the entire object
+// has been verified. path must not already exist in base.
+func Restore(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	base string,
+	path string,
+	opts *Options,
+) error {
+	target := filepath.Join(base, path)
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		return fmt.Errorf("%s already exists", target)
+	}
+
+	staging, err := ioutil.TempDir(base, stagingPattern)
+	if err != nil {
+		return fmt.Errorf("%w: could not create staging directory", err)
+	}
+	defer os.RemoveAll(staging)
+
+	download := opts.Download
+	if download == nil {
+		download = storage.Download
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	r := stage(g, func(w io.Writer) error {
+		return download(gctx, backend, name, w)
+	})
+	if opts.Decrypt != nil {
+		r = transform(g, r, opts.Decrypt)
+	}
+
+	g.Go(func() error {
+		if err := compression.Decompress(r, staging, opts.Format); err != nil {
+			_ = r.CloseWithError(err)
+			return err
+		}
+
+		// The archive may end before the underlying stream
+		// does, so we read the remainder to ensure the
+		// decryption and checksum are fully verified.
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return err
+		}
+
+		return r.Close()
+	})
+
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("%w: could not restore %s", err, name)
+	}
+
+	if opts.Verify != nil {
+		if err := opts.Verify(staging); err != nil {
+			return fmt.Errorf("%w: could not verify %s", err, name)
+		}
+	}
+
+	staged := filepath.Join(staging, path)
+	if _, err := os.Stat(staged); err != nil {
+		return fmt.Errorf("%w: %s does not contain %s", err, name, path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), directoryPerm); err != nil {
+		return fmt.Errorf("%w: could not create parent of %s", err, target)
+	}
+
+	if err := os.Rename(staged, target); err != nil {
+		return fmt.Errorf("%w: could not move %s into place", err, target)
+	}
+
+	return nil
+}
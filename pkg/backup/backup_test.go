@@ -0,0 +1,186 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/encryption"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+var passphrase = []byte("correct horse battery staple")
+
+func testOptions() *Options {
+	return &Options{
+		Format: compression.Gzip,
+		Encrypt: func(r io.Reader, w io.Writer) error {
+			return encryption.Encrypt(r, w, passphrase)
+		},
+		Decrypt: func(r io.Reader, w io.Writer) error {
+			return encryption.Decrypt(r, w, passphrase)
+		},
+	}
+}
+
+func setup(t *testing.T) (string, string, storage.Backend) {
+	src := t.TempDir()
+	staking := filepath.Join(".avalanchego", "staking")
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, staking), 0700))
+	assert.NoError(t, ioutil.WriteFile(
+		filepath.Join(src, staking, "staker.key"),
+		[]byte("key"),
+		0600,
+	))
+
+	backend, err := storage.NewFileBackend(t.TempDir())
+	assert.NoError(t, err)
+
+	return src, staking, backend
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	src, staking, backend := setup(t)
+	opts := testOptions()
+
+	result, err := Backup(ctx, backend, "NodeID-test.tar.gz.gpg", src, staking, opts)
+	assert.NoError(t, err)
+	assert.Len(t, result.Checksum, 64)
+
+	obj, err := backend.Stat(ctx, "NodeID-test.tar.gz.gpg")
+	assert.NoError(t, err)
+	assert.Equal(t, obj.Size, result.Size)
+
+	// Nothing but the source should be written locally
+	entries, err := ioutil.ReadDir(src)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Only the object and its checksum are stored
+	objects, err := backend.List(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 2)
+
+	dst := t.TempDir()
+	var verified string
+	opts.Verify = func(root string) error {
+		verified = root
+		return nil
+	}
+	assert.NoError(t, Restore(ctx, backend, "NodeID-test.tar.gz.gpg", dst, staking, opts))
+	assert.True(t, strings.HasPrefix(filepath.Base(verified), stagingPattern))
+
+	key := filepath.Join(dst, staking, "staker.key")
+	contents, err := ioutil.ReadFile(key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key"), contents)
+	info, err := os.Stat(key)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The staging directory is removed
+	entries, err = ioutil.ReadDir(dst)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Restoring over existing credentials fails
+	assert.Error(t, Restore(ctx, backend, "NodeID-test.tar.gz.gpg", dst, staking, opts))
+}
+
+func TestRestoreFailures(t *testing.T) {
+	tests := map[string]struct {
+		tamper func(t *testing.T, backend storage.Backend)
+		verify Verify
+	}{
+		"checksum mismatch": {
+			tamper: func(t *testing.T, backend storage.Backend) {
+				assert.NoError(t, backend.Put(
+					context.Background(),
+					"backup"+storage.ChecksumSuffix,
+					strings.NewReader(strings.Repeat("0", 64)),
+				))
+			},
+		},
+		"missing checksum": {
+			tamper: func(t *testing.T, backend storage.Backend) {
+				assert.NoError(t, backend.Delete(
+					context.Background(),
+					"backup"+storage.ChecksumSuffix,
+				))
+			},
+		},
+		"verification failure": {
+			verify: func(root string) error {
+				return errors.New("wrong NodeID")
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			src, staking, backend := setup(t)
+			opts := testOptions()
+
+			_, err := Backup(ctx, backend, "backup", src, staking, opts)
+			assert.NoError(t, err)
+			if test.tamper != nil {
+				test.tamper(t, backend)
+			}
+
+			dst := t.TempDir()
+			opts.Verify = test.verify
+			assert.Error(t, Restore(ctx, backend, "backup", dst, staking, opts))
+
+			// Nothing is left behind
+			entries, err := ioutil.ReadDir(dst)
+			assert.NoError(t, err)
+			assert.Len(t, entries, 0)
+		})
+	}
+}
+
+func TestBackupFailure(t *testing.T) {
+	ctx := context.Background()
+	src, staking, backend := setup(t)
+	opts := testOptions()
+	opts.Encrypt = func(r io.Reader, w io.Writer) error {
+		return errors.New("encryption failed")
+	}
+
+	_, err := Backup(ctx, backend, "backup", src, staking, opts)
+	assert.Error(t, err)
+
+	// No partial object is stored
+	objects, err := backend.List(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 0)
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+// replicateBufferSize is the size of each chunk written to
+// every replica.
+const replicateBufferSize = 1024 * 1024
+
+// errReplicasFailed stops the pipeline of Replicate once
+// there are no replicas left to write to.
+var errReplicasFailed = errors.New("all replicas failed")
+
+// ReplicaUploader is like Uploader, but the checksum of r is
+// computed by the caller. checksum must only be called once r
+// has been read to EOF (ex: storage.UploadWithChecksum).
+type ReplicaUploader func(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	r io.Reader,
+	checksum func() string,
+) (*storage.UploadResult, error)
+
+// Replica is a destination a backup is replicated to.
+type Replica struct {
+	// Destination identifies the replica in results (ex:
+	// gs://bucket).
+	Destination string
+
+	// Backend is the backend of Destination.
+	Backend storage.Backend
+
+	// Upload stores the backup. Defaults to
+	// storage.UploadWithChecksum.
+	Upload ReplicaUploader
+}
+
+// ReplicaResult is the outcome of a backup to a Replica.
+type ReplicaResult struct {
+	Replica *Replica
+
+	// Result is nil if Err is not.
+	Result *storage.UploadResult
+	Err    error
+}
+
+// Replicate is like Backup, but the archive is uploaded to
+// every replica concurrently. The archive is only created,
+// encrypted and hashed once, so every replica stores identical
+// bytes with the same checksum. A replica that fails is
+// dropped without interrupting the others (the slowest
+// replica sets the pace of the rest).
+//
+// An error is only returned if the archive could not be
+// created. The outcome of each replica is returned in the
+// order of replicas.
+func Replicate(
+	ctx context.Context,
+	replicas []*Replica,
+	name string,
+	base string,
+	path string,
+	opts *Options,
+) ([]*ReplicaResult, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("no replicas provided")
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	r := stage(g, func(w io.Writer) error {
+		return compression.Compress(w, base, path, opts.Format)
+	})
+	if opts.Encrypt != nil {
+		r = transform(g, r, opts.Encrypt)
+	}
+
+	// Replicas are not part of g because a failed replica
+	// must not cancel the others.
+	var (
+		wg       sync.WaitGroup
+		checksum string
+	)
+	results := make([]*ReplicaResult, len(replicas))
+	writers := make([]*io.PipeWriter, len(replicas))
+	for i, replica := range replicas {
+		upload := replica.Upload
+		if upload == nil {
+			upload = storage.UploadWithChecksum
+		}
+
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		results[i] = &ReplicaResult{Replica: replica}
+
+		wg.Add(1)
+		go func(result *ReplicaResult, pr *io.PipeReader) {
+			defer wg.Done()
+
+			// checksum is set before any replica reads EOF
+			result.Result, result.Err = upload(ctx, result.Replica.Backend, name, pr, func() string {
+				return checksum
+			})
+			if result.Err != nil {
+				_ = pr.CloseWithError(result.Err)
+				return
+			}
+
+			_ = pr.Close()
+		}(results[i], pr)
+	}
+
+	var replicasFailed bool
+	g.Go(func() error {
+		sum, err := broadcast(gctx, r, writers)
+		if errors.Is(err, errReplicasFailed) {
+			replicasFailed = true
+		}
+		if err != nil {
+			_ = r.CloseWithError(err)
+			return err
+		}
+
+		checksum = sum
+		for _, w := range writers {
+			if w != nil {
+				_ = w.Close()
+			}
+		}
+
+		return r.Close()
+	})
+
+	err := g.Wait()
+	if err != nil {
+		// Replicas still reading from a pipe must be
+		// stopped before waiting for them.
+		for _, w := range writers {
+			if w != nil {
+				_ = w.CloseWithError(err)
+			}
+		}
+	}
+	wg.Wait()
+
+	if err != nil && !replicasFailed {
+		return nil, fmt.Errorf("%w: could not back up %s", err, path)
+	}
+
+	return results, nil
+}
+
+// broadcast copies r to every writer and returns the checksum
+// of r. A writer that fails is set to nil and no longer
+// written to. If every writer fails, errReplicasFailed is
+// returned.
+func broadcast(ctx context.Context, r io.Reader, writers []*io.PipeWriter) (string, error) {
+	h := sha256.New()
+	buf := make([]byte, replicateBufferSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			_, _ = h.Write(buf[:n])
+
+			live := 0
+			for i, w := range writers {
+				if w == nil {
+					continue
+				}
+
+				if _, err := w.Write(buf[:n]); err != nil {
+					writers[i] = nil
+					continue
+				}
+				live++
+			}
+
+			if live == 0 {
+				return "", errReplicasFailed
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return fmt.Sprintf("%x", h.Sum(nil)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+	}
+}
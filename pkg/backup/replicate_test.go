@@ -0,0 +1,112 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+// failingUploader reads some of r and then fails.
+func failingUploader(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	r io.Reader,
+	checksum func() string,
+) (*storage.UploadResult, error) {
+	_, _ = r.Read(make([]byte, 1))
+	return nil, errors.New("bucket unavailable")
+}
+
+func TestReplicate(t *testing.T) {
+	ctx := context.Background()
+	src, staking, primary := setup(t)
+	secondary, err := storage.NewFileBackend(t.TempDir())
+	assert.NoError(t, err)
+	opts := testOptions()
+
+	results, err := Replicate(ctx, []*Replica{
+		{Destination: "primary", Backend: primary},
+		{Destination: "broken", Backend: primary, Upload: failingUploader},
+		{Destination: "secondary", Backend: secondary},
+	}, "backup", src, staking, opts)
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+	assert.Equal(t, "primary", results[0].Replica.Destination)
+	assert.NoError(t, results[0].Err)
+	assert.Error(t, results[1].Err)
+	assert.Nil(t, results[1].Result)
+	assert.NoError(t, results[2].Err)
+
+	// Every replica stores the same (encrypted) bytes
+	assert.Equal(t, results[0].Result, results[2].Result)
+	for _, backend := range []storage.Backend{primary, secondary} {
+		checksum, err := storage.ReadChecksum(ctx, backend, "backup")
+		assert.NoError(t, err)
+		assert.Equal(t, results[0].Result.Checksum, checksum)
+
+		dst := t.TempDir()
+		assert.NoError(t, Restore(ctx, backend, "backup", dst, staking, opts))
+		contents, err := ioutil.ReadFile(filepath.Join(dst, staking, "staker.key"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("key"), contents)
+	}
+}
+
+func TestReplicateFailures(t *testing.T) {
+	ctx := context.Background()
+	src, staking, backend := setup(t)
+	opts := testOptions()
+
+	// A failure of every replica is reported per replica
+	results, err := Replicate(ctx, []*Replica{
+		{Destination: "a", Backend: backend, Upload: failingUploader},
+		{Destination: "b", Backend: backend, Upload: failingUploader},
+	}, "backup", src, staking, opts)
+	assert.NoError(t, err)
+	for _, result := range results {
+		assert.Error(t, result.Err)
+	}
+
+	// A failure to create the archive fails the backup
+	opts.Encrypt = func(r io.Reader, w io.Writer) error {
+		return errors.New("encryption failed")
+	}
+	_, err = Replicate(ctx, []*Replica{
+		{Destination: "a", Backend: backend},
+	}, "backup", src, staking, opts)
+	assert.Error(t, err)
+
+	// No partial object is stored
+	objects, err := backend.List(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 0)
+
+	_, err = Replicate(ctx, nil, "backup", src, staking, opts)
+	assert.Error(t, err)
+}
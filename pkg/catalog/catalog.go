@@ -0,0 +1,217 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+	"github.com/patrick-ogrady/snowplow/pkg/transfer"
+)
+
+const (
+	// ManifestSuffix is appended to the name of a backup
+	// to get the name of its manifest.
+	ManifestSuffix = ".manifest.json"
+
+	// UnknownVersion is used when the version of avalanchego
+	// cannot be determined (ex: the node is not running).
+	UnknownVersion = "unknown"
+)
+
+// Kind is the type of data held in a backup.
+type Kind string
+
+const (
+	// Staking backups hold staking credentials.
+	Staking Kind = "staking"
+
+	// DB backups hold the avalanchego db.
+	DB Kind = "db"
+)
+
+// Encryption is the scheme used to encrypt a backup.
+type Encryption string
+
+const (
+	// NoEncryption is used for unencrypted backups.
+	NoEncryption Encryption = "none"
+
+	// PassphraseEncryption is used for backups encrypted
+	// with an OpenPGP passphrase.
+	PassphraseEncryption Encryption = "openpgp-passphrase"
+
+	// RecipientsEncryption is used for backups encrypted
+	// to OpenPGP public keys.
+	RecipientsEncryption Encryption = "openpgp-recipients"
+)
+
+// Manifest describes a backup. It is stored as JSON next to
+// the backup (and its checksum) in the same storage.Backend.
+type Manifest struct {
+	Name               string             `json:"name"`
+	Kind               Kind               `json:"kind"`
+	NodeID             string             `json:"nodeID,omitempty"`
+	Version            string             `json:"version,omitempty"`
+	SnowplowVersion    string             `json:"snowplowVersion"`
+	AvalancheGoVersion string             `json:"avalanchegoVersion"`
+	CreatedAt          time.Time          `json:"createdAt"`
+	Size               int64              `json:"size"`
+	Checksum           string             `json:"checksum"`
+	Encryption         Encryption         `json:"encryption"`
+	Compression        compression.Format `json:"compression"`
+
+	// Legacy is true for backups created before manifests
+	// were introduced (only Name, Kind, CreatedAt and Size
+	// are populated). It is never stored.
+	Legacy bool `json:"-"`
+}
+
+// Write stores manifest next to the backup it describes. If
+// signer is not nil, the manifest is signed and its signature
+// is stored next to it.
+func Write(ctx context.Context, backend storage.Backend, manifest *Manifest, signer *Signer) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w: could not marshal manifest", err)
+	}
+
+	name := manifest.Name + ManifestSuffix
+	if err := backend.Put(ctx, name, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("%w: could not store %s", err, name)
+	}
+
+	if signer == nil {
+		return nil
+	}
+
+	return writeSignature(ctx, backend, manifest.Name, data, signer)
+}
+
+// Read returns the manifest of the backup name.
+func Read(ctx context.Context, backend storage.Backend, name string) (*Manifest, error) {
+	data, err := readObject(ctx, backend, name+ManifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("%w: could not parse manifest of %s", err, name)
+	}
+
+	return manifest, nil
+}
+
+// List returns the manifests of all backups of kind in
+// backend, newest first. Backups without a manifest are
+// included (marked Legacy) if they have a checksum.
+func List(ctx context.Context, backend storage.Backend, kind Kind) ([]*Manifest, error) {
+	objects, err := backend.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not list objects", err)
+	}
+
+	byName := map[string]*storage.Object{}
+	for _, obj := range objects {
+		byName[obj.Name] = obj
+	}
+
+	manifests := []*Manifest{}
+	for _, obj := range objects {
+		name := strings.TrimSuffix(obj.Name, storage.ChecksumSuffix)
+		if name == obj.Name {
+			continue
+		}
+
+		// Skip checksums of objects that no longer exist
+		// (ex: an interrupted prune).
+		backup, ok := byName[name]
+		if !ok {
+			continue
+		}
+
+		var manifest *Manifest
+		if _, ok := byName[name+ManifestSuffix]; ok {
+			manifest, err = Read(ctx, backend, name)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			manifest = &Manifest{
+				Name:      name,
+				Kind:      legacyKind(name),
+				CreatedAt: backup.Updated,
+				Size:      backup.Size,
+				Legacy:    true,
+			}
+		}
+
+		if manifest.Kind == kind {
+			manifests = append(manifests, manifest)
+		}
+	}
+
+	sort.SliceStable(manifests, func(i, j int) bool {
+		return manifests[i].CreatedAt.After(manifests[j].CreatedAt)
+	})
+
+	return manifests, nil
+}
+
+// legacyKind infers the Kind of a backup without a
+// manifest from its name.
+func legacyKind(name string) Kind {
+	if strings.HasPrefix(name, "NodeID-") && strings.HasSuffix(name, ".gpg") {
+		return Staking
+	}
+
+	return DB
+}
+
+// Delete removes a backup, its checksum, its part index
+// (if it was uploaded with transfer.Upload) and its manifest
+// (and signature).
+// The manifest is removed last so that an interrupted
+// Delete can be retried.
+func Delete(ctx context.Context, backend storage.Backend, name string) error {
+	for _, obj := range []string{
+		name,
+		name + storage.ChecksumSuffix,
+		name + transfer.PartsSuffix,
+		signatureName(name),
+		name + ManifestSuffix,
+	} {
+		err := backend.Delete(ctx, obj)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+			return fmt.Errorf("%w: could not delete %s", err, obj)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package catalog
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+func put(t *testing.T, backend storage.Backend, name string, contents string) {
+	assert.NoError(t, backend.Put(context.Background(), name, strings.NewReader(contents)))
+}
+
+func TestListDelete(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewFileBackend(t.TempDir())
+	assert.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, name := range []string{"db-1.tar.gz", "db-2.tar.zst"} {
+		put(t, backend, name, "db")
+		put(t, backend, name+storage.ChecksumSuffix, "checksum")
+		assert.NoError(t, Write(ctx, backend, &Manifest{
+			Name:        name,
+			Kind:        DB,
+			CreatedAt:   now.Add(time.Duration(i) * time.Hour),
+			Size:        2,
+			Checksum:    "checksum",
+			Encryption:  NoEncryption,
+			Compression: compression.Gzip,
+		}, nil))
+	}
+
+	// Legacy backups are listed without a manifest
+	put(t, backend, "NodeID-legacy.tar.gz.gpg", "keys")
+	put(t, backend, "NodeID-legacy.tar.gz.gpg"+storage.ChecksumSuffix, "checksum")
+
+	// Objects without a checksum are not backups
+	put(t, backend, "notes.txt", "hello")
+
+	manifests, err := List(ctx, backend, DB)
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 2)
+	assert.Equal(t, "db-2.tar.zst", manifests[0].Name)
+	assert.Equal(t, "db-1.tar.gz", manifests[1].Name)
+	assert.True(t, manifests[0].CreatedAt.Equal(now.Add(time.Hour)))
+
+	manifests, err = List(ctx, backend, Staking)
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 1)
+	assert.True(t, manifests[0].Legacy)
+	assert.Equal(t, int64(4), manifests[0].Size)
+
+	assert.NoError(t, Delete(ctx, backend, "db-1.tar.gz"))
+	manifests, err = List(ctx, backend, DB)
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 1)
+	objects, err := backend.List(ctx, "db-1")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 0)
+
+	// Deleting a missing backup is not an error
+	assert.NoError(t, Delete(ctx, backend, "db-1.tar.gz"))
+}
+
+func TestPolicy(t *testing.T) {
+	// Two backups a day (at 00:00 and 12:00) for 28 days,
+	// starting on a Monday.
+	start := time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+	manifests := []*Manifest{}
+	for i := 55; i >= 0; i-- {
+		manifests = append(manifests, &Manifest{
+			Name:      start.Add(time.Duration(i) * 12 * time.Hour).Format(time.RFC3339),
+			CreatedAt: start.Add(time.Duration(i) * 12 * time.Hour),
+		})
+	}
+
+	tests := map[string]struct {
+		policy Policy
+		keep   []string
+	}{
+		"keep last": {
+			policy: Policy{KeepLast: 3},
+			keep: []string{
+				"2021-03-28T12:00:00Z",
+				"2021-03-28T00:00:00Z",
+				"2021-03-27T12:00:00Z",
+			},
+		},
+		"keep daily": {
+			policy: Policy{KeepDaily: 3},
+			keep: []string{
+				"2021-03-28T12:00:00Z",
+				"2021-03-27T12:00:00Z",
+				"2021-03-26T12:00:00Z",
+			},
+		},
+		"keep weekly": {
+			policy: Policy{KeepWeekly: 2},
+			keep: []string{
+				"2021-03-28T12:00:00Z",
+				"2021-03-21T12:00:00Z",
+			},
+		},
+		"combined": {
+			policy: Policy{KeepLast: 2, KeepDaily: 2, KeepWeekly: 2},
+			keep: []string{
+				"2021-03-28T12:00:00Z",
+				"2021-03-28T00:00:00Z",
+				"2021-03-27T12:00:00Z",
+				"2021-03-21T12:00:00Z",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, test.policy.Validate())
+
+			keep, remove := test.policy.Apply(manifests)
+			names := []string{}
+			for _, m := range keep {
+				names = append(names, m.Name)
+			}
+			assert.Equal(t, test.keep, names)
+			assert.Len(t, remove, len(manifests)-len(test.keep))
+		})
+	}
+
+	assert.Error(t, (&Policy{}).Validate())
+	assert.Error(t, (&Policy{KeepLast: -1, KeepDaily: 1}).Validate())
+}
+
+func TestLatest(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewFileBackend(t.TempDir())
+	assert.NoError(t, err)
+
+	_, err = ReadLatest(ctx, backend, "NodeID-test")
+	assert.ErrorIs(t, err, ErrNoLatest)
+
+	version := NewVersion(time.Date(2021, time.April, 28, 15, 30, 0, 0, time.UTC))
+	assert.Equal(t, "20210428T153000.000Z", version)
+	assert.NoError(t, ValidateVersion(version))
+	assert.Error(t, ValidateVersion("../latest"))
+	assert.Equal(
+		t,
+		"NodeID-test/20210428T153000.000Z.tar.gz.gpg",
+		VersionedName("NodeID-test", version, ".tar.gz.gpg"),
+	)
+
+	assert.NoError(t, WriteLatest(ctx, backend, "NodeID-test", version))
+	latest, err := ReadLatest(ctx, backend, "NodeID-test")
+	assert.NoError(t, err)
+	assert.Equal(t, version, latest)
+
+	put(t, backend, "NodeID-test/"+LatestName, "garbage")
+	_, err = ReadLatest(ctx, backend, "NodeID-test")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrNoLatest)
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Policy determines which backups are kept when pruning.
+// A backup is kept if any rule selects it.
+type Policy struct {
+	// KeepLast keeps the n most recent backups.
+	KeepLast int
+
+	// KeepDaily keeps the most recent backup of each of
+	// the n most recent days with a backup.
+	KeepDaily int
+
+	// KeepWeekly keeps the most recent backup of each of
+	// the n most recent ISO weeks with a backup.
+	KeepWeekly int
+}
+
+// Validate ensures the policy keeps at least one backup.
+func (p *Policy) Validate() error {
+	if p.KeepLast < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 {
+		return errors.New("retention counts cannot be negative")
+	}
+
+	if p.KeepLast == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0 {
+		return errors.New("retention policy would remove every backup")
+	}
+
+	return nil
+}
+
+// Apply splits manifests (sorted newest first, as returned
+// by List) into the backups to keep and the backups to remove.
+func (p *Policy) Apply(manifests []*Manifest) ([]*Manifest, []*Manifest) {
+	keepLast := p.KeepLast
+	days := newBucketer(p.KeepDaily, func(t time.Time) string {
+		return t.UTC().Format("2006-01-02")
+	})
+	weeks := newBucketer(p.KeepWeekly, func(t time.Time) string {
+		year, week := t.UTC().ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+
+	keep := []*Manifest{}
+	remove := []*Manifest{}
+	for _, manifest := range manifests {
+		kept := false
+		if keepLast > 0 {
+			keepLast--
+			kept = true
+		}
+
+		// Every rule must see every backup (even if an earlier
+		// rule already kept it) so that buckets are consumed
+		// by the most recent backup in them.
+		if days.keep(manifest.CreatedAt) {
+			kept = true
+		}
+		if weeks.keep(manifest.CreatedAt) {
+			kept = true
+		}
+
+		if kept {
+			keep = append(keep, manifest)
+		} else {
+			remove = append(remove, manifest)
+		}
+	}
+
+	return keep, remove
+}
+
+// bucketer keeps the first time seen in each of the
+// first n buckets.
+type bucketer struct {
+	remaining int
+	bucket    func(time.Time) string
+	last      string
+}
+
+func newBucketer(n int, bucket func(time.Time) string) *bucketer {
+	return &bucketer{remaining: n, bucket: bucket}
+}
+
+func (b *bucketer) keep(t time.Time) bool {
+	if b.remaining == 0 {
+		return false
+	}
+
+	bucket := b.bucket(t)
+	if bucket == b.last {
+		return false
+	}
+
+	b.last = bucket
+	b.remaining--
+	return true
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/patrick-ogrady/snowplow/pkg/integrity"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+	"github.com/patrick-ogrady/snowplow/pkg/utils"
+)
+
+// SignatureSuffix is appended to the name of a manifest to
+// get the name of its signature.
+const SignatureSuffix = ".sig"
+
+var (
+	// ErrUnsigned is returned by ReadVerified when a
+	// manifest has no signature.
+	ErrUnsigned = errors.New("manifest is not signed")
+
+	// ErrUntrusted is returned by ReadVerified when a
+	// manifest was signed by a key that is not trusted.
+	ErrUntrusted = errors.New("manifest was not signed by a trusted key")
+)
+
+// Signer signs manifests as they are written.
+type Signer struct {
+	// Key signs the manifest (ex: the key in staker.key).
+	Key crypto.Signer
+
+	// Certificate is the PEM-encoded staking certificate of
+	// Key. If provided, it is stored with the signature so the
+	// manifest can be verified against its NodeID.
+	Certificate []byte
+}
+
+// Signature is stored next to a signed manifest. It signs
+// the exact bytes of the manifest, so manifests never need
+// to be re-encoded to be verified.
+type Signature struct {
+	Signature   []byte `json:"signature"`
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// Verifier determines which signatures are trusted. A
+// manifest is trusted if it was signed by any of TrustedKeys
+// or, if there are none, by the staking certificate of NodeID.
+type Verifier struct {
+	TrustedKeys []crypto.PublicKey
+	NodeID      string
+}
+
+// signatureName returns the name of the signature of the
+// manifest of the backup name.
+func signatureName(name string) string {
+	return name + ManifestSuffix + SignatureSuffix
+}
+
+// writeSignature signs data (the manifest of the backup
+// name) with signer and stores the signature.
+func writeSignature(ctx context.Context, backend storage.Backend, name string, data []byte, signer *Signer) error {
+	signature, err := integrity.Sign(signer.Key, data)
+	if err != nil {
+		return fmt.Errorf("%w: could not sign manifest of %s", err, name)
+	}
+
+	encoded, err := json.Marshal(&Signature{
+		Signature:   signature,
+		Certificate: string(signer.Certificate),
+	})
+	if err != nil {
+		return fmt.Errorf("%w: could not marshal signature", err)
+	}
+
+	sigName := signatureName(name)
+	if err := backend.Put(ctx, sigName, bytes.NewReader(encoded)); err != nil {
+		return fmt.Errorf("%w: could not store %s", err, sigName)
+	}
+
+	return nil
+}
+
+// readObject returns the contents of name in backend.
+func readObject(ctx context.Context, backend storage.Backend, name string) ([]byte, error) {
+	rc, err := backend.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read %s", err, name)
+	}
+
+	return data, nil
+}
+
+// ReadVerified returns the manifest of the backup name once
+// its signature has been verified by verifier.
+func ReadVerified(ctx context.Context, backend storage.Backend, name string, verifier *Verifier) (*Manifest, error) {
+	data, err := readObject(ctx, backend, name+ManifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := readObject(ctx, backend, signatureName(name))
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsigned, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signature := &Signature{}
+	if err := json.Unmarshal(encoded, signature); err != nil {
+		return nil, fmt.Errorf("%w: could not parse signature of %s", err, name)
+	}
+
+	if err := verifier.verify(data, signature); err != nil {
+		return nil, fmt.Errorf("%w: could not verify manifest of %s", err, name)
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("%w: could not parse manifest of %s", err, name)
+	}
+
+	// A signed manifest of another backup must not be
+	// accepted in place of this one.
+	if manifest.Name != name {
+		return nil, fmt.Errorf("manifest of %s describes %s", name, manifest.Name)
+	}
+	if len(verifier.NodeID) > 0 && len(manifest.NodeID) > 0 && manifest.NodeID != verifier.NodeID {
+		return nil, fmt.Errorf("manifest of %s belongs to %s, not %s", name, manifest.NodeID, verifier.NodeID)
+	}
+
+	return manifest, nil
+}
+
+// verify checks that signature was created over data by a
+// trusted key.
+func (v *Verifier) verify(data []byte, signature *Signature) error {
+	if len(v.TrustedKeys) > 0 {
+		for _, key := range v.TrustedKeys {
+			if integrity.Verify(key, data, signature.Signature) == nil {
+				return nil
+			}
+		}
+
+		return ErrUntrusted
+	}
+
+	if len(v.NodeID) == 0 {
+		return errors.New("no trusted keys or NodeID provided")
+	}
+
+	if len(signature.Certificate) == 0 {
+		return fmt.Errorf("%w: signature does not include a staking certificate", ErrUntrusted)
+	}
+
+	cert, err := utils.ParseStakingCertificate([]byte(signature.Certificate))
+	if err != nil {
+		return err
+	}
+
+	nodeID, err := utils.CertificateNodeID(cert)
+	if err != nil {
+		return err
+	}
+
+	if printableNodeID := utils.PrintableNodeID(nodeID); printableNodeID != v.NodeID {
+		return fmt.Errorf("%w: signed by %s instead of %s", ErrUntrusted, printableNodeID, v.NodeID)
+	}
+
+	return integrity.Verify(cert.PublicKey, data, signature.Signature)
+}
+
+// Inspection describes a backup and the signature of its
+// manifest.
+type Inspection struct {
+	Manifest *Manifest `json:"manifest"`
+
+	// Signed is true if the manifest has a signature and
+	// SignerNodeID is the NodeID of the staking certificate
+	// stored with it (if any). The signature is only checked
+	// if Verified is true.
+	Signed       bool   `json:"signed"`
+	SignerNodeID string `json:"signerNodeID,omitempty"`
+	Verified     bool   `json:"verified"`
+}
+
+// Inspect returns the manifest of the backup name and
+// describes its signature. If verifier is not nil, the
+// signature must be trusted by verifier (as in ReadVerified).
+func Inspect(ctx context.Context, backend storage.Backend, name string, verifier *Verifier) (*Inspection, error) {
+	inspection := &Inspection{}
+	var err error
+	if verifier != nil {
+		inspection.Manifest, err = ReadVerified(ctx, backend, name, verifier)
+		inspection.Verified = err == nil
+	} else {
+		inspection.Manifest, err = Read(ctx, backend, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the manifest is signed (and by which NodeID)
+	encoded, err := readObject(ctx, backend, signatureName(name))
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return inspection, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	inspection.Signed = true
+
+	signature := &Signature{}
+	if err := json.Unmarshal(encoded, signature); err != nil {
+		return nil, fmt.Errorf("%w: could not parse signature of %s", err, name)
+	}
+	if len(signature.Certificate) == 0 {
+		return inspection, nil
+	}
+
+	cert, err := utils.ParseStakingCertificate([]byte(signature.Certificate))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not parse certificate of %s", err, name)
+	}
+
+	nodeID, err := utils.CertificateNodeID(cert)
+	if err != nil {
+		return nil, err
+	}
+	inspection.SignerNodeID = utils.PrintableNodeID(nodeID)
+	return inspection, nil
+}
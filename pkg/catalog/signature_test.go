@@ -0,0 +1,184 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package catalog
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/staking"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/integrity"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+	"github.com/patrick-ogrady/snowplow/pkg/utils"
+)
+
+// newStakingSigner creates staking credentials and returns a
+// *Signer using them and their NodeID.
+func newStakingSigner(t *testing.T) (*Signer, string) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "staker.key")
+	certPath := filepath.Join(dir, "staker.crt")
+	assert.NoError(t, staking.InitNodeStakingKeyPair(keyPath, certPath))
+
+	key, err := integrity.LoadPrivateKey(keyPath)
+	assert.NoError(t, err)
+	cert, err := ioutil.ReadFile(certPath)
+	assert.NoError(t, err)
+	nodeID, err := utils.LoadNodeID(certPath)
+	assert.NoError(t, err)
+
+	return &Signer{Key: key, Certificate: cert}, utils.PrintableNodeID(nodeID)
+}
+
+func TestSignedManifests(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewFileBackend(t.TempDir())
+	assert.NoError(t, err)
+
+	signer, nodeID := newStakingSigner(t)
+	other, otherNodeID := newStakingSigner(t)
+	manifest := func(name string, nodeID string) *Manifest {
+		return &Manifest{
+			Name:        name,
+			Kind:        Staking,
+			NodeID:      nodeID,
+			CreatedAt:   time.Now().UTC(),
+			Checksum:    "checksum",
+			Encryption:  PassphraseEncryption,
+			Compression: compression.Gzip,
+		}
+	}
+
+	// Manifests are verified against the NodeID of the
+	// certificate they were signed with
+	assert.NoError(t, Write(ctx, backend, manifest("a", nodeID), signer))
+	m, err := ReadVerified(ctx, backend, "a", &Verifier{NodeID: nodeID})
+	assert.NoError(t, err)
+	assert.Equal(t, "a", m.Name)
+
+	_, err = ReadVerified(ctx, backend, "a", &Verifier{NodeID: otherNodeID})
+	assert.ErrorIs(t, err, ErrUntrusted)
+
+	// Manifests can be verified with a trusted key
+	_, err = ReadVerified(ctx, backend, "a", &Verifier{TrustedKeys: []crypto.PublicKey{signer.Key.Public()}})
+	assert.NoError(t, err)
+	_, err = ReadVerified(ctx, backend, "a", &Verifier{TrustedKeys: []crypto.PublicKey{other.Key.Public()}})
+	assert.ErrorIs(t, err, ErrUntrusted)
+	_, err = ReadVerified(ctx, backend, "a", &Verifier{})
+	assert.Error(t, err)
+
+	// Unsigned manifests are rejected
+	assert.NoError(t, Write(ctx, backend, manifest("b", nodeID), nil))
+	_, err = ReadVerified(ctx, backend, "b", &Verifier{NodeID: nodeID})
+	assert.ErrorIs(t, err, ErrUnsigned)
+
+	// Modified manifests are rejected
+	put(t, backend, "a"+ManifestSuffix, `{"name":"a","checksum":"swapped"}`)
+	_, err = ReadVerified(ctx, backend, "a", &Verifier{NodeID: nodeID})
+	assert.ErrorIs(t, err, integrity.ErrInvalidSignature)
+
+	// Signed manifests of other backups are rejected
+	assert.NoError(t, Write(ctx, backend, manifest("c", nodeID), signer))
+	data, err := readObject(ctx, backend, "c"+ManifestSuffix)
+	assert.NoError(t, err)
+	sig, err := readObject(ctx, backend, signatureName("c"))
+	assert.NoError(t, err)
+	put(t, backend, "d"+ManifestSuffix, string(data))
+	put(t, backend, signatureName("d"), string(sig))
+	_, err = ReadVerified(ctx, backend, "d", &Verifier{NodeID: nodeID})
+	assert.Error(t, err)
+
+	// Signatures are removed with their backup
+	assert.NoError(t, Delete(ctx, backend, "c"))
+	_, err = backend.Stat(ctx, signatureName("c"))
+	assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+}
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewFileBackend(t.TempDir())
+	assert.NoError(t, err)
+
+	signer, nodeID := newStakingSigner(t)
+	_, otherNodeID := newStakingSigner(t)
+	manifest := &Manifest{
+		Name:        "a",
+		Kind:        DB,
+		CreatedAt:   time.Now().UTC(),
+		Size:        10,
+		Checksum:    "checksum",
+		Encryption:  NoEncryption,
+		Compression: compression.Zstd,
+	}
+
+	// Signed manifests include the NodeID of the signer
+	assert.NoError(t, Write(ctx, backend, manifest, signer))
+	inspection, err := Inspect(ctx, backend, "a", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "checksum", inspection.Manifest.Checksum)
+	assert.True(t, inspection.Signed)
+	assert.Equal(t, nodeID, inspection.SignerNodeID)
+	assert.False(t, inspection.Verified)
+
+	inspection, err = Inspect(ctx, backend, "a", &Verifier{NodeID: nodeID})
+	assert.NoError(t, err)
+	assert.True(t, inspection.Verified)
+
+	_, err = Inspect(ctx, backend, "a", &Verifier{NodeID: otherNodeID})
+	assert.ErrorIs(t, err, ErrUntrusted)
+
+	// Manifests signed with another key have no signer NodeID
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	assert.NoError(t, Write(ctx, backend, manifest, &Signer{Key: key}))
+	inspection, err = Inspect(ctx, backend, "a", nil)
+	assert.NoError(t, err)
+	assert.True(t, inspection.Signed)
+	assert.Empty(t, inspection.SignerNodeID)
+
+	inspection, err = Inspect(ctx, backend, "a", &Verifier{TrustedKeys: []crypto.PublicKey{key.Public()}})
+	assert.NoError(t, err)
+	assert.True(t, inspection.Verified)
+
+	// Unsigned manifests can be inspected (unless they must
+	// be verified)
+	manifest.Name = "b"
+	assert.NoError(t, Write(ctx, backend, manifest, nil))
+	inspection, err = Inspect(ctx, backend, "b", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", inspection.Manifest.Name)
+	assert.False(t, inspection.Signed)
+
+	_, err = Inspect(ctx, backend, "b", &Verifier{NodeID: nodeID})
+	assert.ErrorIs(t, err, ErrUnsigned)
+
+	// Backups without a manifest cannot be inspected
+	_, err = Inspect(ctx, backend, "c", nil)
+	assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+}
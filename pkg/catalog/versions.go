@@ -0,0 +1,107 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+const (
+	// LatestName is the name of the object (relative to a
+	// NodeID) holding the version of the latest backup.
+	LatestName = "latest"
+
+	// versionFormat sorts lexicographically in time order and
+	// only uses characters that are safe in object names.
+	versionFormat = "20060102T150405.000Z"
+)
+
+var versionPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{3}Z$`)
+
+// ErrNoLatest is returned by ReadLatest when no
+// versioned backup exists for a NodeID.
+var ErrNoLatest = errors.New("no latest version")
+
+// NewVersion returns the version of a backup created at t.
+func NewVersion(t time.Time) string {
+	return t.UTC().Format(versionFormat)
+}
+
+// ValidateVersion returns an error if version was not
+// created by NewVersion.
+func ValidateVersion(version string) error {
+	if !versionPattern.MatchString(version) {
+		return fmt.Errorf("%s is not a valid version", version)
+	}
+
+	return nil
+}
+
+// VersionedName returns the name of the version of a backup
+// of nodeID with the provided extension.
+func VersionedName(nodeID string, version string, extension string) string {
+	return path.Join(nodeID, version+extension)
+}
+
+// WriteLatest points the latest backup of nodeID at version.
+// It must only be called once version has been uploaded.
+func WriteLatest(ctx context.Context, backend storage.Backend, nodeID string, version string) error {
+	name := path.Join(nodeID, LatestName)
+	if err := backend.Put(ctx, name, strings.NewReader(version)); err != nil {
+		return fmt.Errorf("%w: could not update %s", err, name)
+	}
+
+	return nil
+}
+
+// ReadLatest returns the version of the latest backup of
+// nodeID or ErrNoLatest if there are none.
+func ReadLatest(ctx context.Context, backend storage.Backend, nodeID string) (string, error) {
+	name := path.Join(nodeID, LatestName)
+	rc, err := backend.Get(ctx, name)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return "", fmt.Errorf("%w: %s", ErrNoLatest, nodeID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: could not read %s", err, name)
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not read %s", err, name)
+	}
+
+	version := strings.TrimSpace(string(data))
+	if err := ValidateVersion(version); err != nil {
+		return "", fmt.Errorf("%w: %s is corrupt", err, name)
+	}
+
+	return version, nil
+}
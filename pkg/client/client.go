@@ -53,8 +53,8 @@ func NewClient() *Client {
 
 // GetLivenessReply is the response for GetLiveness
 type GetLivenessReply struct {
-	Checks  map[string]interface{} `json:"checks"`
-	Healthy bool                   `json:"healthy"`
+	Checks  map[string]*CheckResult `json:"checks"`
+	Healthy bool                    `json:"healthy"`
 }
 
 // GetLiveness returns a health check on the Avalanche node
@@ -64,6 +64,17 @@ func (c *Client) GetLiveness() (*GetLivenessReply, error) {
 	return res, err
 }
 
+// Liveness returns the health checks of the Avalanche node
+// grouped by subsystem.
+func (c *Client) Liveness() (*Liveness, error) {
+	reply, err := c.GetLiveness()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLiveness(reply), nil
+}
+
 // IsHealthy ...
 func (c *Client) IsHealthy() (bool, error) {
 	liveness, err := c.GetLiveness()
@@ -116,3 +127,19 @@ func (c *Client) Peers() (uint64, error) {
 
 	return uint64(res.NumPeers), nil
 }
+
+// GetNodeVersionReply are the results from calling GetNodeVersion
+type GetNodeVersionReply struct {
+	Version string `json:"version"`
+}
+
+// NodeVersion returns the version of the Avalanche node
+// (ex: avalanche/1.3.2).
+func (c *Client) NodeVersion() (string, error) {
+	res := &GetNodeVersionReply{}
+	if err := c.infoRequester.SendRequest("getNodeVersion", struct{}{}, res); err != nil {
+		return "", err
+	}
+
+	return res.Version, nil
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// NetworkCheck is the health check of the p2p network.
+	NetworkCheck = "network"
+
+	// RouterCheck is the health check of the consensus
+	// router.
+	RouterCheck = "router"
+
+	// BootstrappedCheck passes once every chain is
+	// bootstrapped.
+	BootstrappedCheck = "isBootstrapped"
+)
+
+// CheckError is the error of a failing health check.
+type CheckError struct {
+	Message string      `json:"message,omitempty"`
+	Cause   *CheckError `json:"cause,omitempty"`
+}
+
+// UnmarshalJSON accepts errors serialized as objects (ex:
+// {"message": "..."} in avalanchego v1.4) and as strings (in
+// later versions).
+func (e *CheckError) UnmarshalJSON(b []byte) error {
+	var message string
+	if err := json.Unmarshal(b, &message); err == nil {
+		*e = CheckError{Message: message}
+		return nil
+	}
+
+	// checkError has no UnmarshalJSON method (so decoding
+	// it does not recurse)
+	type checkError CheckError
+	decoded := &checkError{}
+	if err := json.Unmarshal(b, decoded); err != nil {
+		return fmt.Errorf("%w: could not parse health check error", err)
+	}
+
+	*e = CheckError(*decoded)
+	return nil
+}
+
+// Error returns the message of e (and of its cause if it
+// adds anything).
+func (e *CheckError) Error() string {
+	if e.Cause == nil || strings.Contains(e.Message, e.Cause.Error()) {
+		return e.Message
+	}
+
+	return fmt.Sprintf("%s: %s", e.Message, e.Cause.Error())
+}
+
+// CheckResult is the result of an avalanchego health check.
+type CheckResult struct {
+	// Message contains the details of the check (its format
+	// depends on the check).
+	Message interface{} `json:"message,omitempty"`
+
+	// Error is nil if the check passed.
+	Error *CheckError `json:"error,omitempty"`
+
+	Timestamp          time.Time     `json:"timestamp"`
+	Duration           time.Duration `json:"duration,omitempty"`
+	ContiguousFailures int64         `json:"contiguousFailures"`
+	TimeOfFirstFailure *time.Time    `json:"timeOfFirstFailure"`
+}
+
+// Failing returns true if the check did not pass.
+func (r *CheckResult) Failing() bool {
+	return r.Error != nil
+}
+
+// Liveness is the result of every avalanchego health check
+// grouped by subsystem. Any subsystem can be nil if the node
+// did not report it.
+type Liveness struct {
+	Healthy bool
+
+	Network      *CheckResult
+	Router       *CheckResult
+	Bootstrapped *CheckResult
+
+	// Chains are the health checks of each chain (by alias).
+	// Checks of unknown subsystems are also included.
+	Chains map[string]*CheckResult
+}
+
+// NewLiveness groups the checks in reply by subsystem.
+func NewLiveness(reply *GetLivenessReply) *Liveness {
+	l := &Liveness{
+		Healthy: reply.Healthy,
+		Chains:  map[string]*CheckResult{},
+	}
+
+	for name, result := range reply.Checks {
+		switch name {
+		case NetworkCheck:
+			l.Network = result
+		case RouterCheck:
+			l.Router = result
+		case BootstrappedCheck:
+			l.Bootstrapped = result
+		default:
+			l.Chains[name] = result
+		}
+	}
+
+	return l
+}
+
+// Subsystem is the health check of a subsystem.
+type Subsystem struct {
+	Name   string       `json:"name"`
+	Result *CheckResult `json:"result"`
+}
+
+// Subsystems returns the health check of every subsystem
+// (network, router and bootstrapping first and then each
+// chain by alias). Subsystems without a result are skipped.
+func (l *Liveness) Subsystems() []*Subsystem {
+	subsystems := []*Subsystem{}
+	for _, s := range []*Subsystem{
+		{Name: NetworkCheck, Result: l.Network},
+		{Name: RouterCheck, Result: l.Router},
+		{Name: BootstrappedCheck, Result: l.Bootstrapped},
+	} {
+		if s.Result != nil {
+			subsystems = append(subsystems, s)
+		}
+	}
+
+	chains := make([]string, 0, len(l.Chains))
+	for chain := range l.Chains {
+		chains = append(chains, chain)
+	}
+	sort.Strings(chains)
+	for _, chain := range chains {
+		if result := l.Chains[chain]; result != nil {
+			subsystems = append(subsystems, &Subsystem{Name: chain, Result: result})
+		}
+	}
+
+	return subsystems
+}
+
+// Failing returns every failing subsystem (in the order of
+// Subsystems).
+func (l *Liveness) Failing() []*Subsystem {
+	failing := []*Subsystem{}
+	for _, s := range l.Subsystems() {
+		if s.Result.Failing() {
+			failing = append(failing, s)
+		}
+	}
+
+	return failing
+}
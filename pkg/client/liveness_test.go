@@ -0,0 +1,161 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package client
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// livenessReply is a getLiveness reply of avalanchego v1.4.
+const livenessReply = `{
+	"checks": {
+		"C": {
+			"message": {"consensus": {"outstandingBlocks": 0}, "vm": null},
+			"timestamp": "2021-06-01T10:00:00Z",
+			"duration": 23402,
+			"contiguousFailures": 0,
+			"timeOfFirstFailure": null
+		},
+		"X": {
+			"message": {"consensus": {"outstandingVertices": 0}, "vm": null},
+			"timestamp": "2021-06-01T10:00:00Z",
+			"duration": 14301,
+			"contiguousFailures": 0,
+			"timeOfFirstFailure": null
+		},
+		"isBootstrapped": {
+			"timestamp": "2021-06-01T10:00:00Z",
+			"duration": 3100,
+			"contiguousFailures": 0,
+			"timeOfFirstFailure": null
+		},
+		"network": {
+			"message": {"connectedPeers": 3, "timeSinceLastMsgReceived": "1m0s"},
+			"error": {
+				"message": "network layer is unhealthy reason: not connected to a minimum of 5 peers",
+				"cause": {"message": "not connected to a minimum of 5 peers"}
+			},
+			"timestamp": "2021-06-01T10:00:00Z",
+			"duration": 10200,
+			"contiguousFailures": 4,
+			"timeOfFirstFailure": "2021-06-01T09:59:20Z"
+		},
+		"router": {
+			"message": {"longestRunningRequest": "0s", "outstandingRequests": 0},
+			"error": {"message": "the router is unhealthy", "cause": {"message": "too many outstanding requests"}},
+			"timestamp": "2021-06-01T10:00:00Z",
+			"duration": 5200,
+			"contiguousFailures": 1,
+			"timeOfFirstFailure": "2021-06-01T10:00:00Z"
+		}
+	},
+	"healthy": false
+}`
+
+func TestLiveness(t *testing.T) {
+	reply := &GetLivenessReply{}
+	assert.NoError(t, json.Unmarshal([]byte(livenessReply), reply))
+
+	l := NewLiveness(reply)
+	assert.False(t, l.Healthy)
+	assert.Len(t, l.Chains, 2)
+
+	firstFailure := time.Date(2021, 6, 1, 9, 59, 20, 0, time.UTC)
+	assert.Equal(t, &CheckResult{
+		Message: map[string]interface{}{
+			"connectedPeers":           float64(3),
+			"timeSinceLastMsgReceived": "1m0s",
+		},
+		Error: &CheckError{
+			Message: "network layer is unhealthy reason: not connected to a minimum of 5 peers",
+			Cause:   &CheckError{Message: "not connected to a minimum of 5 peers"},
+		},
+		Timestamp:          time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+		Duration:           10200,
+		ContiguousFailures: 4,
+		TimeOfFirstFailure: &firstFailure,
+	}, l.Network)
+	assert.False(t, l.Bootstrapped.Failing())
+
+	names := []string{}
+	for _, s := range l.Subsystems() {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"network", "router", "isBootstrapped", "C", "X"}, names)
+
+	// Causes are only included if the message doesn't
+	// already contain them
+	failing := l.Failing()
+	assert.Len(t, failing, 2)
+	assert.Equal(t, "network layer is unhealthy reason: not connected to a minimum of 5 peers", failing[0].Result.Error.Error())
+	assert.Equal(t, "the router is unhealthy: too many outstanding requests", failing[1].Result.Error.Error())
+}
+
+// stringErrorReply is a getLiveness reply with errors
+// serialized as strings (as later versions of avalanchego do)
+// and a chain without a result.
+const stringErrorReply = `{
+	"checks": {
+		"C": {
+			"error": "chain is not making progress",
+			"timestamp": "2021-06-01T10:00:00Z",
+			"contiguousFailures": 2,
+			"timeOfFirstFailure": "2021-06-01T09:59:50Z"
+		},
+		"P": null,
+		"network": {
+			"message": {"connectedPeers": 20},
+			"timestamp": "2021-06-01T10:00:00Z",
+			"contiguousFailures": 0,
+			"timeOfFirstFailure": null
+		}
+	},
+	"healthy": false
+}`
+
+func TestLivenessStringErrors(t *testing.T) {
+	reply := &GetLivenessReply{}
+	assert.NoError(t, json.Unmarshal([]byte(stringErrorReply), reply))
+
+	l := NewLiveness(reply)
+	assert.False(t, l.Healthy)
+	assert.Nil(t, l.Router)
+	assert.Nil(t, l.Chains["P"])
+
+	// Subsystems without a result are skipped
+	names := []string{}
+	for _, s := range l.Subsystems() {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"network", "C"}, names)
+
+	failing := l.Failing()
+	assert.Len(t, failing, 1)
+	assert.Equal(t, "C", failing[0].Name)
+	assert.Equal(t, &CheckError{Message: "chain is not making progress"}, failing[0].Result.Error)
+	assert.Equal(t, int64(2), failing[0].Result.ContiguousFailures)
+
+	// Errors that are neither strings nor objects are
+	// rejected
+	assert.Error(t, json.Unmarshal([]byte(`{"error": 1}`), &CheckResult{}))
+}
@@ -20,38 +20,340 @@
 package compression
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
 	"fmt"
-	"os/exec"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
-// Compress compresses a file using tar.
-func Compress(input string, output string) error {
-	fmt.Printf("compressing %s...\n", output)
-	tarCmd := exec.Command(
-		"tar",
-		"-cvzf",
-		output,
-		input,
-	)
-	if err := tarCmd.Run(); err != nil {
-		return fmt.Errorf("%w: could not compress %s", err, input)
+// Format is the compression applied to a tar archive.
+type Format string
+
+const (
+	// Gzip compresses archives with gzip (.tar.gz).
+	Gzip Format = "gzip"
+
+	// Zstd compresses archives with zstd (.tar.zst).
+	Zstd Format = "zstd"
+
+	gzipExtension = ".tar.gz"
+	zstdExtension = ".tar.zst"
+
+	// permMask is applied to the mode of all extracted
+	// files (dropping setuid, setgid and sticky bits).
+	permMask = 0777
+
+	// ownerDirectoryPerm is always granted on extracted
+	// directories so that their contents can be written.
+	ownerDirectoryPerm = 0700
+)
+
+// ErrUnsafeArchive is returned when an archive contains
+// an entry that cannot be safely extracted.
+var ErrUnsafeArchive = errors.New("unsafe archive")
+
+// ParseFormat returns the Format named s.
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case Gzip, Zstd:
+		return Format(s), nil
+	default:
+		return "", fmt.Errorf("compression format %s is not supported", s)
+	}
+}
+
+// FormatFromName returns the Format of an archive based
+// on the extension of name.
+func FormatFromName(name string) (Format, error) {
+	switch {
+	case strings.HasSuffix(name, gzipExtension):
+		return Gzip, nil
+	case strings.HasSuffix(name, zstdExtension):
+		return Zstd, nil
+	default:
+		return "", fmt.Errorf("could not determine compression format of %s", name)
+	}
+}
+
+// Extension returns the file extension used for
+// archives in Format f.
+func (f Format) Extension() string {
+	if f == Zstd {
+		return zstdExtension
+	}
+
+	return gzipExtension
+}
+
+// NewWriter returns an io.WriteCloser that compresses
+// data written to it into w.
+func NewWriter(w io.Writer, format Format) (io.WriteCloser, error) {
+	switch format {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("compression format %s is not supported", format)
+	}
+}
+
+// NewReader returns an io.ReadCloser that decompresses
+// data read from r.
+func NewReader(r io.Reader, format Format) (io.ReadCloser, error) {
+	switch format {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("compression format %s is not supported", format)
+	}
+}
+
+// Compress writes a compressed tar archive of the directory
+// at src (relative to base) to w. Entries are named by their
+// path relative to base, so the archive can be extracted
+// into any directory with Decompress. Only regular files and
+// directories are supported.
+func Compress(w io.Writer, base string, src string, format Format) error {
+	fmt.Printf("compressing %s...\n", src)
+	cw, err := NewWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(cw)
+	root := filepath.Join(base, src)
+	if err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		return addEntry(tw, base, p, info)
+	}); err != nil {
+		return fmt.Errorf("%w: could not compress %s", err, src)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("%w: could not finish archive", err)
+	}
+
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("%w: could not finish compression", err)
 	}
 
 	return nil
 }
 
-// Decompress decompresses a file using tar.
-func Decompress(input string, output string) error {
-	fmt.Printf("decompressing %s...\n", input)
-	untarCmd := exec.Command(
-		"tar",
-		"-xvf",
-		input,
-		"-C",
-		output,
-	)
-	if err := untarCmd.Run(); err != nil {
-		return fmt.Errorf("%w: could not uncompress %s", err, input)
+// addEntry writes the file at p to tw.
+func addEntry(tw *tar.Writer, base string, p string, info os.FileInfo) error {
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file or directory", p)
+	}
+
+	rel, err := filepath.Rel(base, p)
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("%w: could not create header for %s", err, p)
+	}
+
+	// Only keep the fields needed to restore the file so that
+	// archives of the same files are identical.
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Mode &= permMask
+	hdr.ModTime = info.ModTime().Truncate(time.Second)
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uid = 0
+	hdr.Gid = 0
+	hdr.Uname = ""
+	hdr.Gname = ""
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("%w: could not write header for %s", err, p)
+	}
+
+	if info.IsDir() {
+		return nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("%w: could not open %s", err, p)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("%w: could not archive %s", err, p)
+	}
+
+	return nil
+}
+
+// Decompress extracts a compressed tar archive read from r
+// into dst. Entries that could escape dst (absolute paths or
+// paths containing ..), links and special files are rejected
+// with ErrUnsafeArchive. Existing files are never overwritten.
+func Decompress(r io.Reader, dst string, format Format) error {
+	fmt.Printf("decompressing into %s...\n", dst)
+	cr, err := NewReader(r, format)
+	if err != nil {
+		return fmt.Errorf("%w: could not start decompression", err)
+	}
+	defer cr.Close()
+
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: could not read archive", err)
+		}
+
+		target, err := EntryPath(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		mode := os.FileMode(hdr.Mode & permMask)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|ownerDirectoryPerm); err != nil {
+				return fmt.Errorf("%w: could not create directory %s", err, target)
+			}
+		case tar.TypeReg, tar.TypeRegA: // nolint:staticcheck
+			if err := ExtractFile(tr, target, mode); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf(
+				"%w: %s has unsupported type %q",
+				ErrUnsafeArchive,
+				hdr.Name,
+				hdr.Typeflag,
+			)
+		}
+	}
+}
+
+// ReadFiles reads every regular file in a compressed tar
+// archive read from r into memory (keyed by their cleaned
+// entry name), so nothing is written to disk. Archives
+// containing more than maxSize bytes of file contents are
+// rejected, as are entries rejected by Decompress.
+func ReadFiles(r io.Reader, format Format, maxSize int64) (map[string][]byte, error) {
+	cr, err := NewReader(r, format)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not start decompression", err)
+	}
+	defer cr.Close()
+
+	files := map[string][]byte{}
+	var size int64
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not read archive", err)
+		}
+
+		// Check if the entry could be extracted safely
+		if _, err := EntryPath(".", hdr.Name); err != nil {
+			return nil, err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg, tar.TypeRegA: // nolint:staticcheck
+		default:
+			return nil, fmt.Errorf(
+				"%w: %s has unsupported type %q",
+				ErrUnsafeArchive,
+				hdr.Name,
+				hdr.Typeflag,
+			)
+		}
+
+		size += hdr.Size
+		if size > maxSize {
+			return nil, fmt.Errorf("archive contains more than %d bytes", maxSize)
+		}
+
+		contents, err := ioutil.ReadAll(io.LimitReader(tr, hdr.Size))
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not read %s", err, hdr.Name)
+		}
+		files[path.Clean(hdr.Name)] = contents
+	}
+}
+
+// EntryPath returns the path an archive entry should be
+// extracted to, ensuring it is contained in dst.
+func EntryPath(dst string, name string) (string, error) {
+	if len(name) == 0 || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("%w: %s is not a relative path", ErrUnsafeArchive, name)
+	}
+
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("%w: %s escapes the destination", ErrUnsafeArchive, name)
+	}
+
+	return filepath.Join(dst, filepath.FromSlash(cleaned)), nil
+}
+
+// ExtractFile writes the contents of r to a new file at
+// target with mode.
+func ExtractFile(r io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), ownerDirectoryPerm); err != nil {
+		return fmt.Errorf("%w: could not create directory for %s", err, target)
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return fmt.Errorf("%w: could not create %s", err, target)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("%w: could not extract %s", err, target)
+	}
+
+	// The mode passed to OpenFile is subject to umask, so we
+	// explicitly set it (ex: 0400 for staker.key).
+	if err := f.Chmod(mode); err != nil {
+		return fmt.Errorf("%w: could not set permissions of %s", err, target)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: could not close %s", err, target)
 	}
 
 	return nil
@@ -0,0 +1,163 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package compression
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	for _, format := range []Format{Gzip, Zstd} {
+		t.Run(string(format), func(t *testing.T) {
+			src := t.TempDir()
+			staking := filepath.Join(".avalanchego", "staking")
+			assert.NoError(t, os.MkdirAll(filepath.Join(src, staking), 0700))
+			assert.NoError(t, ioutil.WriteFile(
+				filepath.Join(src, staking, "staker.key"),
+				[]byte("key"),
+				0600,
+			))
+			assert.NoError(t, ioutil.WriteFile(
+				filepath.Join(src, staking, "staker.crt"),
+				[]byte("cert"),
+				0644,
+			))
+
+			var archive bytes.Buffer
+			assert.NoError(t, Compress(&archive, src, staking, format))
+
+			dst := t.TempDir()
+			assert.NoError(t, Decompress(bytes.NewReader(archive.Bytes()), dst, format))
+
+			key := filepath.Join(dst, staking, "staker.key")
+			contents, err := ioutil.ReadFile(key)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("key"), contents)
+			info, err := os.Stat(key)
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+			cert := filepath.Join(dst, staking, "staker.crt")
+			info, err = os.Stat(cert)
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+			// Existing files are never overwritten
+			assert.Error(t, Decompress(bytes.NewReader(archive.Bytes()), dst, format))
+
+			// Files can be read into memory instead
+			files, err := ReadFiles(bytes.NewReader(archive.Bytes()), format, 7) // nolint:gomnd
+			assert.NoError(t, err)
+			assert.Equal(t, map[string][]byte{
+				".avalanchego/staking/staker.key": []byte("key"),
+				".avalanchego/staking/staker.crt": []byte("cert"),
+			}, files)
+
+			_, err = ReadFiles(bytes.NewReader(archive.Bytes()), format, 6) // nolint:gomnd
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCompressSymlink(t *testing.T) {
+	src := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "staking"), 0700))
+	assert.NoError(t, os.Symlink("/etc/passwd", filepath.Join(src, "staking", "staker.key")))
+
+	var archive bytes.Buffer
+	assert.Error(t, Compress(&archive, src, "staking", Gzip))
+}
+
+func TestDecompressUnsafe(t *testing.T) {
+	tests := map[string]*tar.Header{
+		"parent directory": {
+			Name:     "../evil",
+			Typeflag: tar.TypeReg,
+			Mode:     0600,
+		},
+		"nested parent directory": {
+			Name:     ".avalanchego/../../evil",
+			Typeflag: tar.TypeReg,
+			Mode:     0600,
+		},
+		"absolute path": {
+			Name:     "/tmp/evil",
+			Typeflag: tar.TypeReg,
+			Mode:     0600,
+		},
+		"symlink": {
+			Name:     "staker.key",
+			Linkname: "/etc/passwd",
+			Typeflag: tar.TypeSymlink,
+		},
+		"hardlink": {
+			Name:     "staker.key",
+			Linkname: "/etc/passwd",
+			Typeflag: tar.TypeLink,
+		},
+		"device": {
+			Name:     "null",
+			Typeflag: tar.TypeChar,
+			Mode:     0600,
+		},
+	}
+
+	for name, hdr := range tests {
+		t.Run(name, func(t *testing.T) {
+			var archive bytes.Buffer
+			gw := gzip.NewWriter(&archive)
+			tw := tar.NewWriter(gw)
+			assert.NoError(t, tw.WriteHeader(hdr))
+			assert.NoError(t, tw.Close())
+			assert.NoError(t, gw.Close())
+
+			dst := t.TempDir()
+			err := Decompress(bytes.NewReader(archive.Bytes()), filepath.Join(dst, "out"), Gzip)
+			assert.ErrorIs(t, err, ErrUnsafeArchive)
+
+			_, err = os.Stat(filepath.Join(dst, "evil"))
+			assert.True(t, os.IsNotExist(err))
+
+			_, err = ReadFiles(bytes.NewReader(archive.Bytes()), Gzip, 1)
+			assert.ErrorIs(t, err, ErrUnsafeArchive)
+		})
+	}
+}
+
+func TestFormatFromName(t *testing.T) {
+	format, err := FormatFromName("NodeID-test.tar.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, Gzip, format)
+
+	format, err = FormatFromName("db.tar.zst")
+	assert.NoError(t, err)
+	assert.Equal(t, Zstd, format)
+
+	_, err = FormatFromName("db.zip")
+	assert.Error(t, err)
+}
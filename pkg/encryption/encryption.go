@@ -20,65 +20,347 @@
 package encryption
 
 import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
+
+	// Register the hash functions used for S2K.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// PassphraseEnv is the environment variable checked for
+	// a passphrase before prompting on the terminal.
+	PassphraseEnv = "SNOWPLOW_PASSPHRASE"
+
+	// Extension is appended to the name of encrypted
+	// objects.
+	Extension = ".gpg"
+
+	// s2kCount is the number of bytes hashed when deriving
+	// a key from a passphrase (the maximum allowed by
+	// OpenPGP).
+	s2kCount = 65011712
 )
 
-// Encrypt encrypts a file using gpg.
-func Encrypt(input string, output string) error {
-	encryptCmd := exec.Command(
-		"gpg",
-		"--symmetric",
-		"--cipher-algo",
-		"aes256",
-		"--digest-algo",
-		"sha256",
-		"--cert-digest-algo",
-		"sha256",
-		"--compress-algo",
-		"none",
-		"-z",
-		"0",
-		"--s2k-mode",
-		"3",
-		"--s2k-digest-algo",
-		"sha512",
-		"--s2k-count",
-		"65011712",
-		"--force-mdc",
-		"--no-symkey-cache",
-		"-o",
-		output,
-		"-c",
-		input,
+// ErrIncorrectPassphrase is returned when ciphertext
+// cannot be decrypted with the provided passphrase.
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+
+// ErrNotIntegrityProtected is returned when ciphertext is not
+// integrity protected (with an MDC or AEAD), so it could have
+// been modified without being detected.
+var ErrNotIntegrityProtected = errors.New("message is not integrity protected")
+
+// OpenPGP packet tags (RFC 4880, section 4.3) of the packets
+// that may precede the encrypted data and of the encrypted
+// data itself.
+const (
+	encryptedKeyTag           = 1
+	symmetricKeyEncryptedTag  = 3
+	symmetricallyEncryptedTag = 9
+	markerTag                 = 10
+	integrityProtectedTag     = 18
+	aeadEncryptedTag          = 20
+)
+
+// config matches the settings previously passed to gpg
+// (AES256, SHA512 S2K with the maximum iteration count and
+// no compression) so that backups created before and after
+// the switch to native encryption are interchangeable.
+var config = &packet.Config{
+	DefaultCipher:          packet.CipherAES256,
+	DefaultHash:            crypto.SHA512,
+	DefaultCompressionAlgo: packet.CompressionNone,
+	S2KCount:               s2kCount,
+}
+
+// Encrypt symmetrically encrypts plaintext to ciphertext
+// using an OpenPGP message (compatible with gpg --symmetric)
+// protected by passphrase.
+func Encrypt(plaintext io.Reader, ciphertext io.Writer, passphrase []byte) error {
+	w, err := openpgp.SymmetricallyEncrypt(
+		ciphertext,
+		passphrase,
+		&openpgp.FileHints{IsBinary: true},
+		config,
 	)
-	encryptCmd.Stdin = os.Stdin
-	encryptCmd.Stdout = os.Stdout
-	encryptCmd.Stderr = os.Stderr
-	if err := encryptCmd.Run(); err != nil {
-		return fmt.Errorf("%w: could not encrypt %s", err, input)
+	if err != nil {
+		return fmt.Errorf("%w: could not start encryption", err)
+	}
+
+	if _, err := io.Copy(w, plaintext); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("%w: could not encrypt", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("%w: could not finish encryption", err)
+	}
+
+	return nil
+}
+
+// Decrypt decrypts an OpenPGP message protected by passphrase
+// from ciphertext to plaintext. The integrity of the message
+// is only verified once all of ciphertext has been read, so
+// callers must discard plaintext if an error is returned.
+func Decrypt(ciphertext io.Reader, plaintext io.Writer, passphrase []byte) error {
+	return decrypt(ciphertext, plaintext, openpgp.EntityList{}, passphrase)
+}
+
+// DecryptWithIdentities decrypts an OpenPGP message encrypted
+// to one of the private keys in identities from ciphertext to
+// plaintext. passphrase is used to unlock any encrypted
+// private keys and may be nil if none are encrypted.
+func DecryptWithIdentities(
+	ciphertext io.Reader,
+	plaintext io.Writer,
+	identities openpgp.EntityList,
+	passphrase []byte,
+) error {
+	return decrypt(ciphertext, plaintext, identities, passphrase)
+}
+
+func decrypt(
+	ciphertext io.Reader,
+	plaintext io.Writer,
+	keyring openpgp.EntityList,
+	passphrase []byte,
+) error {
+	// ReadMessage calls prompt until decryption succeeds, so
+	// we must return an error after the first attempt.
+	var prompted bool
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if prompted || len(passphrase) == 0 {
+			return nil, ErrIncorrectPassphrase
+		}
+		prompted = true
+
+		for _, key := range keys {
+			if err := key.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, fmt.Errorf("%w: could not unlock private key", ErrIncorrectPassphrase)
+			}
+		}
+
+		return passphrase, nil
+	}
+
+	ciphertext, err := requireIntegrity(ciphertext)
+	if err != nil {
+		return err
+	}
+
+	md, err := openpgp.ReadMessage(ciphertext, keyring, prompt, config)
+	if err != nil {
+		return fmt.Errorf("%w: could not start decryption", err)
+	}
+
+	if _, err := io.Copy(plaintext, md.UnverifiedBody); err != nil {
+		return fmt.Errorf("%w: could not decrypt", err)
 	}
 
 	return nil
 }
 
-// Decrypt decrypts a file using gpg.
-func Decrypt(input string, output string) error {
-	decryptCmd := exec.Command(
-		"gpg",
-		"--no-symkey-cache",
-		"-o",
-		output,
-		"--decrypt",
-		input,
+// packetTag returns the tag of the packet whose first byte
+// is b.
+func packetTag(b byte) (int, error) {
+	if b&0x80 == 0 {
+		return 0, errors.New("invalid OpenPGP packet")
+	}
+
+	// New format packets store the tag in the lower 6 bits
+	// and old format packets in the 4 bits above the length
+	// type.
+	if b&0x40 != 0 {
+		return int(b & 0x3f), nil
+	}
+
+	return int(b&0x3f) >> 2, nil // nolint:gomnd
+}
+
+// requireIntegrity reads the packets preceding the encrypted
+// data in ciphertext and fails with ErrNotIntegrityProtected
+// unless the data is integrity protected. The returned reader
+// yields the entire ciphertext (the encrypted data is never
+// buffered).
+func requireIntegrity(ciphertext io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(ciphertext)
+	var header bytes.Buffer
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not read OpenPGP packet", err)
+		}
+
+		tag, err := packetTag(b[0])
+		if err != nil {
+			return nil, err
+		}
+
+		switch tag {
+		case encryptedKeyTag, symmetricKeyEncryptedTag, markerTag:
+			// Check if the (small) packet can be read and
+			// keep it to pass to ReadMessage
+			if _, err := packet.Read(io.TeeReader(br, &header)); err != nil && tag != markerTag {
+				return nil, fmt.Errorf("%w: could not read OpenPGP packet", err)
+			}
+		case integrityProtectedTag, aeadEncryptedTag:
+			return io.MultiReader(&header, br), nil
+		case symmetricallyEncryptedTag:
+			return nil, ErrNotIntegrityProtected
+		default:
+			return nil, fmt.Errorf("unexpected OpenPGP packet %d", tag)
+		}
+	}
+}
+
+// EncryptToRecipients encrypts plaintext to ciphertext using an
+// OpenPGP message (compatible with gpg --encrypt) that can be
+// decrypted by the private key of any of recipients. No secret
+// material is needed to encrypt.
+func EncryptToRecipients(plaintext io.Reader, ciphertext io.Writer, recipients openpgp.EntityList) error {
+	if len(recipients) == 0 {
+		return errors.New("no recipients provided")
+	}
+
+	w, err := openpgp.Encrypt(
+		ciphertext,
+		recipients,
+		nil,
+		&openpgp.FileHints{IsBinary: true},
+		config,
 	)
-	decryptCmd.Stdin = os.Stdin
-	decryptCmd.Stdout = os.Stdout
-	decryptCmd.Stderr = os.Stderr
-	if err := decryptCmd.Run(); err != nil {
-		return fmt.Errorf("%w: could not decrypt %s", err, input)
+	if err != nil {
+		return fmt.Errorf("%w: could not start encryption", err)
+	}
+
+	if _, err := io.Copy(w, plaintext); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("%w: could not encrypt", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("%w: could not finish encryption", err)
 	}
 
 	return nil
 }
+
+// LoadKeys reads all OpenPGP keys (public or private, armored
+// or binary) from the files at paths.
+func LoadKeys(paths ...string) (openpgp.EntityList, error) {
+	keys := openpgp.EntityList{}
+	for _, path := range paths {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not read %s", err, path)
+		}
+
+		fileKeys, err := readKeys(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not parse keys in %s", err, path)
+		}
+
+		keys = append(keys, fileKeys...)
+	}
+
+	return keys, nil
+}
+
+// readKeys parses an armored or binary keyring.
+func readKeys(raw []byte) (openpgp.EntityList, error) {
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(raw))
+	if err != nil {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(raw))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+
+	return keys, nil
+}
+
+// HasEncryptedPrivateKeys returns true if any private key
+// in identities is protected by a passphrase.
+func HasEncryptedPrivateKeys(identities openpgp.EntityList) bool {
+	for _, identity := range identities {
+		if identity.PrivateKey != nil && identity.PrivateKey.Encrypted {
+			return true
+		}
+
+		for _, subkey := range identity.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// LoadPassphrase returns the passphrase stored in PassphraseEnv
+// or, if it is not set, prompts for one on the terminal. If
+// confirm is true, the passphrase must be entered twice.
+func LoadPassphrase(confirm bool) ([]byte, error) {
+	if passphrase := os.Getenv(PassphraseEnv); len(passphrase) > 0 {
+		return []byte(passphrase), nil
+	}
+
+	passphrase, err := promptPassphrase("enter passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase cannot be empty")
+	}
+
+	if !confirm {
+		return passphrase, nil
+	}
+
+	confirmation, err := promptPassphrase("confirm passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if string(passphrase) != string(confirmation) {
+		return nil, errors.New("passphrases do not match")
+	}
+
+	return passphrase, nil
+}
+
+// promptPassphrase reads a passphrase from the terminal
+// without echoing it.
+func promptPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, fmt.Errorf("stdin is not a terminal and %s is not set", PassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read passphrase", err)
+	}
+
+	return passphrase, nil
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testPassphrase = "correct horse battery staple"
+	legacyFixture  = "testdata/legacy.txt.gpg"
+	legacyMessage  = "snowplow legacy backup\n"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	plaintext := []byte("staker.key and staker.crt")
+
+	var ciphertext bytes.Buffer
+	assert.NoError(t, Encrypt(bytes.NewReader(plaintext), &ciphertext, []byte(testPassphrase)))
+	assert.NotContains(t, ciphertext.String(), string(plaintext))
+
+	var decrypted bytes.Buffer
+	assert.NoError(t, Decrypt(bytes.NewReader(ciphertext.Bytes()), &decrypted, []byte(testPassphrase)))
+	assert.Equal(t, plaintext, decrypted.Bytes())
+
+	var wrong bytes.Buffer
+	assert.Error(t, Decrypt(bytes.NewReader(ciphertext.Bytes()), &wrong, []byte("wrong")))
+	assert.NotEqual(t, plaintext, wrong.Bytes())
+}
+
+func TestEncryptToRecipients(t *testing.T) {
+	plaintext := []byte("staker.key and staker.crt")
+	recipient, err := openpgp.NewEntity("recipient", "", "recipient@example.com", nil)
+	assert.NoError(t, err)
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	assert.NoError(t, err)
+
+	// Only public material is needed to encrypt.
+	var public bytes.Buffer
+	assert.NoError(t, recipient.Serialize(&public))
+	recipients, err := readKeys(public.Bytes())
+	assert.NoError(t, err)
+	assert.Nil(t, recipients[0].PrivateKey)
+
+	var ciphertext bytes.Buffer
+	assert.NoError(t, EncryptToRecipients(bytes.NewReader(plaintext), &ciphertext, recipients))
+
+	var decrypted bytes.Buffer
+	assert.NoError(t, DecryptWithIdentities(
+		bytes.NewReader(ciphertext.Bytes()),
+		&decrypted,
+		openpgp.EntityList{recipient},
+		nil,
+	))
+	assert.Equal(t, plaintext, decrypted.Bytes())
+
+	// Encrypted private keys are unlocked with the passphrase.
+	assert.NoError(t, recipient.PrivateKey.Encrypt([]byte(testPassphrase)))
+	for _, subkey := range recipient.Subkeys {
+		assert.NoError(t, subkey.PrivateKey.Encrypt([]byte(testPassphrase)))
+	}
+	assert.True(t, HasEncryptedPrivateKeys(openpgp.EntityList{recipient}))
+	decrypted.Reset()
+	assert.NoError(t, DecryptWithIdentities(
+		bytes.NewReader(ciphertext.Bytes()),
+		&decrypted,
+		openpgp.EntityList{recipient},
+		[]byte(testPassphrase),
+	))
+	assert.Equal(t, plaintext, decrypted.Bytes())
+
+	// Passphrase-only decryption and other identities fail.
+	assert.Error(t, Decrypt(bytes.NewReader(ciphertext.Bytes()), ioutil.Discard, []byte(testPassphrase)))
+	assert.Error(t, DecryptWithIdentities(
+		bytes.NewReader(ciphertext.Bytes()),
+		ioutil.Discard,
+		openpgp.EntityList{other},
+		nil,
+	))
+}
+
+func TestDecryptTampered(t *testing.T) {
+	var ciphertext bytes.Buffer
+	assert.NoError(t, Encrypt(bytes.NewReader([]byte("hello")), &ciphertext, []byte(testPassphrase)))
+
+	tampered := ciphertext.Bytes()
+	tampered[len(tampered)-1] ^= 0xff
+	assert.Error(t, Decrypt(bytes.NewReader(tampered), ioutil.Discard, []byte(testPassphrase)))
+}
+
+// nonMDCMessage returns an OpenPGP message containing
+// message encrypted with passphrase in a Symmetrically
+// Encrypted Data packet (which has no MDC).
+func nonMDCMessage(t *testing.T, message string) []byte {
+	var buf bytes.Buffer
+	key, err := packet.SerializeSymmetricKeyEncrypted(&buf, []byte(testPassphrase), config)
+	assert.NoError(t, err)
+
+	// Literal Data packet (binary, no file name or time)
+	literal := append([]byte{0xc0 | 11, byte(6 + len(message)), 'b', 0, 0, 0, 0, 0}, message...)
+
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+	randData := make([]byte, block.BlockSize())
+	_, err = rand.Read(randData)
+	assert.NoError(t, err)
+	stream, prefix := packet.NewOCFBEncrypter(block, randData, packet.OCFBResync)
+	encrypted := make([]byte, len(literal))
+	stream.XORKeyStream(encrypted, literal)
+
+	contents := append(prefix, encrypted...)
+	buf.Write([]byte{0xc0 | 9, byte(len(contents))})
+	buf.Write(contents)
+	return buf.Bytes()
+}
+
+func TestDecryptNotIntegrityProtected(t *testing.T) {
+	var decrypted bytes.Buffer
+	err := Decrypt(bytes.NewReader(nonMDCMessage(t, "hello")), &decrypted, []byte(testPassphrase))
+	assert.ErrorIs(t, err, ErrNotIntegrityProtected)
+	assert.Empty(t, decrypted.Bytes())
+
+	// Integrity protected messages are still decrypted
+	// after the packets preceding the encrypted data are
+	// read
+	var ciphertext bytes.Buffer
+	assert.NoError(t, Encrypt(bytes.NewReader([]byte("hello")), &ciphertext, []byte(testPassphrase)))
+	assert.NoError(t, Decrypt(&ciphertext, &decrypted, []byte(testPassphrase)))
+	assert.Equal(t, "hello", decrypted.String())
+}
+
+// TestDecryptLegacy ensures backups created by the
+// gpg-based implementation can still be decrypted.
+func TestDecryptLegacy(t *testing.T) {
+	f, err := os.Open(legacyFixture)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var decrypted bytes.Buffer
+	assert.NoError(t, Decrypt(f, &decrypted, []byte(testPassphrase)))
+	assert.Equal(t, legacyMessage, decrypted.String())
+}
+
+// TestGPGCompatibility ensures backups created natively can
+// be decrypted with gpg (if it is installed).
+func TestGPGCompatibility(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "message.gpg")
+	var ciphertext bytes.Buffer
+	assert.NoError(t, Encrypt(bytes.NewReader([]byte(legacyMessage)), &ciphertext, []byte(testPassphrase)))
+	assert.NoError(t, ioutil.WriteFile(encrypted, ciphertext.Bytes(), 0600))
+
+	homeDir := filepath.Join(dir, "gnupg")
+	assert.NoError(t, os.Mkdir(homeDir, 0700))
+	cmd := exec.Command(
+		"gpg",
+		"--homedir",
+		homeDir,
+		"--batch",
+		"--pinentry-mode",
+		"loopback",
+		"--passphrase",
+		testPassphrase,
+		"--decrypt",
+		encrypted,
+	)
+	output, err := cmd.Output()
+	assert.NoError(t, err)
+	assert.Equal(t, legacyMessage, string(output))
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package health
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/patrick-ogrady/snowplow/pkg/client"
+)
+
+// Severity describes the impact of a failing Check.
+type Severity string
+
+const (
+	// Critical checks make the node unhealthy while they
+	// are failing.
+	Critical Severity = "critical"
+
+	// Warning checks are reported while they are failing
+	// but do not make the node unhealthy.
+	Warning Severity = "warning"
+)
+
+// Check is a condition the Monitor checks periodically. A
+// Check is failing once its last run did not pass and it has
+// not passed for longer than its Threshold.
+type Check interface {
+	// Name identifies the check in alerts (ex: IsHealthy).
+	Name() string
+
+	// Interval is how often the check is run.
+	Interval() time.Duration
+
+	// Threshold is how long the check can go without
+	// passing before it is failing.
+	Threshold() time.Duration
+
+	// Severity is the impact of the check failing.
+	Severity() Severity
+
+	// Failure describes the check while it is failing (ex:
+	// isHealthy=false).
+	Failure() string
+
+	// Run runs the check once and returns true if it
+	// passed. An error (ex: the node could not be reached)
+	// is alerted immediately.
+	Run(ctx context.Context) (bool, error)
+}
+
+// Failure is a failing Check.
+type Failure struct {
+	Name     string
+	Severity Severity
+	Message  string
+}
+
+// bootstrappedCheckName is the name of the check of whether
+// chain is bootstrapped.
+func bootstrappedCheckName(chain string) string {
+	return fmt.Sprintf("%s-Chain IsBootstrapped", chain)
+}
+
+// bootstrappedCheck passes once chain is bootstrapped (and
+// then never calls the node again).
+type bootstrappedCheck struct {
+	m     *Monitor
+	chain string
+	start time.Time
+
+	bootstrapped bool
+}
+
+func (c *bootstrappedCheck) Name() string {
+	return bootstrappedCheckName(c.chain)
+}
+
+func (c *bootstrappedCheck) Interval() time.Duration {
+	return c.m.config.HealthInterval
+}
+
+func (c *bootstrappedCheck) Threshold() time.Duration {
+	return 0
+}
+
+func (c *bootstrappedCheck) Severity() Severity {
+	return Critical
+}
+
+func (c *bootstrappedCheck) Failure() string {
+	return fmt.Sprintf("%s-Chain isBootstrapped=false", c.chain)
+}
+
+func (c *bootstrappedCheck) Run(ctx context.Context) (bool, error) {
+	if c.bootstrapped {
+		return true, nil
+	}
+
+	bootstrapped, err := c.m.client.IsBootstrapped(c.chain)
+	if err != nil || !bootstrapped {
+		return false, err
+	}
+
+	c.bootstrapped = true
+	c.m.notifier.Info(fmt.Sprintf("%s-Chain bootstrapped after %s", c.chain, c.m.clock.Now().Sub(c.start)))
+	return true, nil
+}
+
+// healthyCheck passes when the node reports that it is
+// healthy. Failures name the subsystems (ex: network) that
+// failed.
+type healthyCheck struct {
+	m *Monitor
+
+	// failing are the subsystems that failed in the last
+	// run.
+	failing []*client.Subsystem
+}
+
+func (c *healthyCheck) Name() string {
+	return "IsHealthy"
+}
+
+func (c *healthyCheck) Interval() time.Duration {
+	return c.m.config.HealthInterval
+}
+
+func (c *healthyCheck) Threshold() time.Duration {
+	return c.m.config.UnhealthyThreshold
+}
+
+func (c *healthyCheck) Severity() Severity {
+	return Critical
+}
+
+func (c *healthyCheck) Failure() string {
+	if len(c.failing) == 0 {
+		return "isHealthy=false"
+	}
+
+	// The failing subsystems are listed after a prefix so
+	// the list reads as a single failure (any duration is
+	// appended to the whole list)
+	failures := []string{}
+	for _, s := range c.failing {
+		failures = append(failures, fmt.Sprintf(
+			"%s (%s, %d contiguous failures)",
+			s.Name,
+			s.Result.Error.Error(),
+			s.Result.ContiguousFailures,
+		))
+	}
+
+	return fmt.Sprintf("isHealthy=false: %s", strings.Join(failures, ", "))
+}
+
+func (c *healthyCheck) Run(ctx context.Context) (bool, error) {
+	liveness, err := c.m.client.Liveness()
+	if err != nil {
+		return false, err
+	}
+
+	c.failing = liveness.Failing()
+	c.m.update(func(s *Snapshot) {
+		s.Subsystems = liveness.Subsystems()
+	})
+	return liveness.Healthy, nil
+}
+
+// peersCheck passes when the node is connected to at least
+// MinPeers peers. The number of peers is also recorded.
+type peersCheck struct {
+	m *Monitor
+
+	seenMinPeers bool
+}
+
+func (c *peersCheck) Name() string {
+	return "Peers"
+}
+
+func (c *peersCheck) Interval() time.Duration {
+	return c.m.config.HealthInterval
+}
+
+func (c *peersCheck) Threshold() time.Duration {
+	return c.m.config.UnhealthyThreshold
+}
+
+func (c *peersCheck) Severity() Severity {
+	return Critical
+}
+
+func (c *peersCheck) Failure() string {
+	return fmt.Sprintf("peers < %d", c.m.config.MinPeers)
+}
+
+func (c *peersCheck) Run(ctx context.Context) (bool, error) {
+	peers, err := c.m.client.Peers()
+	if err != nil {
+		return false, err
+	}
+
+	if err := c.m.metricWriter.Peers(ctx, peers); err != nil {
+		c.m.alert(fmt.Sprintf("Peers metric writing failed: %s", err.Error()))
+	}
+
+	c.m.update(func(s *Snapshot) {
+		s.Peers = peers
+	})
+	if peers < c.m.config.MinPeers {
+		return false, nil
+	}
+
+	if !c.seenMinPeers {
+		c.seenMinPeers = true
+		c.m.notifier.Info(fmt.Sprintf("connected peers (%d) >= %d", peers, c.m.config.MinPeers))
+	}
+
+	return true, nil
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package health
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// Mainnet is the profile of nodes on the Avalanche
+	// mainnet.
+	Mainnet = "mainnet"
+
+	// Fuji is the profile of nodes on the Fuji testnet,
+	// which has far fewer nodes than mainnet.
+	Fuji = "fuji"
+
+	// Local is the profile of nodes on a local network,
+	// which may not have any peers.
+	Local = "local"
+
+	defaultHealthInterval     = 10 * time.Second
+	defaultStatusInterval     = time.Hour
+	defaultUnhealthyThreshold = time.Minute
+	defaultPort               = 8080
+	mainnetMinPeers           = 400
+	fujiMinPeers              = 20
+
+	maxPort = 65535
+)
+
+// Profiles are the default Config of each network.
+var Profiles = map[string]*Config{
+	Mainnet: {
+		Network:            Mainnet,
+		HealthInterval:     defaultHealthInterval,
+		StatusInterval:     defaultStatusInterval,
+		UnhealthyThreshold: defaultUnhealthyThreshold,
+		MinPeers:           mainnetMinPeers,
+		Port:               defaultPort,
+	},
+	Fuji: {
+		Network:            Fuji,
+		HealthInterval:     defaultHealthInterval,
+		StatusInterval:     defaultStatusInterval,
+		UnhealthyThreshold: defaultUnhealthyThreshold,
+		MinPeers:           fujiMinPeers,
+		Port:               defaultPort,
+	},
+	Local: {
+		Network:            Local,
+		HealthInterval:     defaultHealthInterval,
+		StatusInterval:     defaultStatusInterval,
+		UnhealthyThreshold: defaultUnhealthyThreshold,
+		MinPeers:           0,
+		Port:               defaultPort,
+	},
+}
+
+// Config configures a Monitor (and the health server it is
+// served on). Any field that is not set is populated from
+// the profile of Network.
+type Config struct {
+	// Network selects the profile to use (mainnet, fuji or
+	// local). Defaults to mainnet.
+	Network string `mapstructure:"network"`
+
+	// HealthInterval is how often each health check runs.
+	HealthInterval time.Duration `mapstructure:"healthInterval"`
+
+	// StatusInterval is how often a status notification is
+	// sent.
+	StatusInterval time.Duration `mapstructure:"statusInterval"`
+
+	// UnhealthyThreshold is how long a check can fail
+	// before the node is considered unhealthy.
+	UnhealthyThreshold time.Duration `mapstructure:"unhealthyThreshold"`
+
+	// MinPeers is the number of peers a healthy node is
+	// connected to. Because 0 is treated as unset, use the
+	// local profile to not require any peers.
+	MinPeers uint64 `mapstructure:"minPeers"`
+
+	// Port is the port the health server listens on.
+	Port uint `mapstructure:"port"`
+}
+
+// WithDefaults returns a copy of c with all unset fields
+// populated from the profile of c.Network. An error is
+// returned if the resulting Config is invalid.
+func (c *Config) WithDefaults() (*Config, error) {
+	o := Config{}
+	if c != nil {
+		o = *c
+	}
+
+	if len(o.Network) == 0 {
+		o.Network = Mainnet
+	}
+	profile, ok := Profiles[o.Network]
+	if !ok {
+		return nil, fmt.Errorf("network %s is not supported (must be %s, %s or %s)", o.Network, Mainnet, Fuji, Local)
+	}
+
+	if o.HealthInterval == 0 {
+		o.HealthInterval = profile.HealthInterval
+	}
+	if o.StatusInterval == 0 {
+		o.StatusInterval = profile.StatusInterval
+	}
+	if o.UnhealthyThreshold == 0 {
+		o.UnhealthyThreshold = profile.UnhealthyThreshold
+	}
+	if o.MinPeers == 0 {
+		o.MinPeers = profile.MinPeers
+	}
+	if o.Port == 0 {
+		o.Port = profile.Port
+	}
+
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// Validate returns an error if c is invalid.
+func (c *Config) Validate() error {
+	if c.HealthInterval <= 0 {
+		return errors.New("health interval must be positive")
+	}
+
+	if c.StatusInterval <= 0 {
+		return errors.New("status interval must be positive")
+	}
+
+	// A check only runs once per HealthInterval, so a
+	// shorter threshold would report a healthy node as
+	// unhealthy between checks.
+	if c.UnhealthyThreshold < c.HealthInterval {
+		return fmt.Errorf(
+			"unhealthy threshold (%s) must be at least the health interval (%s)",
+			c.UnhealthyThreshold,
+			c.HealthInterval,
+		)
+	}
+
+	if c.Port == 0 || c.Port > maxPort {
+		return fmt.Errorf("port must be between 1 and %d (got %d)", maxPort, c.Port)
+	}
+
+	return nil
+}
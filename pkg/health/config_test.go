@@ -0,0 +1,100 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package health
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigWithDefaults(t *testing.T) {
+	tests := map[string]struct {
+		config   *Config
+		expected *Config
+		err      string
+	}{
+		"nil": {
+			expected: Profiles[Mainnet],
+		},
+		"mainnet": {
+			config:   &Config{},
+			expected: Profiles[Mainnet],
+		},
+		"fuji overrides": {
+			config: &Config{
+				Network:  Fuji,
+				MinPeers: 5,
+				Port:     9090,
+			},
+			expected: &Config{
+				Network:            Fuji,
+				HealthInterval:     10 * time.Second,
+				StatusInterval:     time.Hour,
+				UnhealthyThreshold: time.Minute,
+				MinPeers:           5,
+				Port:               9090,
+			},
+		},
+		"local": {
+			config: &Config{Network: Local},
+			expected: &Config{
+				Network:            Local,
+				HealthInterval:     10 * time.Second,
+				StatusInterval:     time.Hour,
+				UnhealthyThreshold: time.Minute,
+				Port:               8080,
+			},
+		},
+		"unknown network": {
+			config: &Config{Network: "devnet"},
+			err:    "network devnet is not supported",
+		},
+		"negative interval": {
+			config: &Config{HealthInterval: -time.Second},
+			err:    "health interval must be positive",
+		},
+		"threshold shorter than interval": {
+			config: &Config{HealthInterval: time.Minute, UnhealthyThreshold: time.Second},
+			err:    "unhealthy threshold (1s) must be at least the health interval (1m0s)",
+		},
+		"invalid port": {
+			config: &Config{Port: 70000},
+			err:    "port must be between 1 and 65535",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config, err := test.config.WithDefaults()
+			if len(test.err) > 0 {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), test.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, config)
+		})
+	}
+
+	// Profiles are never modified
+	assert.Equal(t, uint64(400), Profiles[Mainnet].MinPeers)
+}
@@ -23,9 +23,11 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/patrick-ogrady/snowplow/pkg/client"
 	"github.com/patrick-ogrady/snowplow/pkg/utils"
 )
 
@@ -42,9 +44,16 @@ type Notifier interface {
 
 // Client ...
 type Client interface {
-	IsHealthy() (bool, error)
+	Liveness() (*client.Liveness, error)
 	IsBootstrapped(chain string) (bool, error)
 	Peers() (uint64, error)
+	NodeVersion() (string, error)
+}
+
+// Node identifies the monitored node.
+type Node struct {
+	ID              string
+	SnowplowVersion string
 }
 
 // MetricWriter ...
@@ -55,158 +64,283 @@ type MetricWriter interface {
 // Monitor tracks the health
 // of an avalanche validator.
 type Monitor struct {
+	node         *Node
 	notifier     Notifier
 	client       Client
 	metricWriter MetricWriter
 
-	healthInterval time.Duration
-	statusInterval time.Duration
-
-	unhealthyThreshold time.Duration
-	minPeers           uint64
+	config *Config
+	clock  utils.Clock
 
-	isBootstrappedMutex sync.Mutex
-	isBootstrapped      map[string]time.Time
+	// checks are only registered before MonitorHealth is
+	// called.
+	checks []Check
 
-	isHealthy time.Time
+	// snapshot is replaced (never modified) by update.
+	snapshotMutex sync.Mutex
+	snapshot      *Snapshot
 
-	peers    time.Time
-	numPeers uint64
-
-	completeHealthMutex       sync.Mutex
-	completeHealth            bool
-	completeHealthStatusSince time.Time
+	// Alerts are suppressed while the node is paused (ex: to
+	// take a snapshot) and until it is healthy again (or
+	// pausedUntil has passed).
+	pausedMutex sync.Mutex
+	paused      bool
+	resumed     time.Time
+	pausedUntil time.Time
 }
 
-// NewMonitor returns a new *Monitor.
+// NewMonitor returns a new *Monitor with the built-in checks
+// (bootstrapping of each chain, health and peers) registered.
+// config must be populated (see Config.WithDefaults) and all
+// times are read from clock (usually utils.RealClock).
 func NewMonitor(
+	node *Node,
 	notifier Notifier,
 	client Client,
 	metricWriter MetricWriter,
-	healthInterval time.Duration,
-	statusInterval time.Duration,
-	unhealthyThreshold time.Duration,
-	minPeers uint64,
+	config *Config,
+	clock utils.Clock,
 ) *Monitor {
-	return &Monitor{
-		notifier:           notifier,
-		client:             client,
-		metricWriter:       metricWriter,
-		healthInterval:     healthInterval,
-		unhealthyThreshold: unhealthyThreshold,
-		statusInterval:     statusInterval,
-		minPeers:           minPeers,
-
-		isBootstrapped: make(map[string]time.Time),
+	start := clock.Now()
+	m := &Monitor{
+		node:         node,
+		notifier:     notifier,
+		client:       client,
+		metricWriter: metricWriter,
+		config:       config,
+		clock:        clock,
+		snapshot:     &Snapshot{HealthySince: start, Evaluated: start},
+	}
+
+	for _, chain := range chains {
+		m.mustRegister(&bootstrappedCheck{m: m, chain: chain, start: start})
 	}
+	m.mustRegister(&healthyCheck{m: m})
+	m.mustRegister(&peersCheck{m: m})
+
+	return m
 }
 
-// checkBootstrapped loops on the IsBootstrapped
-// check for a particular chain.
-func (m *Monitor) checkIsBootstrapped(
-	ctx context.Context,
-	chain string,
-) {
-	start := time.Now()
-	for utils.ContextSleep(ctx, m.healthInterval) == nil {
-		bootstrapped, err := m.client.IsBootstrapped(chain)
-		if err != nil {
-			m.notifier.Alert(fmt.Sprintf("%s-Chain IsBootstrapped failed: %s", chain, err.Error()))
-			continue
-		}
+// Register adds check to the checks run by MonitorHealth.
+// Checks must be registered before MonitorHealth is called.
+func (m *Monitor) Register(check Check) error {
+	if check.Interval() <= 0 {
+		return fmt.Errorf("interval of %s must be positive", check.Name())
+	}
 
-		if !bootstrapped {
-			continue
-		}
+	if check.Threshold() < 0 {
+		return fmt.Errorf("threshold of %s cannot be negative", check.Name())
+	}
 
-		m.notifier.Info(fmt.Sprintf("%s-Chain bootstrapped after %s", chain, time.Since(start)))
-		m.isBootstrappedMutex.Lock()
-		m.isBootstrapped[chain] = time.Now()
-		m.isBootstrappedMutex.Unlock()
-		return
+	if check.Severity() != Critical && check.Severity() != Warning {
+		return fmt.Errorf("severity %s of %s is not supported", check.Severity(), check.Name())
 	}
-}
 
-// checkIsHealthy loops on the IsHealthy
-// check.
-func (m *Monitor) checkIsHealthy(
-	ctx context.Context,
-) {
-	for utils.ContextSleep(ctx, m.healthInterval) == nil {
-		isHealthy, err := m.client.IsHealthy()
-		if err != nil {
-			m.notifier.Alert(fmt.Sprintf("IsHealthy failed: %s", err.Error()))
-			continue
+	for _, c := range m.checks {
+		if c.Name() == check.Name() {
+			return fmt.Errorf("%s is already registered", check.Name())
 		}
+	}
 
-		if !isHealthy {
-			continue
-		}
+	m.checks = append(m.checks, check)
+	m.update(func(s *Snapshot) {
+		s.Checks = append(s.Checks, CheckResult{
+			Name:      check.Name(),
+			Severity:  check.Severity(),
+			Threshold: check.Threshold(),
+			Message:   check.Failure(),
+		})
+	})
+	return nil
+}
 
-		m.isHealthy = time.Now()
+// mustRegister registers a built-in check.
+func (m *Monitor) mustRegister(check Check) {
+	if err := m.Register(check); err != nil {
+		panic(err)
 	}
 }
 
-func (m *Monitor) checkPeers(
-	ctx context.Context,
-) {
-	var seenMinPeers bool
-	for utils.ContextSleep(ctx, m.healthInterval) == nil {
-		peers, err := m.client.Peers()
-		if err != nil {
-			m.notifier.Alert(fmt.Sprintf("Peers failed: %s", err.Error()))
-			continue
-		}
+// Snapshot returns the current state of the monitor.
+func (m *Monitor) Snapshot() *Snapshot {
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
 
-		if err := m.metricWriter.Peers(ctx, peers); err != nil {
-			m.notifier.Alert(fmt.Sprintf("Peers metric writing failed: %s", err.Error()))
-		}
+	return m.snapshot
+}
 
-		m.numPeers = peers
-		if m.numPeers < m.minPeers {
-			continue
-		}
+// update publishes a new snapshot modified by f (which must
+// not call update).
+func (m *Monitor) update(f func(s *Snapshot)) {
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
 
-		if !seenMinPeers {
-			seenMinPeers = true
-			m.notifier.Info(fmt.Sprintf("connected peers (%d) >= %d", m.numPeers, m.minPeers))
-		}
+	s := m.snapshot.copy()
+	f(s)
+	m.snapshot = s
+}
+
+// Pause suppresses alerts until Resume is called (ex: while
+// the node is stopped for a planned snapshot).
+func (m *Monitor) Pause(reason string) {
+	m.pausedMutex.Lock()
+	m.paused = true
+	m.pausedMutex.Unlock()
+
+	m.notifier.Info(fmt.Sprintf("pausing health alerts: %s", reason))
+}
+
+// Resume ends a pause. Alerts remain suppressed until the node
+// is healthy again or grace has passed.
+func (m *Monitor) Resume(grace time.Duration) {
+	m.pausedMutex.Lock()
+	m.paused = false
+	m.resumed = m.clock.Now()
+	m.pausedUntil = m.resumed.Add(grace)
+	m.pausedMutex.Unlock()
+
+	m.notifier.Info("resuming health alerts once healthy")
+}
+
+// isPaused returns true if alerts are suppressed.
+func (m *Monitor) isPaused() bool {
+	m.pausedMutex.Lock()
+	defer m.pausedMutex.Unlock()
+
+	return m.paused || m.clock.Now().Before(m.pausedUntil)
+}
+
+// endPause stops suppressing alerts once the node has been
+// healthy (at lastHealthy) since the end of a pause.
+func (m *Monitor) endPause(lastHealthy time.Time) {
+	m.pausedMutex.Lock()
+	defer m.pausedMutex.Unlock()
 
-		m.peers = time.Now()
+	if !m.paused && lastHealthy.After(m.resumed) {
+		m.pausedUntil = time.Time{}
 	}
 }
 
-func (m *Monitor) computeHealth() string {
-	m.isBootstrappedMutex.Lock()
-	defer m.isBootstrappedMutex.Unlock()
-	for _, chain := range chains {
-		if _, ok := m.isBootstrapped[chain]; !ok {
-			return fmt.Sprintf("%s-Chain isBootstrapped=false", chain)
-		}
+// alert sends message unless alerts are suppressed.
+func (m *Monitor) alert(message string) {
+	if m.isPaused() {
+		return
 	}
 
-	if time.Since(m.isHealthy) > m.unhealthyThreshold {
-		return fmt.Sprintf("isHealthy=false for %s", time.Since(m.isHealthy))
+	m.notifier.Alert(message)
+}
+
+// runCheck runs the ith check every interval until ctx is
+// done.
+func (m *Monitor) runCheck(ctx context.Context, i int) {
+	for utils.ContextSleep(ctx, m.clock, m.checks[i].Interval()) == nil {
+		m.check(ctx, i)
+	}
+}
+
+// check runs the ith check once and records the result.
+func (m *Monitor) check(ctx context.Context, i int) {
+	check := m.checks[i]
+	passed, err := check.Run(ctx)
+
+	// A check that could not be run (ex: the node is
+	// unreachable) is failing (with the error as its
+	// message).
+	message := check.Failure()
+	if err != nil {
+		message = fmt.Sprintf("%s failed: %s", check.Name(), err.Error())
+		m.alert(message)
 	}
 
-	if time.Since(m.peers) > m.unhealthyThreshold {
-		return fmt.Sprintf("peers < %d for %s", m.minPeers, time.Since(m.peers))
+	now := m.clock.Now()
+	m.update(func(s *Snapshot) {
+		r := &s.Checks[i]
+		r.Message = message
+		r.Passing = passed
+		if !passed {
+			return
+		}
+
+		if r.FirstPassed.IsZero() {
+			r.FirstPassed = now
+		}
+		r.LastPassed = now
+	})
+}
+
+// unhealthyStatus describes the failing critical checks in
+// failures (or returns an empty string if there are none).
+func unhealthyStatus(failures []*Failure) string {
+	messages := []string{}
+	for _, f := range failures {
+		if f.Severity == Critical {
+			messages = append(messages, f.Message)
+		}
 	}
 
-	return ""
+	return strings.Join(messages, ", ")
+}
+
+// sendStatus sends the current status of the node.
+func (m *Monitor) sendStatus() {
+	s := m.Snapshot()
+	m.notifier.Status(fmt.Sprintf(
+		"healthy(%s): %t peers: %d",
+		m.clock.Now().Sub(s.HealthySince),
+		s.Healthy,
+		s.Peers,
+	))
 }
 
 func (m *Monitor) monitorStatus(ctx context.Context) {
-	for utils.ContextSleep(ctx, m.statusInterval) == nil {
-		m.completeHealthMutex.Lock()
-		m.notifier.Status(fmt.Sprintf(
-			"healthy(%s): %t peers: %d",
-			time.Since(m.completeHealthStatusSince),
-			m.completeHealth,
-			m.numPeers,
-		))
-		m.completeHealthMutex.Unlock()
+	for utils.ContextSleep(ctx, m.clock, m.config.StatusInterval) == nil {
+		m.sendStatus()
+	}
+}
+
+// evaluate computes the health of the node and notifies
+// any transition.
+func (m *Monitor) evaluate() {
+	now := m.clock.Now()
+	snapshot := m.Snapshot()
+	unhealthyStatus := unhealthyStatus(snapshot.Failures(now))
+	healthy := len(unhealthyStatus) == 0
+
+	// Health transitions are ignored while paused (so the
+	// node is considered as healthy as it was before the
+	// pause until the pause ends).
+	if healthy {
+		m.endPause(snapshot.LastHealthy())
+	}
+	if m.isPaused() || snapshot.Healthy == healthy {
+		m.update(func(s *Snapshot) {
+			s.Evaluated = now
+		})
+		return
+	}
+
+	// The version of avalanchego is only read when the node
+	// becomes healthy (it can only change when avalanchego
+	// is restarted).
+	nodeVersion := snapshot.NodeVersion
+	if healthy {
+		m.notifier.Info(fmt.Sprintf("healthy after %s", now.Sub(snapshot.HealthySince)))
+
+		version, err := m.client.NodeVersion()
+		if err != nil {
+			m.alert(fmt.Sprintf("NodeVersion failed: %s", err.Error()))
+		} else {
+			nodeVersion = version
+		}
+	} else {
+		m.notifier.Alert(fmt.Sprintf("not healthy: %s", unhealthyStatus))
 	}
+	m.update(func(s *Snapshot) {
+		s.Healthy = healthy
+		s.HealthySince = now
+		s.Evaluated = now
+		s.NodeVersion = nodeVersion
+	})
 }
 
 // MonitorHealth checks a validator's health
@@ -216,48 +350,47 @@ func (m *Monitor) MonitorHealth(
 ) {
 	go m.monitorStatus(ctx)
 
-	for _, chain := range chains {
-		go m.checkIsBootstrapped(ctx, chain)
+	for i := range m.checks {
+		go m.runCheck(ctx, i)
 	}
-	go m.checkIsHealthy(ctx)
-	go m.checkPeers(ctx)
-
-	m.completeHealthStatusSince = time.Now()
-	for utils.ContextSleep(ctx, m.healthInterval) == nil {
-		unhealthyStatus := m.computeHealth()
 
-		if (m.completeHealth && len(unhealthyStatus) == 0) || (!m.completeHealth && len(unhealthyStatus) > 0) {
-			continue
-		}
-
-		if m.completeHealth && len(unhealthyStatus) > 0 {
-			m.notifier.Alert(fmt.Sprintf("not healthy: %s", unhealthyStatus))
-			m.completeHealthMutex.Lock()
-			m.completeHealth = false
-			m.completeHealthStatusSince = time.Now()
-			m.completeHealthMutex.Unlock()
-			continue
-		}
-
-		if !m.completeHealth && len(unhealthyStatus) == 0 {
-			m.notifier.Info(fmt.Sprintf("healthy after %s", time.Since(m.completeHealthStatusSince)))
-			m.completeHealthMutex.Lock()
-			m.completeHealth = true
-			m.completeHealthStatusSince = time.Now()
-			m.completeHealthMutex.Unlock()
-		}
+	for utils.ContextSleep(ctx, m.clock, m.config.HealthInterval) == nil {
+		m.evaluate()
 	}
 }
 
-// ServeHTTP serves a health check response on all paths.
+// ServeHTTP serves the state of the monitor as JSON on
+// statusPath, liveness on livezPath, readiness on readyzPath
+// and the health of the node on every other path.
 func (m *Monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	unhealthyStatus := m.computeHealth()
-	if len(unhealthyStatus) > 0 {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		_, _ = w.Write([]byte(unhealthyStatus))
-		return
+	switch r.URL.Path {
+	case statusPath:
+		m.serveStatus(w)
+	case livezPath:
+		m.serveLivez(w)
+	case readyzPath:
+		m.serveReadyz(w)
+	default:
+		m.serveHealth(w)
+	}
+}
+
+// serveHealth lists every failing check (one per line). The
+// status is 503 if any of them is critical.
+func (m *Monitor) serveHealth(w http.ResponseWriter) {
+	failures := m.Snapshot().Failures(m.clock.Now())
+
+	status := http.StatusOK
+	lines := []string{}
+	if len(unhealthyStatus(failures)) > 0 {
+		status = http.StatusServiceUnavailable
+	} else {
+		lines = append(lines, "healthy")
+	}
+	for _, f := range failures {
+		lines = append(lines, fmt.Sprintf("%s (%s): %s", f.Name, f.Severity, f.Message))
 	}
 
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte("healthy"))
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(strings.Join(lines, "\n")))
 }
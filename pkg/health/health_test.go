@@ -16,14 +16,13 @@
 // COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
 // IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
 // CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
-
 package health
 
 import (
 	"context"
 	"errors"
-	"fmt"
-	"strings"
+	"net/http"
+	"sync"
 	"testing"
 	"time"
 
@@ -31,69 +30,57 @@ import (
 	"github.com/stretchr/testify/mock"
 
 	mocks "github.com/patrick-ogrady/snowplow/mocks/pkg/health"
+	"github.com/patrick-ogrady/snowplow/pkg/client"
+	"github.com/patrick-ogrady/snowplow/pkg/utils"
 )
 
-func handleIsBootstrappedChecks(t *testing.T, n *mocks.Notifier, c *mocks.Client, chain string) {
-	c.On("IsBootstrapped", chain).Return(false, nil).Once()
-	c.On("IsBootstrapped", chain).Return(false, errors.New("bad")).Once()
-	n.On("Alert", fmt.Sprintf("%s-Chain IsBootstrapped failed: bad", chain)).Once()
-	c.On("IsBootstrapped", chain).Return(true, nil).Once()
-	n.On("Info", mock.Anything).Run(
-		func(args mock.Arguments) {
-			// We cannot check explicit chains here because we use
-			// mock.Anything as the argument.
-			assert.Contains(t, args[0], "-Chain bootstrapped after")
-		},
-	).Once()
-}
+const testInterval = 10 * time.Second
 
-func handleIsHealthyChecks(n *mocks.Notifier, c *mocks.Client) {
-	c.On("IsHealthy").Return(false, nil).Once()
-	c.On("IsHealthy").Return(true, nil).Once()
-	c.On("IsHealthy").Return(false, errors.New("unable to complete health check")).Once()
-	n.On("Alert", "IsHealthy failed: unable to complete health check").Once()
-	c.On("IsHealthy").Return(true, nil).Once()
-	// should not send a healthy recovery because of threshold
-	c.On("IsHealthy").Return(true, nil).Once()
-	c.On("IsHealthy").Return(false, nil).Once()
-	c.On("IsHealthy").Return(false, nil).Once()
-	c.On("IsHealthy").Return(false, nil).Once()
+var testNode = &Node{
+	ID:              "NodeID-test",
+	SnowplowVersion: "v0.0.0",
 }
 
-func handlePeers(n *mocks.Notifier, c *mocks.Client, mw *mocks.MetricWriter) {
-	c.On("Peers").Return(uint64(0), nil).Once()
-	mw.On("Peers", mock.Anything, uint64(0)).Return(nil).Once()
-	c.On("Peers").Return(uint64(2), nil).Once()
-	mw.On("Peers", mock.Anything, uint64(2)).Return(nil).Once()
-	c.On("Peers").Return(uint64(3), nil).Once()
-	mw.On("Peers", mock.Anything, uint64(3)).Return(nil).Once()
-	c.On("Peers").Return(uint64(4), nil).Once()
-	mw.On("Peers", mock.Anything, uint64(4)).Return(nil).Once()
-	c.On("Peers").Return(uint64(5), nil).Once()
-	mw.On("Peers", mock.Anything, uint64(5)).Return(nil).Once()
-	n.On("Info", "connected peers (5) >= 5").Once()
-	c.On("Peers").Return(uint64(5), nil).Once()
-	mw.On("Peers", mock.Anything, uint64(5)).Return(nil).Once()
-	c.On("Peers").Return(uint64(5), nil).Once()
-	mw.On("Peers", mock.Anything, uint64(5)).Return(nil).Once()
-	c.On("Peers").Return(uint64(5), nil).Once()
-	mw.On("Peers", mock.Anything, uint64(5)).Return(nil).Once()
+func testConfig() *Config {
+	return &Config{
+		HealthInterval:     testInterval,
+		StatusInterval:     time.Hour,
+		UnhealthyThreshold: 3 * testInterval,
+		MinPeers:           5,
+	}
 }
 
-func handleStatus(ctx context.Context, t *testing.T, n *mocks.Notifier) {
-	var seenTrue bool
-	n.On("Status", mock.Anything).Run(
-		func(args mock.Arguments) {
-			if strings.Contains(args[0].(string), "true") {
-				seenTrue = true
-			}
+// testLiveness returns the health checks of a node with
+// failing subsystems.
+func testLiveness(healthy bool, failing ...string) *client.Liveness {
+	reply := &client.GetLivenessReply{
+		Healthy: healthy,
+		Checks: map[string]*client.CheckResult{
+			client.NetworkCheck:      {},
+			client.RouterCheck:       {},
+			client.BootstrappedCheck: {},
+			"C":                      {},
 		},
-	)
+	}
+	for i, name := range failing {
+		reply.Checks[name] = &client.CheckResult{
+			Error:              &client.CheckError{Message: name + " is broken"},
+			ContiguousFailures: int64(i + 1),
+		}
+	}
 
-	go func() {
-		<-ctx.Done()
-		assert.True(t, seenTrue)
-	}()
+	return client.NewLiveness(reply)
+}
+
+// step advances clock by testInterval, runs every check once
+// and then evaluates the health of the node (as MonitorHealth
+// would, but in a deterministic order).
+func step(ctx context.Context, m *Monitor, clock *utils.FakeClock) {
+	clock.Advance(testInterval)
+	for i := range m.checks {
+		m.check(ctx, i)
+	}
+	m.evaluate()
 }
 
 func TestMonitorHealth(t *testing.T) {
@@ -101,34 +88,282 @@ func TestMonitorHealth(t *testing.T) {
 	client := &mocks.Client{}
 	metricWriter := &mocks.MetricWriter{}
 	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	m := NewMonitor(testNode, notifier, client, metricWriter, testConfig(), clock)
+
+	expectPeers := func(peers uint64) {
+		client.On("Peers").Return(peers, nil).Once()
+		metricWriter.On("Peers", ctx, peers).Return(nil).Once()
+	}
 
+	// Nothing has passed yet (the node starts unhealthy, so
+	// no alert is sent)
 	for _, chain := range chains {
-		handleIsBootstrappedChecks(t, notifier, client, chain)
+		client.On("IsBootstrapped", chain).Return(false, nil).Once()
 	}
-	handlePeers(notifier, client, metricWriter)
-	handleIsHealthyChecks(notifier, client)
-	handleStatus(ctx, t, notifier)
+	client.On("Liveness").Return(testLiveness(false), nil).Once()
+	expectPeers(0)
+	step(ctx, m, clock)
+	w := get(m, "/")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(
+		t,
+		"X-Chain IsBootstrapped (critical): X-Chain isBootstrapped=false\n"+
+			"C-Chain IsBootstrapped (critical): C-Chain isBootstrapped=false\n"+
+			"P-Chain IsBootstrapped (critical): P-Chain isBootstrapped=false\n"+
+			"IsHealthy (critical): isHealthy=false\n"+
+			"Peers (critical): peers < 5",
+		w.Body.String(),
+	)
 
-	notifier.On("Info", mock.Anything).Run(
-		func(args mock.Arguments) {
-			assert.Contains(t, args[0], "healthy after")
-		},
-	).Once()
+	// Errors are alerted immediately
+	client.On("IsBootstrapped", "X").Return(false, errors.New("bad")).Once()
+	notifier.On("Alert", "X-Chain IsBootstrapped failed: bad").Once()
+	client.On("IsBootstrapped", "C").Return(true, nil).Once()
+	notifier.On("Info", "C-Chain bootstrapped after 20s").Once()
+	client.On("IsBootstrapped", "P").Return(true, nil).Once()
+	notifier.On("Info", "P-Chain bootstrapped after 20s").Once()
+	client.On("Liveness").Return(testLiveness(true), nil).Once()
+	expectPeers(5)
+	notifier.On("Info", "connected peers (5) >= 5").Once()
+	step(ctx, m, clock)
+	assert.False(t, m.Snapshot().Healthy)
 
-	notifier.On("Alert", mock.Anything).Run(
-		func(args mock.Arguments) {
-			assert.Contains(t, args[0], "not healthy: isHealthy=false for")
-			time.Sleep(10 * time.Millisecond)
-			cancel()
-		},
-	).Once()
+	// Healthy once every chain is bootstrapped (bootstrapped
+	// chains are not checked again)
+	client.On("IsBootstrapped", "X").Return(true, nil).Once()
+	notifier.On("Info", "X-Chain bootstrapped after 30s").Once()
+	client.On("Liveness").Return(testLiveness(true), nil).Once()
+	expectPeers(5)
+	notifier.On("Info", "healthy after 30s").Once()
+	client.On("NodeVersion").Return("avalanche/1.4.0", nil).Once()
+	step(ctx, m, clock)
+	assert.True(t, m.Snapshot().Healthy)
+	w = get(m, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "healthy", w.Body.String())
+
+	// Failing checks are tolerated for UnhealthyThreshold
+	for i := 0; i < 3; i++ {
+		client.On("Liveness").Return(testLiveness(false, "network", "C"), nil).Once()
+		expectPeers(5)
+		step(ctx, m, clock)
+		assert.True(t, m.Snapshot().Healthy)
+	}
+
+	client.On("Liveness").Return(testLiveness(false, "network", "C"), nil).Once()
+	expectPeers(5)
+	notifier.On("Alert", "not healthy: isHealthy=false: network (network is broken, 1 contiguous failures), C (C is broken, 2 contiguous failures) for 40s").Once()
+	step(ctx, m, clock)
+	assert.False(t, m.Snapshot().Healthy)
+
+	notifier.On("Status", "healthy(0s): false peers: 5").Once()
+	m.sendStatus()
+
+	// Metric errors are alerted but don't fail the check
+	client.On("Liveness").Return(testLiveness(true), nil).Once()
+	client.On("Peers").Return(uint64(4), nil).Once()
+	metricWriter.On("Peers", ctx, uint64(4)).Return(errors.New("bad")).Once()
+	notifier.On("Alert", "Peers metric writing failed: bad").Once()
+	notifier.On("Info", "healthy after 10s").Once()
+	client.On("NodeVersion").Return("", errors.New("bad")).Once()
+	notifier.On("Alert", "NodeVersion failed: bad").Once()
+	step(ctx, m, clock)
+	assert.True(t, m.Snapshot().Healthy)
+
+	clock.Advance(time.Minute)
+	notifier.On("Status", "healthy(1m0s): true peers: 4").Once()
+	m.sendStatus()
 
-	m := NewMonitor(notifier, client, metricWriter, 100*time.Millisecond, 150*time.Millisecond, 300*time.Millisecond, 5)
-	m.MonitorHealth(ctx)
+	// Checks that can't be run (ex: avalanchego crashed) are
+	// failing once they haven't passed for UnhealthyThreshold
+	client.On("Liveness").Return(testLiveness(true), nil).Once()
+	expectPeers(5)
+	step(ctx, m, clock)
+
+	unreachable := errors.New("connection refused")
+	for i := 0; i < 4; i++ {
+		client.On("Liveness").Return(nil, unreachable).Once()
+		notifier.On("Alert", "IsHealthy failed: connection refused").Once()
+		client.On("Peers").Return(uint64(0), unreachable).Once()
+		notifier.On("Alert", "Peers failed: connection refused").Once()
+		if i == 3 {
+			notifier.On(
+				"Alert",
+				"not healthy: IsHealthy failed: connection refused for 40s, Peers failed: connection refused for 40s",
+			).Once()
+		}
+		step(ctx, m, clock)
+		assert.Equal(t, i < 3, m.Snapshot().Healthy)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, get(m, "/").Code)
 
-	time.Sleep(5 * time.Second)
 	client.AssertExpectations(t)
 	notifier.AssertExpectations(t)
 	metricWriter.AssertExpectations(t)
 }
+
+func TestPause(t *testing.T) {
+	notifier := &mocks.Notifier{}
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	m := NewMonitor(testNode, notifier, nil, nil, testConfig(), clock)
+
+	notifier.On("Alert", "before").Once()
+	m.alert("before")
+
+	// Alerts are suppressed while paused
+	notifier.On("Info", "pausing health alerts: snapshot").Once()
+	m.Pause("snapshot")
+	m.alert("paused")
+	assert.True(t, m.isPaused())
+
+	// Alerts remain suppressed after resuming until the
+	// node is healthy again
+	notifier.On("Info", "resuming health alerts once healthy").Once()
+	m.Resume(time.Hour)
+	m.alert("resumed")
+	m.endPause(clock.Now().Add(-time.Second))
+	assert.True(t, m.isPaused())
+
+	m.endPause(clock.Now().Add(time.Second))
+	assert.False(t, m.isPaused())
+	notifier.On("Alert", "healthy").Once()
+	m.alert("healthy")
+
+	// Alerts are sent once the grace period has passed
+	notifier.On("Info", "pausing health alerts: snapshot").Once()
+	m.Pause("snapshot")
+	notifier.On("Info", "resuming health alerts once healthy").Once()
+	m.Resume(time.Minute)
+	assert.True(t, m.isPaused())
+	clock.Advance(time.Minute + time.Second)
+	assert.False(t, m.isPaused())
+
+	notifier.AssertExpectations(t)
+}
+
+type testCheck struct {
+	name      string
+	interval  time.Duration
+	threshold time.Duration
+	severity  Severity
+}
+
+func (c *testCheck) Name() string {
+	return c.name
+}
+
+func (c *testCheck) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *testCheck) Threshold() time.Duration {
+	return c.threshold
+}
+
+func (c *testCheck) Severity() Severity {
+	return c.severity
+}
+
+func (c *testCheck) Failure() string {
+	return c.name + "=false"
+}
+
+func (c *testCheck) Run(ctx context.Context) (bool, error) {
+	return false, nil
+}
+
+func TestRegister(t *testing.T) {
+	m := NewMonitor(testNode, nil, nil, nil, testConfig(), utils.NewFakeClock(time.Unix(0, 0)))
+
+	assert.Error(t, m.Register(&testCheck{name: "IsHealthy", interval: time.Second, severity: Critical}))
+	assert.Error(t, m.Register(&testCheck{name: "disk", severity: Critical}))
+	assert.Error(t, m.Register(&testCheck{name: "disk", interval: time.Second, severity: "fatal"}))
+	assert.NoError(t, m.Register(&testCheck{name: "disk", interval: time.Second, severity: Warning}))
+	assert.Error(t, m.Register(&testCheck{name: "disk", interval: time.Second, severity: Warning}))
+
+	// Pass every built-in check so only the warning is
+	// failing
+	m.update(func(s *Snapshot) {
+		for i := range s.Checks {
+			if s.Checks[i].Severity == Critical {
+				s.Checks[i].Passing = true
+			}
+		}
+	})
+	failures := m.Snapshot().Failures(time.Unix(0, 0))
+	assert.Len(t, failures, 1)
+	assert.Equal(t, &Failure{Name: "disk", Severity: Warning, Message: "disk=false"}, failures[0])
+
+	w := get(m, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "healthy\ndisk (warning): disk=false", w.Body.String())
+
+	// Every failing check is listed once a critical check
+	// fails
+	assert.NoError(t, m.Register(&testCheck{name: "db", interval: time.Second, severity: Critical}))
+	assert.Equal(t, "db=false", unhealthyStatus(m.Snapshot().Failures(time.Unix(0, 0))))
+
+	w = get(m, "/")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "disk (warning): disk=false\ndb (critical): db=false", w.Body.String())
+}
+
+func TestServeHTTPRace(t *testing.T) {
+	notifier := &mocks.Notifier{}
+	client := &mocks.Client{}
+	metricWriter := &mocks.MetricWriter{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	notifier.On("Alert", mock.Anything).Maybe()
+	notifier.On("Info", mock.Anything).Maybe()
+	notifier.On("Status", mock.Anything).Maybe()
+	client.On("IsBootstrapped", mock.Anything).Return(true, nil)
+	client.On("Liveness").Return(testLiveness(true), nil)
+	client.On("Peers").Return(uint64(5), nil)
+	client.On("NodeVersion").Return("avalanche/1.4.0", nil)
+	metricWriter.On("Peers", mock.Anything, uint64(5)).Return(nil)
+
+	config := testConfig()
+	config.StatusInterval = testInterval
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	m := NewMonitor(testNode, notifier, client, metricWriter, config, clock)
+
+	// Every check, the status notifier and the health loop
+	// sleep on the clock
+	sleepers := len(m.checks) + 2 // nolint:gomnd
+	done := make(chan struct{})
+	go func() {
+		m.MonitorHealth(ctx)
+		close(done)
+	}()
+
+	// Hammer the handler while the checks update the
+	// snapshot (run with -race)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				w := get(m, "/")
+				assert.Contains(t, []int{http.StatusOK, http.StatusServiceUnavailable}, w.Code)
+				_ = m.Snapshot().Failures(clock.Now())
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		clock.BlockUntil(sleepers)
+		clock.Advance(testInterval)
+	}
+	clock.BlockUntil(sleepers)
+
+	s := m.Snapshot()
+	assert.True(t, s.Healthy)
+	assert.Equal(t, uint64(5), s.Peers)
+
+	cancel()
+	wg.Wait()
+	<-done
+}
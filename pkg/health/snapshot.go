@@ -0,0 +1,145 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package health
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/patrick-ogrady/snowplow/pkg/client"
+)
+
+// CheckResult is the last result of a registered Check.
+type CheckResult struct {
+	Name      string
+	Severity  Severity
+	Threshold time.Duration
+
+	// Message describes the check while it is failing (see
+	// Check.Failure).
+	Message string
+
+	// Passing is true if the last run of the check passed.
+	Passing bool
+
+	// FirstPassed and LastPassed are when the check first
+	// and last passed (or the zero time if it never has).
+	FirstPassed time.Time
+	LastPassed  time.Time
+}
+
+// Snapshot is the state of a Monitor at a point in time.
+// Snapshots are never modified once they are published, so
+// they can be read without synchronization.
+type Snapshot struct {
+	// Checks are the results of every registered Check (in
+	// the order they were registered).
+	Checks []CheckResult
+
+	// Peers is the number of peers the node was last
+	// connected to.
+	Peers uint64
+
+	// Healthy is true if the node was healthy at the last
+	// health interval, and HealthySince is when it became
+	// Healthy (or unhealthy).
+	Healthy      bool
+	HealthySince time.Time
+
+	// Evaluated is when the health of the node was last
+	// evaluated.
+	Evaluated time.Time
+
+	// NodeVersion is the version of avalanchego when the node
+	// last became healthy.
+	NodeVersion string
+
+	// Subsystems are the health checks of avalanchego (ex:
+	// network) when the node was last checked.
+	Subsystems []*client.Subsystem
+}
+
+// copy returns a copy of s that can be modified.
+func (s *Snapshot) copy() *Snapshot {
+	c := *s
+	c.Checks = append([]CheckResult{}, s.Checks...)
+	return &c
+}
+
+// result returns the result of the check called name (or nil
+// if it is not registered).
+func (s *Snapshot) result(name string) *CheckResult {
+	for i := range s.Checks {
+		if s.Checks[i].Name == name {
+			return &s.Checks[i]
+		}
+	}
+
+	return nil
+}
+
+// Failures returns every check failing at now (in the order
+// they were registered). A check is failing if its last run
+// did not pass and it has not passed for longer than its
+// threshold.
+func (s *Snapshot) Failures(now time.Time) []*Failure {
+	failures := []*Failure{}
+	for _, r := range s.Checks {
+		since := now.Sub(r.LastPassed)
+		if r.Passing || since <= r.Threshold {
+			continue
+		}
+
+		// Checks that never passed have been failing since
+		// the monitor started (so no duration is included).
+		message := r.Message
+		if r.Threshold > 0 && !r.LastPassed.IsZero() {
+			message = fmt.Sprintf("%s for %s", message, since)
+		}
+
+		failures = append(failures, &Failure{
+			Name:     r.Name,
+			Severity: r.Severity,
+			Message:  message,
+		})
+	}
+
+	return failures
+}
+
+// LastHealthy returns the last time at which every critical
+// check had passed.
+func (s *Snapshot) LastHealthy() time.Time {
+	var (
+		last  time.Time
+		found bool
+	)
+	for _, r := range s.Checks {
+		if r.Severity != Critical {
+			continue
+		}
+
+		if !found || r.LastPassed.Before(last) {
+			last = r.LastPassed
+			found = true
+		}
+	}
+
+	return last
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/patrick-ogrady/snowplow/pkg/client"
+)
+
+const (
+	// statusPath serves the state of the monitor as JSON.
+	statusPath = "/status"
+
+	// livezPath serves whether the monitor is running.
+	livezPath = "/livez"
+
+	// readyzPath serves whether the node is bootstrapped and
+	// healthy.
+	readyzPath = "/readyz"
+
+	// livenessIntervals is the number of health intervals
+	// the monitor can go without evaluating the health of
+	// the node before it is no longer live.
+	livenessIntervals = 3
+)
+
+// Status is the state of the monitor served on statusPath.
+type Status struct {
+	NodeID   string    `json:"nodeID"`
+	Versions *Versions `json:"versions"`
+
+	// Healthy is true if the node is healthy and
+	// StreakSeconds is how long it has been Healthy (or
+	// not).
+	Healthy       bool      `json:"healthy"`
+	HealthySince  time.Time `json:"healthySince"`
+	StreakSeconds float64   `json:"streakSeconds"`
+
+	// LastHealthy is the last time at which every critical
+	// check had passed.
+	LastHealthy *time.Time `json:"lastHealthy,omitempty"`
+
+	Peers    uint64 `json:"peers"`
+	MinPeers uint64 `json:"minPeers"`
+
+	Chains map[string]*ChainStatus `json:"chains"`
+	Checks []*CheckStatus          `json:"checks"`
+
+	// Subsystems are the health checks of avalanchego (ex:
+	// network) when the node was last checked.
+	Subsystems []*client.Subsystem `json:"subsystems,omitempty"`
+}
+
+// Versions are the versions of snowplow and avalanchego
+// (which is only known once the node has been healthy).
+type Versions struct {
+	Snowplow    string `json:"snowplow"`
+	Avalanchego string `json:"avalanchego,omitempty"`
+}
+
+// ChainStatus describes the bootstrapping of a chain.
+type ChainStatus struct {
+	Bootstrapped   bool       `json:"bootstrapped"`
+	BootstrappedAt *time.Time `json:"bootstrappedAt,omitempty"`
+}
+
+// CheckStatus describes a registered Check.
+type CheckStatus struct {
+	Name       string     `json:"name"`
+	Severity   Severity   `json:"severity"`
+	Passing    bool       `json:"passing"`
+	Failing    bool       `json:"failing"`
+	LastPassed *time.Time `json:"lastPassed,omitempty"`
+
+	// Message is only populated while the check is failing.
+	Message string `json:"message,omitempty"`
+}
+
+// timestamp returns t in UTC (or nil if t is the zero time).
+func timestamp(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	t = t.UTC()
+	return &t
+}
+
+// status returns the Status of the monitor at now.
+func (m *Monitor) status(now time.Time) *Status {
+	snapshot := m.Snapshot()
+	status := &Status{
+		NodeID: m.node.ID,
+		Versions: &Versions{
+			Snowplow:    m.node.SnowplowVersion,
+			Avalanchego: snapshot.NodeVersion,
+		},
+		Healthy:       snapshot.Healthy,
+		HealthySince:  snapshot.HealthySince.UTC(),
+		StreakSeconds: now.Sub(snapshot.HealthySince).Seconds(),
+		LastHealthy:   timestamp(snapshot.LastHealthy()),
+		Peers:         snapshot.Peers,
+		MinPeers:      m.config.MinPeers,
+		Chains:        map[string]*ChainStatus{},
+		Checks:        []*CheckStatus{},
+		Subsystems:    snapshot.Subsystems,
+	}
+
+	for _, chain := range chains {
+		chainStatus := &ChainStatus{}
+		if r := snapshot.result(bootstrappedCheckName(chain)); r != nil {
+			chainStatus.Bootstrapped = !r.FirstPassed.IsZero()
+			chainStatus.BootstrappedAt = timestamp(r.FirstPassed)
+		}
+		status.Chains[chain] = chainStatus
+	}
+
+	failures := map[string]*Failure{}
+	for _, f := range snapshot.Failures(now) {
+		failures[f.Name] = f
+	}
+	for _, r := range snapshot.Checks {
+		checkStatus := &CheckStatus{
+			Name:       r.Name,
+			Severity:   r.Severity,
+			Passing:    r.Passing,
+			LastPassed: timestamp(r.LastPassed),
+		}
+		if f, ok := failures[r.Name]; ok {
+			checkStatus.Failing = true
+			checkStatus.Message = f.Message
+		}
+		status.Checks = append(status.Checks, checkStatus)
+	}
+
+	return status
+}
+
+// serveStatus serves the Status of the monitor as JSON.
+func (m *Monitor) serveStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(m.status(m.clock.Now()))
+}
+
+// serveLivez returns a 503 if the monitor has stopped
+// evaluating the health of the node (it does not depend on
+// the health of the node).
+func (m *Monitor) serveLivez(w http.ResponseWriter) {
+	since := m.clock.Now().Sub(m.Snapshot().Evaluated)
+	if since > livenessIntervals*m.config.HealthInterval {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(fmt.Sprintf("health not evaluated for %s", since)))
+		return
+	}
+
+	_, _ = w.Write([]byte("ok"))
+}
+
+// serveReadyz returns a 503 unless every chain is
+// bootstrapped, no critical check is failing and alerts are
+// not paused (ex: while the node is restarted to take a
+// snapshot and until it is healthy again or the grace period
+// has passed). The reasons the node is not ready are listed.
+func (m *Monitor) serveReadyz(w http.ResponseWriter) {
+	snapshot := m.Snapshot()
+
+	reasons := []string{}
+	if m.isPaused() {
+		reasons = append(reasons, "paused")
+	}
+
+	failing := map[string]bool{}
+	for _, f := range snapshot.Failures(m.clock.Now()) {
+		if f.Severity == Critical {
+			failing[f.Name] = true
+			reasons = append(reasons, f.Message)
+		}
+	}
+
+	// Chains are only ready once their last check passed
+	// (even if they are not failing yet)
+	for _, chain := range chains {
+		name := bootstrappedCheckName(chain)
+		if r := snapshot.result(name); !failing[name] && (r == nil || !r.Passing) {
+			reasons = append(reasons, fmt.Sprintf("%s-Chain isBootstrapped=false", chain))
+		}
+	}
+
+	if len(reasons) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(fmt.Sprintf("not ready: %s", strings.Join(reasons, ", "))))
+		return
+	}
+
+	_, _ = w.Write([]byte("ready"))
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	mocks "github.com/patrick-ogrady/snowplow/mocks/pkg/health"
+	"github.com/patrick-ogrady/snowplow/pkg/utils"
+)
+
+func get(m *Monitor, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestStatusEndpoints(t *testing.T) {
+	notifier := &mocks.Notifier{}
+	client := &mocks.Client{}
+	metricWriter := &mocks.MetricWriter{}
+	ctx := context.Background()
+	start := time.Unix(0, 0).UTC()
+	clock := utils.NewFakeClock(start)
+	m := NewMonitor(testNode, notifier, client, metricWriter, testConfig(), clock)
+
+	notifier.On("Info", mock.Anything)
+	client.On("Liveness").Return(testLiveness(true), nil)
+	client.On("Peers").Return(uint64(7), nil)
+	metricWriter.On("Peers", ctx, uint64(7)).Return(nil)
+	client.On("NodeVersion").Return("avalanche/1.4.0", nil)
+
+	// Only the X-Chain is bootstrapped
+	client.On("IsBootstrapped", "X").Return(true, nil).Once()
+	client.On("IsBootstrapped", "C").Return(false, nil).Once()
+	client.On("IsBootstrapped", "P").Return(false, nil).Once()
+	step(ctx, m, clock)
+
+	assert.Equal(t, http.StatusOK, get(m, livezPath).Code)
+	w := get(m, readyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "not ready: C-Chain isBootstrapped=false, P-Chain isBootstrapped=false", w.Body.String())
+
+	status := &Status{}
+	w = get(m, statusPath)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), status))
+	assert.False(t, status.Healthy)
+	assert.Nil(t, status.LastHealthy)
+	assert.Equal(t, "", status.Versions.Avalanchego)
+	assert.True(t, status.Chains["X"].Bootstrapped)
+	assert.Equal(t, start.Add(testInterval), *status.Chains["X"].BootstrappedAt)
+	assert.False(t, status.Chains["C"].Bootstrapped)
+	assert.Nil(t, status.Chains["C"].BootstrappedAt)
+	assert.Equal(t, &CheckStatus{
+		Name:     "C-Chain IsBootstrapped",
+		Severity: Critical,
+		Failing:  true,
+		Message:  "C-Chain isBootstrapped=false",
+	}, status.Checks[1])
+
+	// Every chain is bootstrapped
+	client.On("IsBootstrapped", "C").Return(true, nil).Once()
+	client.On("IsBootstrapped", "P").Return(true, nil).Once()
+	step(ctx, m, clock)
+	clock.Advance(time.Minute)
+
+	w = get(m, readyzPath)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ready", w.Body.String())
+
+	status = &Status{}
+	assert.NoError(t, json.Unmarshal(get(m, statusPath).Body.Bytes(), status))
+	healthy := start.Add(2 * testInterval)
+	assert.Equal(t, &Status{
+		NodeID: "NodeID-test",
+		Versions: &Versions{
+			Snowplow:    "v0.0.0",
+			Avalanchego: "avalanche/1.4.0",
+		},
+		Healthy:       true,
+		HealthySince:  healthy,
+		StreakSeconds: 60,
+		LastHealthy:   &healthy,
+		Peers:         7,
+		MinPeers:      5,
+		Chains: map[string]*ChainStatus{
+			"X": {Bootstrapped: true, BootstrappedAt: timestamp(start.Add(testInterval))},
+			"C": {Bootstrapped: true, BootstrappedAt: &healthy},
+			"P": {Bootstrapped: true, BootstrappedAt: &healthy},
+		},
+		Checks: []*CheckStatus{
+			{Name: "X-Chain IsBootstrapped", Severity: Critical, Passing: true, LastPassed: &healthy},
+			{Name: "C-Chain IsBootstrapped", Severity: Critical, Passing: true, LastPassed: &healthy},
+			{Name: "P-Chain IsBootstrapped", Severity: Critical, Passing: true, LastPassed: &healthy},
+			{Name: "IsHealthy", Severity: Critical, Passing: true, LastPassed: &healthy},
+			{Name: "Peers", Severity: Critical, Passing: true, LastPassed: &healthy},
+		},
+		Subsystems: testLiveness(true).Subsystems(),
+	}, status)
+
+	// The monitor is no longer live once it stops evaluating
+	// the health of the node
+	w = get(m, livezPath)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "health not evaluated for 1m0s", w.Body.String())
+
+	// Paused nodes are not ready (but remain healthy) until
+	// they are healthy again after resuming
+	m.Pause("snapshot")
+	w = get(m, readyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "not ready: paused", w.Body.String())
+
+	m.Resume(time.Hour)
+	w = get(m, readyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "not ready: paused", w.Body.String())
+
+	step(ctx, m, clock)
+	assert.Equal(t, http.StatusOK, get(m, readyzPath).Code)
+
+	// Other paths are served as before
+	w = get(m, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "healthy", w.Body.String())
+	assert.Equal(t, w.Body.String(), get(m, "/health").Body.String())
+
+	client.AssertExpectations(t)
+}
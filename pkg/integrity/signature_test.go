@@ -0,0 +1,101 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package integrity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ava-labs/avalanchego/staking"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerify(t *testing.T) {
+	dir := t.TempDir()
+
+	// RSA (staker.key)
+	keyPath := filepath.Join(dir, "staker.key")
+	certPath := filepath.Join(dir, "staker.crt")
+	assert.NoError(t, staking.InitNodeStakingKeyPair(keyPath, certPath))
+	rsaKey, err := LoadPrivateKey(keyPath)
+	assert.NoError(t, err)
+	rsaPublic, err := LoadPublicKey(certPath)
+	assert.NoError(t, err)
+
+	// ECDSA
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	// Ed25519 (written as PKCS #8 and PKIX)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	privateBytes, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	assert.NoError(t, err)
+	publicBytes, err := x509.MarshalPKIXPublicKey(ed25519Key.Public())
+	assert.NoError(t, err)
+	edKeyPath := filepath.Join(dir, "signing.key")
+	edPublicPath := filepath.Join(dir, "signing.pub")
+	assert.NoError(t, ioutil.WriteFile(
+		edKeyPath,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateBytes}),
+		0600,
+	))
+	assert.NoError(t, ioutil.WriteFile(
+		edPublicPath,
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes}),
+		0600,
+	))
+	edKey, err := LoadPrivateKey(edKeyPath)
+	assert.NoError(t, err)
+	edPublic, err := LoadPublicKey(edPublicPath)
+	assert.NoError(t, err)
+
+	tests := map[string]struct {
+		signer crypto.Signer
+		public crypto.PublicKey
+	}{
+		"rsa":     {signer: rsaKey, public: rsaPublic},
+		"ecdsa":   {signer: ecdsaKey, public: ecdsaKey.Public()},
+		"ed25519": {signer: edKey, public: edPublic},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			data := []byte("manifest")
+			signature, err := Sign(test.signer, data)
+			assert.NoError(t, err)
+			assert.NoError(t, Verify(test.public, data, signature))
+
+			assert.ErrorIs(t, Verify(test.public, []byte("tampered"), signature), ErrInvalidSignature)
+			for other, otherTest := range tests {
+				if other != name {
+					assert.Error(t, Verify(otherTest.public, data, signature))
+				}
+			}
+		})
+	}
+}
@@ -42,6 +42,10 @@ const (
 
 	peersMetric  = "custom.googleapis.com/peers"
 	minMetricGap = 10 * time.Second
+
+	// lastBackupMetric is suffixed with the kind of backup
+	// (ex: custom.googleapis.com/last_backup/db).
+	lastBackupMetric = "custom.googleapis.com/last_backup"
 )
 
 // MetricWriter writes metrics to Google Cloud Monitoring.
@@ -176,3 +180,13 @@ func (w *MetricWriter) Peers(ctx context.Context, peerCount uint64) error {
 
 	return w.writeInt64(ctx, peersMetric, int64(peerCount))
 }
+
+// LastBackup writes the time (in unix seconds) of the last
+// successful backup of kind to metrics.
+func (w *MetricWriter) LastBackup(ctx context.Context, kind string, t time.Time) error {
+	if w == nil {
+		return nil
+	}
+
+	return w.writeInt64(ctx, lastBackupMetric+"/"+kind, t.Unix())
+}
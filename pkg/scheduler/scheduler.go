@@ -0,0 +1,124 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Notifier ...
+type Notifier interface {
+	Alert(message string)
+	Info(message string)
+}
+
+// MetricWriter ...
+type MetricWriter interface {
+	LastBackup(ctx context.Context, kind string, t time.Time) error
+}
+
+// Job is a backup that runs on a schedule.
+type Job struct {
+	// Kind identifies the backup in notifications and
+	// metrics (ex: db).
+	Kind string
+
+	// Schedule is a cron expression (ex: "0 3 * * *") or
+	// a descriptor (ex: "@daily").
+	Schedule string
+
+	// Run performs the backup and returns a description
+	// of it that is included in the notification.
+	Run func(ctx context.Context) (string, error)
+
+	// running is 1 while Run is in progress.
+	running int32
+}
+
+// Scheduler runs backups on their schedules and reports
+// the result of each.
+type Scheduler struct {
+	notifier     Notifier
+	metricWriter MetricWriter
+
+	cron *cron.Cron
+	ctx  context.Context
+}
+
+// NewScheduler returns a new *Scheduler.
+func NewScheduler(notifier Notifier, metricWriter MetricWriter) *Scheduler {
+	return &Scheduler{
+		notifier:     notifier,
+		metricWriter: metricWriter,
+		cron:         cron.New(),
+	}
+}
+
+// Add schedules job. It must be called before Run.
+func (s *Scheduler) Add(job *Job) error {
+	if _, err := s.cron.AddFunc(job.Schedule, func() { s.runJob(job) }); err != nil {
+		return fmt.Errorf("%w: invalid schedule %q for %s backups", err, job.Schedule, job.Kind)
+	}
+
+	return nil
+}
+
+// runJob runs job unless it is still running from its
+// previous schedule.
+func (s *Scheduler) runJob(job *Job) {
+	if !atomic.CompareAndSwapInt32(&job.running, 0, 1) {
+		s.notifier.Alert(fmt.Sprintf("skipping %s backup: previous backup is still running", job.Kind))
+		return
+	}
+	defer atomic.StoreInt32(&job.running, 0)
+
+	start := time.Now()
+	description, err := job.Run(s.ctx)
+	if s.ctx.Err() != nil {
+		// The backup was interrupted because we are
+		// shutting down.
+		return
+	}
+	if err != nil {
+		s.notifier.Alert(fmt.Sprintf("%s backup failed: %s", job.Kind, err.Error()))
+		return
+	}
+
+	s.notifier.Info(fmt.Sprintf("%s backup succeeded after %s: %s", job.Kind, time.Since(start), description))
+	if err := s.metricWriter.LastBackup(s.ctx, job.Kind, time.Now()); err != nil {
+		s.notifier.Alert(fmt.Sprintf("LastBackup metric writing failed: %s", err.Error()))
+	}
+}
+
+// Run runs all jobs on their schedules until ctx is done
+// and then waits for any running jobs (which are passed
+// ctx) to return.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.ctx = ctx
+	s.cron.Start()
+
+	<-ctx.Done()
+	<-s.cron.Stop().Done()
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	mocks "github.com/patrick-ogrady/snowplow/mocks/pkg/scheduler"
+)
+
+func TestAdd(t *testing.T) {
+	s := NewScheduler(&mocks.Notifier{}, &mocks.MetricWriter{})
+	assert.NoError(t, s.Add(&Job{Kind: "db", Schedule: "0 3 * * *"}))
+	assert.NoError(t, s.Add(&Job{Kind: "staking", Schedule: "@weekly"}))
+	assert.Error(t, s.Add(&Job{Kind: "db", Schedule: "every day"}))
+}
+
+func TestRunJob(t *testing.T) {
+	notifier := &mocks.Notifier{}
+	metricWriter := &mocks.MetricWriter{}
+	s := NewScheduler(notifier, metricWriter)
+	s.ctx = context.Background()
+
+	// Successful backups are reported and recorded
+	notifier.On("Info", mock.Anything).Run(
+		func(args mock.Arguments) {
+			assert.Contains(t, args[0], "db backup succeeded after")
+			assert.Contains(t, args[0], "db-1")
+		},
+	).Once()
+	metricWriter.On("LastBackup", s.ctx, "db", mock.Anything).Return(nil).Once()
+	s.runJob(&Job{
+		Kind: "db",
+		Run: func(ctx context.Context) (string, error) {
+			return "db-1", nil
+		},
+	})
+
+	// Failed backups are alerted
+	notifier.On("Alert", "db backup failed: disk full").Once()
+	s.runJob(&Job{
+		Kind: "db",
+		Run: func(ctx context.Context) (string, error) {
+			return "", errors.New("disk full")
+		},
+	})
+
+	// Overlapping backups are skipped
+	job := &Job{Kind: "db"}
+	job.Run = func(ctx context.Context) (string, error) {
+		s.runJob(job)
+		return "", errors.New("interrupted")
+	}
+	notifier.On("Alert", "skipping db backup: previous backup is still running").Once()
+	notifier.On("Alert", "db backup failed: interrupted").Once()
+	s.runJob(job)
+
+	// Backups interrupted by shutdown are not alerted
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
+	s.runJob(&Job{
+		Kind: "db",
+		Run: func(ctx context.Context) (string, error) {
+			cancel()
+			return "", ctx.Err()
+		},
+	})
+
+	notifier.AssertExpectations(t)
+	metricWriter.AssertExpectations(t)
+}
@@ -23,9 +23,15 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
 )
 
+// socketPerm only allows the owner to connect
+// to a unix socket.
+const socketPerm = 0600
+
 // StartServer stats a server at a port with a particular handler.
 // This is often used to support a status endpoint for a particular test.
 func StartServer(
@@ -54,3 +60,42 @@ func StartServer(
 		_ = server.Shutdown(ctx)
 	}()
 }
+
+// StartUnixServer starts a server on a unix socket at path
+// (only accessible to the current user) with a particular
+// handler. Any stale socket at path is removed.
+func StartUnixServer(
+	ctx context.Context,
+	name string,
+	handler http.Handler,
+	path string,
+) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%w: could not remove stale socket %s", err, path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("%w: could not listen on %s", err, path)
+	}
+
+	if err := os.Chmod(path, socketPerm); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("%w: could not set permissions of %s", err, path)
+	}
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		log.Printf("%s server running on %s\n", name, path)
+		_ = server.Serve(listener)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		log.Printf("%s server shutting down", name)
+
+		_ = server.Shutdown(context.Background())
+	}()
+
+	return nil
+}
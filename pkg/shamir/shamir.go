@@ -0,0 +1,296 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package shamir
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/patrick-ogrady/snowplow/pkg/integrity"
+)
+
+const (
+	// MaxShares is the maximum number of shares a secret
+	// can be split into (each share needs a unique, non-zero
+	// x-coordinate in GF(256)).
+	MaxShares = 255
+
+	// sharePrefix identifies an encoded share.
+	sharePrefix = "snowplow-share-v1"
+
+	// shareFields is the number of ":" separated fields
+	// in an encoded share.
+	shareFields = 6
+
+	// generator is a generator of the multiplicative group
+	// of GF(256) with the AES reduction polynomial.
+	generator = 0x03
+)
+
+var (
+	// expTable[i] is generator^i.
+	expTable [510]byte
+
+	// logTable[x] is i such that generator^i = x.
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		expTable[i+255] = x
+		logTable[x] = byte(i)
+		x = mulNoTable(x, generator)
+	}
+}
+
+// mulNoTable multiplies two elements of GF(256)
+// (reduction polynomial x^8 + x^4 + x^3 + x + 1).
+func mulNoTable(a byte, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 == 1 {
+			p ^= a
+		}
+
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+
+	return p
+}
+
+func mul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func div(a byte, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+// Share is one part of a secret split with Split.
+type Share struct {
+	// Label identifies the secret the share belongs to
+	// (ex: a NodeID).
+	Label string
+
+	// Threshold is the number of shares needed to
+	// recover the secret.
+	Threshold int
+
+	// Index is the x-coordinate of the share (1-255).
+	Index int
+
+	// Data holds one y-coordinate for each byte
+	// of the secret.
+	Data []byte
+}
+
+// Split splits secret into n shares, any threshold of
+// which can be combined to recover secret. Fewer than
+// threshold shares reveal nothing about secret.
+func Split(label string, secret []byte, n int, threshold int) ([]*Share, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("secret cannot be empty")
+	}
+
+	if threshold < 2 || threshold > n || n > MaxShares {
+		return nil, fmt.Errorf(
+			"threshold must be between 2 and shares, and shares must be at most %d (threshold=%d shares=%d)",
+			MaxShares,
+			threshold,
+			n,
+		)
+	}
+
+	if strings.Contains(label, ":") {
+		return nil, fmt.Errorf("label %s cannot contain ':'", label)
+	}
+
+	shares := make([]*Share, n)
+	for i := range shares {
+		shares[i] = &Share{
+			Label:     label,
+			Threshold: threshold,
+			Index:     i + 1,
+			Data:      make([]byte, len(secret)),
+		}
+	}
+
+	// Each byte of secret is the constant term of a random
+	// polynomial of degree threshold-1.
+	coefficients := make([]byte, threshold-1)
+	for b, s := range secret {
+		if _, err := rand.Read(coefficients); err != nil {
+			return nil, fmt.Errorf("%w: could not generate coefficients", err)
+		}
+
+		for _, share := range shares {
+			x := byte(share.Index)
+
+			// Horner's method
+			var y byte
+			for i := len(coefficients) - 1; i >= 0; i-- {
+				y = mul(y, x) ^ coefficients[i]
+			}
+			share.Data[b] = mul(y, x) ^ s
+		}
+	}
+
+	return shares, nil
+}
+
+// Combine recovers a secret from at least threshold
+// shares created by Split.
+func Combine(shares []*Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares provided")
+	}
+
+	first := shares[0]
+	if len(shares) < first.Threshold {
+		return nil, fmt.Errorf("need %d shares but only have %d", first.Threshold, len(shares))
+	}
+
+	seen := map[int]struct{}{}
+	for _, share := range shares {
+		if share.Label != first.Label || share.Threshold != first.Threshold {
+			return nil, fmt.Errorf("share %d does not belong to %s", share.Index, first.Label)
+		}
+
+		if len(share.Data) != len(first.Data) {
+			return nil, fmt.Errorf("share %d has an unexpected length", share.Index)
+		}
+
+		if share.Index < 1 || share.Index > MaxShares {
+			return nil, fmt.Errorf("share index %d is invalid", share.Index)
+		}
+
+		if _, ok := seen[share.Index]; ok {
+			return nil, fmt.Errorf("share %d provided more than once", share.Index)
+		}
+		seen[share.Index] = struct{}{}
+	}
+
+	// Lagrange interpolation at x=0 (subtraction
+	// and addition are both XOR in GF(256)).
+	secret := make([]byte, len(first.Data))
+	for i, share := range shares {
+		xi := byte(share.Index)
+		basis := byte(1)
+		for j, other := range shares {
+			if i == j {
+				continue
+			}
+
+			xj := byte(other.Index)
+			basis = mul(basis, div(xj, xj^xi))
+		}
+
+		for b := range secret {
+			secret[b] ^= mul(share.Data[b], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+// payload returns the checksummed portion of
+// an encoded share.
+func (s *Share) payload() string {
+	return strings.Join([]string{
+		sharePrefix,
+		s.Label,
+		strconv.Itoa(s.Threshold),
+		strconv.Itoa(s.Index),
+		base64.StdEncoding.EncodeToString(s.Data),
+	}, ":")
+}
+
+// Encode returns a text representation of the share
+// protected by a SHA256 checksum.
+func (s *Share) Encode() (string, error) {
+	payload := s.payload()
+	checksum, err := integrity.Checksum(strings.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("%w: could not compute checksum", err)
+	}
+
+	return fmt.Sprintf("%s:%s", payload, checksum), nil
+}
+
+// Decode parses a share created by Encode and
+// verifies its checksum.
+func Decode(blob string) (*Share, error) {
+	fields := strings.Split(strings.TrimSpace(blob), ":")
+	if len(fields) != shareFields || fields[0] != sharePrefix {
+		return nil, errors.New("not a snowplow share")
+	}
+
+	threshold, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid threshold", err)
+	}
+
+	index, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid index", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid data", err)
+	}
+
+	share := &Share{
+		Label:     fields[1],
+		Threshold: threshold,
+		Index:     index,
+		Data:      data,
+	}
+
+	checksum, err := integrity.Checksum(strings.NewReader(share.payload()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not compute checksum", err)
+	}
+
+	if checksum != fields[5] {
+		return nil, fmt.Errorf("share %d checksum mismatch (expected %s but got %s)", index, fields[5], checksum)
+	}
+
+	return share, nil
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package shamir
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := make([]byte, 1024)
+	_, err := rand.Read(secret)
+	assert.NoError(t, err)
+
+	shares, err := Split("NodeID-test", secret, 5, 3)
+	assert.NoError(t, err)
+	assert.Len(t, shares, 5)
+
+	tests := map[string]struct {
+		indexes []int
+		recover bool
+	}{
+		"first three":   {indexes: []int{0, 1, 2}, recover: true},
+		"last three":    {indexes: []int{2, 3, 4}, recover: true},
+		"out of order":  {indexes: []int{4, 0, 2}, recover: true},
+		"all":           {indexes: []int{0, 1, 2, 3, 4}, recover: true},
+		"below minimum": {indexes: []int{0, 1}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			subset := []*Share{}
+			for _, i := range test.indexes {
+				subset = append(subset, shares[i])
+			}
+
+			recovered, err := Combine(subset)
+			if !test.recover {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, secret, recovered)
+		})
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	_, err := Split("NodeID-test", []byte("secret"), 3, 1)
+	assert.Error(t, err)
+
+	_, err = Split("NodeID-test", []byte("secret"), 3, 4)
+	assert.Error(t, err)
+
+	_, err = Split("NodeID-test", []byte("secret"), 256, 2)
+	assert.Error(t, err)
+
+	_, err = Split("NodeID:test", []byte("secret"), 3, 2)
+	assert.Error(t, err)
+
+	_, err = Split("NodeID-test", []byte{}, 3, 2)
+	assert.Error(t, err)
+}
+
+func TestEncodeDecode(t *testing.T) {
+	shares, err := Split("NodeID-test", []byte("secret"), 3, 2)
+	assert.NoError(t, err)
+
+	blob, err := shares[1].Encode()
+	assert.NoError(t, err)
+
+	decoded, err := Decode(blob + "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, shares[1], decoded)
+
+	// Corrupt a single character of the data.
+	fields := strings.Split(blob, ":")
+	data := []byte(fields[4])
+	if data[0] == 'A' {
+		data[0] = 'B'
+	} else {
+		data[0] = 'A'
+	}
+	fields[4] = string(data)
+	_, err = Decode(strings.Join(fields, ":"))
+	assert.Error(t, err)
+
+	_, err = Decode("not a share")
+	assert.Error(t, err)
+}
+
+func TestCombineMismatchedShares(t *testing.T) {
+	a, err := Split("NodeID-a", []byte("secret"), 3, 2)
+	assert.NoError(t, err)
+	b, err := Split("NodeID-b", []byte("secret"), 3, 2)
+	assert.NoError(t, err)
+
+	_, err = Combine([]*Share{a[0], b[1]})
+	assert.Error(t, err)
+
+	_, err = Combine([]*Share{a[0], a[0]})
+	assert.Error(t, err)
+}
@@ -0,0 +1,602 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+	"github.com/patrick-ogrady/snowplow/pkg/transfer"
+)
+
+const (
+	// Prefix is the prefix of all snapshots.
+	Prefix = "snapshots/"
+
+	// Extension is the extension of all snapshots. It is
+	// only used by snapshots (unlike ".json", which is also
+	// used by the manifests stored next to them), so GC can
+	// identify every snapshot by its name.
+	Extension = ".snapshot.json"
+
+	// BlobPrefix is the prefix of all blobs.
+	BlobPrefix = "blobs/"
+
+	// stagingPattern is the pattern used to name the
+	// directory a restore is extracted into.
+	stagingPattern = ".snowplow-restore-"
+
+	// permMask is applied to the mode of all restored
+	// files and directories.
+	permMask = 0777
+
+	// ownerDirectoryPerm is always granted on restored
+	// directories so that their contents can be written.
+	ownerDirectoryPerm = 0700
+)
+
+// ErrFileChanged is returned when a file changes while it
+// is being backed up.
+var ErrFileChanged = errors.New("file changed during backup")
+
+// ErrBlobMismatch is returned when a restored blob does not
+// match the checksum it is named by.
+var ErrBlobMismatch = errors.New("blob checksum mismatch")
+
+// blobExtensions are the extensions of blobs compressed
+// with each compression.Format.
+var blobExtensions = map[compression.Format]string{
+	compression.Gzip: ".gz",
+	compression.Zstd: ".zst",
+}
+
+// Entry is a file or directory in a snapshot.
+type Entry struct {
+	// Path is the slash-separated path of the entry relative
+	// to the directory that was backed up.
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+
+	// Size and Blob (the checksum of the contents of the
+	// file) are only populated for files.
+	Size int64  `json:"size,omitempty"`
+	Blob string `json:"blob,omitempty"`
+}
+
+// Snapshot lists the contents of a directory at the time
+// it was backed up.
+type Snapshot struct {
+	Compression compression.Format `json:"compression"`
+	Entries     []*Entry           `json:"entries"`
+}
+
+// Options configures a backup or restore.
+type Options struct {
+	// Format is the compression format of new blobs.
+	Format compression.Format
+
+	// Workers is the number of files transferred
+	// concurrently. Defaults to transfer.DefaultWorkers.
+	Workers int
+
+	// Limiter caps the bandwidth of all workers. If nil,
+	// the bandwidth is not limited.
+	Limiter *transfer.Limiter
+
+	// Checksum is the checksum the snapshot must match when
+	// it is restored (ex: from a signed manifest). Every blob
+	// is verified against the checksum it is listed with, so
+	// this covers the entire restore. If empty, the checksum
+	// stored next to the snapshot is used.
+	Checksum string
+}
+
+// workers returns the number of workers to use.
+func (opts *Options) workers() int {
+	if opts.Workers <= 0 {
+		return transfer.DefaultWorkers
+	}
+
+	return opts.Workers
+}
+
+// Name returns the name of the snapshot called name.
+func Name(name string) string {
+	return Prefix + name + Extension
+}
+
+// blobName returns the name of the blob holding the
+// contents with checksum sum compressed with format.
+func blobName(sum string, format compression.Format) string {
+	return BlobPrefix + sum[:2] + "/" + sum + blobExtensions[format]
+}
+
+// Backup stores a snapshot of the directory path (relative to
+// base) as name in backend. Each file is stored as a
+// compressed blob named by the checksum of its contents, so
+// files that did not change since an earlier backup (ex:
+// LevelDB tables) are never uploaded again. The snapshot itself
+// is stored with storage.Upload, so the returned result
+// describes it (and the total size of the files it lists).
+func Backup(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	base string,
+	path string,
+	opts *Options,
+) (*storage.UploadResult, error) {
+	if _, ok := blobExtensions[opts.Format]; !ok {
+		return nil, fmt.Errorf("compression format %s is not supported", opts.Format)
+	}
+
+	existing, err := listBlobs(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := walk(filepath.Join(base, path), opts.Format)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read %s", err, path)
+	}
+
+	// Upload the blobs that are missing
+	var (
+		mu       sync.Mutex
+		size     int64
+		uploaded int64
+		files    int64
+	)
+	root := filepath.Join(base, path)
+	if err := forEachFile(ctx, snapshot, opts.workers(), func(ctx context.Context, entry *Entry) error {
+		p := filepath.Join(root, filepath.FromSlash(entry.Path))
+		sum, n, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		entry.Blob = sum
+		entry.Size = n
+		atomic.AddInt64(&size, n)
+
+		blob := blobName(sum, opts.Format)
+		mu.Lock()
+		exists := existing[blob]
+		existing[blob] = true
+		mu.Unlock()
+		if exists {
+			return nil
+		}
+
+		if err := uploadBlob(ctx, backend, blob, p, sum, opts); err != nil {
+			// Another file with the same contents may still
+			// reference this blob.
+			mu.Lock()
+			delete(existing, blob)
+			mu.Unlock()
+			return err
+		}
+
+		atomic.AddInt64(&uploaded, n)
+		atomic.AddInt64(&files, 1)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("%w: could not back up %s", err, path)
+	}
+
+	// Upload the snapshot (only once all of its blobs exist)
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not marshal snapshot", err)
+	}
+
+	result, err := storage.Upload(ctx, backend, name, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not store %s", err, name)
+	}
+
+	fmt.Printf("uploaded %d new files (%d of %d bytes)\n", files, uploaded, size)
+	return &storage.UploadResult{Checksum: result.Checksum, Size: size}, nil
+}
+
+// walk returns a snapshot of the entries in root (without
+// the contents of any files).
+func walk(root string, format compression.Format) (*Snapshot, error) {
+	snapshot := &Snapshot{Compression: format, Entries: []*Entry{}}
+	if err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file or directory", p)
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		snapshot.Entries = append(snapshot.Entries, &Entry{
+			Path: filepath.ToSlash(rel),
+			Mode: info.Mode() & (os.ModeDir | permMask),
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// listBlobs returns the names of all blobs in backend.
+func listBlobs(ctx context.Context, backend storage.Backend) (map[string]bool, error) {
+	objects, err := backend.List(ctx, BlobPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not list blobs", err)
+	}
+
+	blobs := map[string]bool{}
+	for _, obj := range objects {
+		blobs[obj.Name] = true
+	}
+
+	return blobs, nil
+}
+
+// hashFile returns the checksum and size of the file at p.
+func hashFile(p string) (string, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", -1, fmt.Errorf("%w: could not open %s", err, p)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", -1, fmt.Errorf("%w: could not read %s", err, p)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), n, nil
+}
+
+// uploadBlob stores the compressed contents of the file at p
+// as blob. If the contents no longer match sum, the upload
+// fails with ErrFileChanged.
+func uploadBlob(
+	ctx context.Context,
+	backend storage.Backend,
+	blob string,
+	p string,
+	sum string,
+	opts *Options,
+) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("%w: could not open %s", err, p)
+	}
+	defer f.Close()
+
+	// Compress the file while it is uploaded, checking that it
+	// did not change since it was hashed. Put never stores a
+	// partial object, so a blob that exists is always complete.
+	pr, pw := io.Pipe()
+	go func() {
+		h := sha256.New()
+		cw, err := compression.NewWriter(pw, opts.Format)
+		if err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(io.MultiWriter(cw, h), f); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+
+		if err := cw.Close(); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+
+		if fmt.Sprintf("%x", h.Sum(nil)) != sum {
+			_ = pw.CloseWithError(fmt.Errorf("%w: %s", ErrFileChanged, p))
+			return
+		}
+
+		_ = pw.Close()
+	}()
+	defer pr.Close()
+
+	if err := backend.Put(ctx, blob, opts.Limiter.Reader(ctx, pr)); err != nil {
+		return fmt.Errorf("%w: could not upload %s", err, p)
+	}
+
+	return nil
+}
+
+// forEachFile calls f for each file in snapshot using
+// workers goroutines. It stops at the first error.
+func forEachFile(
+	ctx context.Context,
+	snapshot *Snapshot,
+	workers int,
+	f func(context.Context, *Entry) error,
+) error {
+	g, gctx := errgroup.WithContext(ctx)
+	queue := make(chan *Entry)
+	g.Go(func() error {
+		defer close(queue)
+
+		for _, entry := range snapshot.Entries {
+			if entry.Mode.IsDir() {
+				continue
+			}
+
+			select {
+			case queue <- entry:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+		}
+
+		return nil
+	})
+
+	for i := 0; i < workers; i++ {
+		g.Go(func() error {
+			for entry := range queue {
+				if err := f(gctx, entry); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// Read returns the snapshot name stored in backend.
+func Read(ctx context.Context, backend storage.Backend, name string) (*Snapshot, error) {
+	return ReadExpected(ctx, backend, name, "")
+}
+
+// ReadExpected returns the snapshot name stored in backend,
+// checking that it matches checksum (ex: from a signed
+// manifest) if it is not empty.
+func ReadExpected(ctx context.Context, backend storage.Backend, name string, checksum string) (*Snapshot, error) {
+	var buf bytes.Buffer
+	if err := storage.Download(ctx, backend, name, &buf); err != nil {
+		return nil, fmt.Errorf("%w: could not download %s", err, name)
+	}
+
+	// Check if the snapshot matches the expected checksum
+	if len(checksum) > 0 {
+		sum := fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+		if sum != checksum {
+			return nil, fmt.Errorf(
+				"%w: expected checksum %s but got %s for %s",
+				storage.ErrChecksumMismatch,
+				checksum,
+				sum,
+				name,
+			)
+		}
+	}
+
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(buf.Bytes(), snapshot); err != nil {
+		return nil, fmt.Errorf("%w: could not parse %s", err, name)
+	}
+
+	if _, ok := blobExtensions[snapshot.Compression]; !ok {
+		return nil, fmt.Errorf("compression format %s of %s is not supported", snapshot.Compression, name)
+	}
+
+	return snapshot, nil
+}
+
+// Restore rebuilds the directory path (relative to base) from
+// the snapshot name in backend. The directory is rebuilt in a
+// staging directory in base and only moved into place once
+// every file has been verified. path must not already exist
+// in base.
+func Restore(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	base string,
+	path string,
+	opts *Options,
+) error {
+	target := filepath.Join(base, path)
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		return fmt.Errorf("%s already exists", target)
+	}
+
+	snapshot, err := ReadExpected(ctx, backend, name, opts.Checksum)
+	if err != nil {
+		return err
+	}
+
+	staging, err := ioutil.TempDir(base, stagingPattern)
+	if err != nil {
+		return fmt.Errorf("%w: could not create staging directory", err)
+	}
+	defer os.RemoveAll(staging)
+
+	// Create directories (parents are always listed
+	// before their contents)
+	root := filepath.Join(staging, "root")
+	for _, entry := range snapshot.Entries {
+		if !entry.Mode.IsDir() {
+			continue
+		}
+
+		p, err := compression.EntryPath(root, entry.Path)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(p, entry.Mode&permMask|ownerDirectoryPerm); err != nil {
+			return fmt.Errorf("%w: could not create directory %s", err, p)
+		}
+	}
+
+	// Restore files
+	if err := forEachFile(ctx, snapshot, opts.workers(), func(ctx context.Context, entry *Entry) error {
+		p, err := compression.EntryPath(root, entry.Path)
+		if err != nil {
+			return err
+		}
+
+		return restoreBlob(ctx, backend, snapshot.Compression, entry, p, opts)
+	}); err != nil {
+		return fmt.Errorf("%w: could not restore %s", err, name)
+	}
+
+	if _, err := os.Stat(root); err != nil {
+		return fmt.Errorf("%w: %s is empty", err, name)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), ownerDirectoryPerm); err != nil {
+		return fmt.Errorf("%w: could not create parent of %s", err, target)
+	}
+
+	if err := os.Rename(root, target); err != nil {
+		return fmt.Errorf("%w: could not move %s into place", err, target)
+	}
+
+	return nil
+}
+
+// restoreBlob writes the contents of the blob of entry to p,
+// verifying that they match the checksum of the blob.
+func restoreBlob(
+	ctx context.Context,
+	backend storage.Backend,
+	format compression.Format,
+	entry *Entry,
+	p string,
+	opts *Options,
+) error {
+	if len(entry.Blob) != sha256.Size*2 || strings.Trim(entry.Blob, "0123456789abcdef") != "" {
+		return fmt.Errorf("%s has an invalid blob %q", entry.Path, entry.Blob)
+	}
+
+	blob := blobName(entry.Blob, format)
+	rc, err := backend.Get(ctx, blob)
+	if err != nil {
+		return fmt.Errorf("%w: could not download %s", err, blob)
+	}
+	defer rc.Close()
+
+	cr, err := compression.NewReader(opts.Limiter.Reader(ctx, rc), format)
+	if err != nil {
+		return fmt.Errorf("%w: could not decompress %s", err, blob)
+	}
+	defer cr.Close()
+
+	h := sha256.New()
+	if err := compression.ExtractFile(io.TeeReader(cr, h), p, entry.Mode&permMask); err != nil {
+		return err
+	}
+
+	if sum := fmt.Sprintf("%x", h.Sum(nil)); sum != entry.Blob {
+		return fmt.Errorf("%w: %s has checksum %s", ErrBlobMismatch, blob, sum)
+	}
+
+	return nil
+}
+
+// GC removes all blobs in backend that are not referenced by
+// any snapshot and returns the number and total size of the
+// blobs removed (or that would be removed if dryRun is true).
+// GC fails (without removing anything) if any snapshot cannot
+// be read. GC must not run at the same time as Backup, which may
+// upload a blob (or rely on an existing blob) before the
+// snapshot referencing it is stored.
+func GC(ctx context.Context, backend storage.Backend, dryRun bool) (int, int64, error) {
+	objects, err := backend.List(ctx, "")
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: could not list objects", err)
+	}
+
+	// Collect the blobs referenced by every snapshot (a
+	// snapshot that cannot be read, ex: one that is still
+	// being uploaded, may reference any blob so GC fails)
+	referenced := map[string]bool{}
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Name, Prefix) || !strings.HasSuffix(obj.Name, Extension) {
+			continue
+		}
+
+		snapshot, err := Read(ctx, backend, obj.Name)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: could not read snapshot %s", err, obj.Name)
+		}
+
+		for _, entry := range snapshot.Entries {
+			if len(entry.Blob) > 0 {
+				referenced[blobName(entry.Blob, snapshot.Compression)] = true
+			}
+		}
+	}
+
+	// Remove unreferenced blobs
+	var (
+		removed int
+		size    int64
+	)
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Name, BlobPrefix) || referenced[obj.Name] {
+			continue
+		}
+
+		if !dryRun {
+			err := backend.Delete(ctx, obj.Name)
+			if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+				return removed, size, fmt.Errorf("%w: could not delete %s", err, obj.Name)
+			}
+		}
+
+		removed++
+		size += obj.Size
+	}
+
+	return removed, size, nil
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/patrick-ogrady/snowplow/pkg/compression"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+func setup(t *testing.T) (string, string, storage.Backend) {
+	src := t.TempDir()
+	db := filepath.Join(".avalanchego", "db")
+	for name, contents := range map[string]string{
+		"000001.ldb":        "table 1",
+		"000002.ldb":        "table 2",
+		"copy/000001.ldb":   "table 1",
+		"MANIFEST-000003":   "manifest",
+		"empty/placeholder": "",
+	} {
+		p := filepath.Join(src, db, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0700))
+		assert.NoError(t, ioutil.WriteFile(p, []byte(contents), 0600))
+	}
+
+	backend, err := storage.NewFileBackend(t.TempDir())
+	assert.NoError(t, err)
+
+	return src, db, backend
+}
+
+func countBlobs(t *testing.T, backend storage.Backend) int {
+	blobs, err := listBlobs(context.Background(), backend)
+	assert.NoError(t, err)
+
+	return len(blobs)
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	src, db, backend := setup(t)
+	opts := &Options{Format: compression.Zstd, Workers: 2}
+
+	// Identical files are only stored once
+	result, err := Backup(ctx, backend, Name("first"), src, db, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(29), result.Size)
+	assert.Equal(t, 4, countBlobs(t, backend))
+
+	// Unchanged files are not uploaded again
+	_, err = Backup(ctx, backend, Name("second"), src, db, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, countBlobs(t, backend))
+
+	changed := filepath.Join(src, db, "MANIFEST-000003")
+	assert.NoError(t, ioutil.WriteFile(changed, []byte("manifest 2"), 0600))
+	_, err = Backup(ctx, backend, Name("third"), src, db, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, countBlobs(t, backend))
+
+	// Every snapshot can be restored
+	for name, manifest := range map[string]string{"first": "manifest", "third": "manifest 2"} {
+		dst := t.TempDir()
+		assert.NoError(t, Restore(ctx, backend, Name(name), dst, db, opts))
+
+		contents, err := ioutil.ReadFile(filepath.Join(dst, db, "MANIFEST-000003"))
+		assert.NoError(t, err)
+		assert.Equal(t, manifest, string(contents))
+
+		contents, err = ioutil.ReadFile(filepath.Join(dst, db, "copy", "000001.ldb"))
+		assert.NoError(t, err)
+		assert.Equal(t, "table 1", string(contents))
+
+		info, err := os.Stat(filepath.Join(dst, db, "000002.ldb"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		// Only the db is left behind
+		entries, err := ioutil.ReadDir(dst)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+
+		// Restoring over an existing db fails
+		assert.Error(t, Restore(ctx, backend, Name(name), dst, db, opts))
+	}
+
+	// Blobs are only removed once no snapshot references them
+	removed, _, err := GC(ctx, backend, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	for _, name := range []string{"first", "second"} {
+		assert.NoError(t, backend.Delete(ctx, Name(name)))
+		assert.NoError(t, backend.Delete(ctx, Name(name)+storage.ChecksumSuffix))
+	}
+	removed, size, err := GC(ctx, backend, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.True(t, size > 0)
+	assert.Equal(t, 5, countBlobs(t, backend))
+
+	removed, _, err = GC(ctx, backend, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, 4, countBlobs(t, backend))
+	assert.NoError(t, Restore(ctx, backend, Name("third"), t.TempDir(), db, opts))
+}
+
+func TestRestoreCorruptBlob(t *testing.T) {
+	ctx := context.Background()
+	src, db, backend := setup(t)
+	opts := &Options{Format: compression.Gzip}
+
+	_, err := Backup(ctx, backend, Name("backup"), src, db, opts)
+	assert.NoError(t, err)
+
+	// Replace a blob with the contents of another file
+	snapshot, err := Read(ctx, backend, Name("backup"))
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	w, err := compression.NewWriter(&buf, compression.Gzip)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("corrupt"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	for _, entry := range snapshot.Entries {
+		if entry.Path == "MANIFEST-000003" {
+			assert.NoError(t, backend.Put(ctx, blobName(entry.Blob, compression.Gzip), &buf))
+		}
+	}
+
+	dst := t.TempDir()
+	err = Restore(ctx, backend, Name("backup"), dst, db, opts)
+	assert.ErrorIs(t, err, ErrBlobMismatch)
+
+	// Nothing is left behind
+	entries, err := ioutil.ReadDir(dst)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestRestoreReplacedSnapshot(t *testing.T) {
+	ctx := context.Background()
+	src, db, backend := setup(t)
+	opts := &Options{Format: compression.Gzip}
+
+	result, err := Backup(ctx, backend, Name("backup"), src, db, opts)
+	assert.NoError(t, err)
+
+	// Replace the snapshot (and its checksum) with another
+	// snapshot
+	changed := filepath.Join(src, db, "MANIFEST-000003")
+	assert.NoError(t, ioutil.WriteFile(changed, []byte("manifest 2"), 0600))
+	_, err = Backup(ctx, backend, Name("other"), src, db, opts)
+	assert.NoError(t, err)
+	for _, suffix := range []string{"", storage.ChecksumSuffix} {
+		var buf bytes.Buffer
+		rc, err := backend.Get(ctx, Name("other")+suffix)
+		assert.NoError(t, err)
+		_, err = io.Copy(&buf, rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.NoError(t, backend.Put(ctx, Name("backup")+suffix, &buf))
+	}
+
+	// The replaced snapshot is only detected with the
+	// expected checksum
+	assert.NoError(t, Restore(ctx, backend, Name("backup"), t.TempDir(), db, opts))
+
+	dst := t.TempDir()
+	opts.Checksum = result.Checksum
+	err = Restore(ctx, backend, Name("backup"), dst, db, opts)
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+
+	entries, err := ioutil.ReadDir(dst)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestGCPartialSnapshot(t *testing.T) {
+	ctx := context.Background()
+	src, db, backend := setup(t)
+	opts := &Options{Format: compression.Gzip}
+
+	_, err := Backup(ctx, backend, Name("backup"), src, db, opts)
+	assert.NoError(t, err)
+
+	// Manifests stored next to the snapshot are not snapshots
+	assert.NoError(t, backend.Put(ctx, Name("backup")+".manifest.json", bytes.NewReader([]byte("{}"))))
+	removed, _, err := GC(ctx, backend, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+	assert.Equal(t, 4, countBlobs(t, backend))
+
+	// A half-written snapshot (without a checksum yet)
+	// fails GC instead of being skipped
+	var buf bytes.Buffer
+	rc, err := backend.Get(ctx, Name("backup"))
+	assert.NoError(t, err)
+	_, err = io.Copy(&buf, rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.NoError(t, backend.Put(ctx, Name("partial"), bytes.NewReader(buf.Bytes()[:buf.Len()/2])))
+	_, _, err = GC(ctx, backend, false)
+	assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+
+	// A snapshot that cannot be parsed fails GC
+	assert.NoError(t, storage.WriteChecksum(ctx, backend, Name("partial"), "checksum"))
+	_, _, err = GC(ctx, backend, false)
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+
+	_, err = storage.Upload(ctx, backend, Name("partial"), bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	assert.NoError(t, err)
+	_, _, err = GC(ctx, backend, false)
+	assert.Error(t, err)
+
+	// No blobs were removed
+	assert.Equal(t, 4, countBlobs(t, backend))
+}
@@ -0,0 +1,685 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5" // nolint:gosec
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+// fakeObject is an object held by a fakeStore.
+type fakeObject struct {
+	data    []byte
+	updated time.Time
+}
+
+// fakeUpload is a multipart (S3) or resumable (GCS) upload
+// in progress.
+type fakeUpload struct {
+	bucket string
+	name   string
+	parts  map[int][]byte
+	data   []byte
+}
+
+// fakeStore is an in-memory object store shared by the fake
+// GCS and S3 servers.
+type fakeStore struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]*fakeUpload
+	nextID  int
+
+	// truncate ends the download of any object larger than
+	// truncate bytes after truncate bytes (if positive).
+	truncate int64
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		objects: map[string]*fakeObject{},
+		uploads: map[string]*fakeUpload{},
+	}
+}
+
+func fakeKey(bucket string, name string) string {
+	return bucket + "/" + name
+}
+
+func (s *fakeStore) put(bucket string, name string, data []byte) *fakeObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj := &fakeObject{data: data, updated: time.Now().UTC().Truncate(time.Second)}
+	s.objects[fakeKey(bucket, name)] = obj
+	return obj
+}
+
+func (s *fakeStore) get(bucket string, name string) (*fakeObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[fakeKey(bucket, name)]
+	return obj, ok
+}
+
+func (s *fakeStore) delete(bucket string, name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fakeKey(bucket, name)
+	_, ok := s.objects[key]
+	delete(s.objects, key)
+	return ok
+}
+
+// list returns the names of all objects in bucket starting
+// with prefix (in lexical order).
+func (s *fakeStore) list(bucket string, prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := []string{}
+	for key := range s.objects {
+		name := strings.TrimPrefix(key, bucket+"/")
+		if name != key && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (s *fakeStore) newUpload(bucket string, name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	id := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[id] = &fakeUpload{bucket: bucket, name: name, parts: map[int][]byte{}}
+	return id
+}
+
+// withUpload calls f with upload id while holding the lock.
+// It returns false if there is no such upload.
+func (s *fakeStore) withUpload(id string, f func(u *fakeUpload)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[id]
+	if ok {
+		f(u)
+	}
+
+	return ok
+}
+
+func (s *fakeStore) removeUpload(id string) (*fakeUpload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[id]
+	delete(s.uploads, id)
+	return u, ok
+}
+
+func (s *fakeStore) setTruncate(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.truncate = n
+}
+
+// serveObject writes the contents of obj (or the requested
+// range of them). If the store truncates downloads, the
+// connection is closed early after announcing the full
+// length.
+func (s *fakeStore) serveObject(w http.ResponseWriter, r *http.Request, obj *fakeObject) {
+	data := obj.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); len(rng) > 0 {
+		start, end, ok := parseFakeRange(rng, int64(len(data)))
+		if !ok {
+			http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Last-Modified", obj.updated.Format(http.TimeFormat))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	s.mu.Lock()
+	truncate := s.truncate
+	s.mu.Unlock()
+	if truncate > 0 && int64(len(data)) > truncate {
+		_, _ = w.Write(data[:truncate])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	_, _ = w.Write(data)
+}
+
+// parseFakeRange parses a single "bytes=start-[end]" range.
+func parseFakeRange(rng string, size int64) (int64, int64, bool) {
+	const parts = 2
+	bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", parts)
+	if len(bounds) != parts {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+
+	end := size - 1
+	if len(bounds[1]) > 0 {
+		end, err = strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end, true
+}
+
+// rewriteTransport sends every request to a test server
+// regardless of the host it was addressed to.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// fakeGCS serves the subset of the Google Cloud Storage JSON
+// API (and XML download API) used by GCSBackend.
+type fakeGCS struct {
+	store *fakeStore
+}
+
+// newFakeGCSBackend returns a *GCSBackend that stores objects
+// in store.
+func newFakeGCSBackend(t *testing.T, store *fakeStore, bucket string, prefix string) *GCSBackend {
+	server := httptest.NewServer(&fakeGCS{store: store})
+	t.Cleanup(server.Close)
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewGCSBackend(
+		context.Background(),
+		bucket,
+		prefix,
+		option.WithHTTPClient(&http.Client{Transport: &rewriteTransport{target: target}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+
+	return backend
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"):
+		f.insert(w, r)
+	case strings.HasPrefix(r.URL.Path, "/upload/resumable/"):
+		f.resume(w, r, strings.TrimPrefix(r.URL.Path, "/upload/resumable/"))
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/"):
+		f.api(w, r)
+	default:
+		f.download(w, r)
+	}
+}
+
+// writeObject responds with the JSON resource of name.
+func (f *fakeGCS) writeObject(w http.ResponseWriter, bucket string, name string, obj *fakeObject) {
+	_ = json.NewEncoder(w).Encode(f.resource(bucket, name, obj))
+}
+
+func (f *fakeGCS) resource(bucket string, name string, obj *fakeObject) map[string]string {
+	return map[string]string{
+		"kind":    "storage#object",
+		"bucket":  bucket,
+		"name":    name,
+		"size":    strconv.Itoa(len(obj.data)),
+		"updated": obj.updated.Format(time.RFC3339),
+	}
+}
+
+func (f *fakeGCS) notFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = io.WriteString(w, `{"error":{"code":404,"message":"Not Found"}}`)
+}
+
+// insert handles single request (multipart) uploads and
+// starts resumable uploads.
+func (f *fakeGCS) insert(w http.ResponseWriter, r *http.Request) {
+	bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+	metadata := struct {
+		Name string `json:"name"`
+	}{}
+
+	switch r.URL.Query().Get("uploadType") {
+	case "multipart":
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		part, err := mr.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(&metadata)
+		}
+		if err == nil {
+			part, err = mr.NextPart()
+		}
+		var data []byte
+		if err == nil {
+			data, err = ioutil.ReadAll(part)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f.writeObject(w, bucket, metadata.Name, f.store.put(bucket, metadata.Name, data))
+	case "resumable":
+		if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id := f.store.newUpload(bucket, metadata.Name)
+		w.Header().Set("Location", "https://www.googleapis.com/upload/resumable/"+id)
+	default:
+		http.Error(w, "unsupported upload type", http.StatusBadRequest)
+	}
+}
+
+// resume appends a chunk to resumable upload id and stores
+// the object once the final chunk is received.
+func (f *fakeGCS) resume(w http.ResponseWriter, r *http.Request, id string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Content-Range is "bytes start-end/*" for all but the
+	// final chunk, which has the total size instead of *.
+	final := !strings.HasSuffix(r.Header.Get("Content-Range"), "/*")
+	var received int
+	if !f.store.withUpload(id, func(u *fakeUpload) {
+		u.data = append(u.data, data...)
+		received = len(u.data)
+	}) {
+		f.notFound(w)
+		return
+	}
+
+	if !final {
+		w.Header().Set("X-HTTP-Status-Code-Override", "308")
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+		return
+	}
+
+	u, _ := f.store.removeUpload(id)
+	f.writeObject(w, u.bucket, u.name, f.store.put(u.bucket, u.name, u.data))
+}
+
+// api handles object metadata, listing and deletion.
+func (f *fakeGCS) api(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/")
+	bucket := path[:strings.Index(path, "/")]
+	name := strings.TrimPrefix(strings.TrimPrefix(path, bucket+"/o"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && len(name) == 0:
+		items := []map[string]string{}
+		for _, name := range f.store.list(bucket, r.URL.Query().Get("prefix")) {
+			if obj, ok := f.store.get(bucket, name); ok {
+				items = append(items, f.resource(bucket, name, obj))
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":  "storage#objects",
+			"items": items,
+		})
+	case r.Method == http.MethodGet:
+		obj, ok := f.store.get(bucket, name)
+		if !ok {
+			f.notFound(w)
+			return
+		}
+		f.writeObject(w, bucket, name, obj)
+	case r.Method == http.MethodDelete:
+		if !f.store.delete(bucket, name) {
+			f.notFound(w)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+	}
+}
+
+// download serves object contents at /bucket/name.
+func (f *fakeGCS) download(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	i := strings.Index(path, "/")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	obj, ok := f.store.get(path[:i], path[i+1:])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f.store.serveObject(w, r, obj)
+}
+
+// fakeS3 serves the subset of the S3 API (with path-style
+// addressing) used by S3Backend.
+type fakeS3 struct {
+	store *fakeStore
+}
+
+// newFakeS3Backend returns a *S3Backend that stores objects
+// in store.
+func newFakeS3Backend(t *testing.T, store *fakeStore, bucket string, prefix string) *S3Backend {
+	server := httptest.NewServer(&fakeS3{store: store})
+	t.Cleanup(server.Close)
+
+	backend, err := NewS3Backend(bucket, prefix, &S3Config{
+		Endpoint:        strings.TrimPrefix(server.URL, "http://"),
+		Region:          "us-east-1",
+		PathStyle:       true,
+		Insecure:        true,
+		PartSize:        5 * mebibyte, // nolint:gomnd
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return backend
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+type s3Contents struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+}
+
+type s3ListResult struct {
+	XMLName     xml.Name      `xml:"ListBucketResult"`
+	Name        string        `xml:"Name"`
+	Prefix      string        `xml:"Prefix"`
+	KeyCount    int           `xml:"KeyCount"`
+	IsTruncated bool          `xml:"IsTruncated"`
+	Contents    []*s3Contents `xml:"Contents"`
+}
+
+type s3InitiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteRequest struct {
+	Parts []struct {
+		PartNumber int `xml:"PartNumber"`
+	} `xml:"Part"`
+}
+
+type s3CompleteResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+func fakeETag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(data)) // nolint:gosec
+}
+
+func (f *fakeS3) writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	f.writeXML(w, status, &s3Error{Code: code, Message: code})
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+
+	query := r.URL.Query()
+	_, uploads := query["uploads"]
+	id := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodGet && len(key) == 0:
+		f.list(w, bucket, query.Get("prefix"))
+	case r.Method == http.MethodPost && uploads:
+		f.writeXML(w, http.StatusOK, &s3InitiateResult{
+			Bucket:   bucket,
+			Key:      key,
+			UploadID: f.store.newUpload(bucket, key),
+		})
+	case r.Method == http.MethodPut && len(id) > 0:
+		f.putPart(w, r, id, query.Get("partNumber"))
+	case r.Method == http.MethodPost && len(id) > 0:
+		f.complete(w, r, id)
+	case r.Method == http.MethodDelete && len(id) > 0:
+		if _, ok := f.store.removeUpload(id); !ok {
+			f.writeError(w, r, http.StatusNotFound, s3NoSuchUpload)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.store.put(bucket, key, data)
+		w.Header().Set("ETag", fakeETag(data))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.store.get(bucket, key)
+		if !ok {
+			f.writeError(w, r, http.StatusNotFound, s3NoSuchKey)
+			return
+		}
+		w.Header().Set("ETag", fakeETag(obj.data))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		f.store.serveObject(w, r, obj)
+	case r.Method == http.MethodDelete:
+		f.store.delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, prefix string) {
+	result := &s3ListResult{Name: bucket, Prefix: prefix}
+	for _, name := range f.store.list(bucket, prefix) {
+		if obj, ok := f.store.get(bucket, name); ok {
+			result.Contents = append(result.Contents, &s3Contents{
+				Key:          name,
+				Size:         int64(len(obj.data)),
+				LastModified: obj.updated,
+				ETag:         fakeETag(obj.data),
+			})
+		}
+	}
+	result.KeyCount = len(result.Contents)
+
+	f.writeXML(w, http.StatusOK, result)
+}
+
+// readS3Body returns the body of r, decoding the chunks of
+// bodies signed with a streaming signature (which minio-go
+// uses for requests of a known size over plain HTTP).
+func readS3Body(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	// Each chunk is "<hex size>;chunk-signature=<sig>\r\n<data>\r\n"
+	// and the body ends with an empty chunk
+	br := bufio.NewReader(r.Body)
+	var data []byte
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64) // nolint:gomnd
+		if err != nil {
+			return nil, err
+		}
+
+		chunk := make([]byte, size+2) // nolint:gomnd
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func (f *fakeS3) putPart(w http.ResponseWriter, r *http.Request, id string, partNumber string) {
+	number, err := strconv.Atoi(partNumber)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := readS3Body(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !f.store.withUpload(id, func(u *fakeUpload) {
+		u.parts[number] = data
+	}) {
+		f.writeError(w, r, http.StatusNotFound, s3NoSuchUpload)
+		return
+	}
+
+	w.Header().Set("ETag", fakeETag(data))
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, r *http.Request, id string) {
+	req := &s3CompleteRequest{}
+	if err := xml.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u, ok := f.store.removeUpload(id)
+	if !ok {
+		f.writeError(w, r, http.StatusNotFound, s3NoSuchUpload)
+		return
+	}
+
+	data := []byte{}
+	for _, part := range req.Parts {
+		data = append(data, u.parts[part.PartNumber]...)
+	}
+	f.store.put(u.bucket, u.name, data)
+
+	f.writeXML(w, http.StatusOK, &s3CompleteResult{
+		Bucket: u.bucket,
+		Key:    u.name,
+		ETag:   fakeETag(data),
+	})
+}
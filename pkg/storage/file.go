@@ -0,0 +1,424 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	fileScheme = "file"
+
+	// tmpMarker is included in the name of all partially
+	// written objects so they can be skipped when listing.
+	tmpMarker = ".tmp-"
+
+	objectPerm    = 0600
+	directoryPerm = 0700
+)
+
+// FileBackend is a Backend that stores objects in a
+// local directory (ex: a mounted USB drive or NAS share).
+type FileBackend struct {
+	root string
+}
+
+// NewFileBackend returns a new *FileBackend that stores
+// all objects under root.
+func NewFileBackend(root string) (*FileBackend, error) {
+	if len(root) == 0 {
+		return nil, errors.New("file root cannot be empty")
+	}
+
+	return &FileBackend{root: root}, nil
+}
+
+// checkName ensures name cannot escape the root of
+// a destination.
+func checkName(name string) error {
+	cleaned := filepath.ToSlash(filepath.Clean(filepath.FromSlash(name)))
+	if filepath.IsAbs(name) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("invalid object name %s", name)
+	}
+
+	return nil
+}
+
+// isTemporary returns true if name is a partially
+// written object.
+func isTemporary(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") && strings.Contains(base, tmpMarker)
+}
+
+func (b *FileBackend) path(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(b.root, filepath.FromSlash(name)), nil
+}
+
+// Put writes the contents of r to name. The object is first
+// written to a temporary file in the same directory and then
+// renamed into place, so a partially written object is never
+// visible under name.
+func (b *FileBackend) Put(ctx context.Context, name string, r io.Reader) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, directoryPerm); err != nil {
+		return fmt.Errorf("%w: unable to create directory %s", err, dir)
+	}
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(p)+tmpMarker)
+	if err != nil {
+		return fmt.Errorf("%w: unable to create temporary file in %s", err, dir)
+	}
+	tmpPath := f.Name()
+
+	if err := writeTemporary(ctx, f, r); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return rename(tmpPath, p)
+}
+
+// rename moves the temporary file at tmpPath to p. tmpPath
+// is removed if it cannot be renamed.
+func rename(tmpPath string, p string) error {
+	if err := os.Rename(tmpPath, p); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("%w: unable to rename %s to %s", err, tmpPath, p)
+	}
+
+	// Persist the rename itself. Not all platforms support
+	// syncing a directory, so this is best effort.
+	if d, err := os.Open(filepath.Dir(p)); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
+	return nil
+}
+
+// writeTemporary copies r into f and flushes f to stable
+// storage. f is always closed.
+func writeTemporary(ctx context.Context, f *os.File, r io.Reader) error {
+	defer f.Close()
+
+	if _, err := io.Copy(f, &contextReader{ctx: ctx, r: r}); err != nil {
+		return fmt.Errorf("%w: unable to write %s", err, f.Name())
+	}
+
+	if err := f.Chmod(objectPerm); err != nil {
+		return fmt.Errorf("%w: unable to set permissions of %s", err, f.Name())
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("%w: unable to sync %s", err, f.Name())
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: unable to close %s", err, f.Name())
+	}
+
+	return nil
+}
+
+// Get returns a reader over the contents of name.
+func (b *FileBackend) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to open %s", err, p)
+	}
+
+	return f, nil
+}
+
+// GetRange returns a reader over length bytes of name
+// starting at offset.
+func (b *FileBackend) GetRange(
+	ctx context.Context,
+	name string,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
+	rc, err := b.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := rc.(*os.File).Seek(offset, io.SeekStart); err != nil {
+		_ = rc.Close()
+		return nil, fmt.Errorf("%w: unable to seek to %d in %s", err, offset, name)
+	}
+
+	return limitReadCloser(rc, length), nil
+}
+
+// Stat returns the metadata of name.
+func (b *FileBackend) Stat(ctx context.Context, name string) (*Object, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to stat %s", err, p)
+	}
+
+	return &Object{
+		Name:    name,
+		Size:    info.Size(),
+		Updated: info.ModTime(),
+	}, nil
+}
+
+// List returns all objects with a name starting with prefix.
+func (b *FileBackend) List(ctx context.Context, prefix string) ([]*Object, error) {
+	objects := []*Object{}
+	err := filepath.Walk(b.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == b.root {
+				return filepath.SkipDir
+			}
+
+			return err
+		}
+
+		if info.IsDir() || isTemporary(p) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.root, p)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		objects = append(objects, &Object{
+			Name:    name,
+			Size:    info.Size(),
+			Updated: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to list %s", err, b.root)
+	}
+
+	return objects, nil
+}
+
+// Delete removes name.
+func (b *FileBackend) Delete(ctx context.Context, name string) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: unable to remove %s", err, p)
+	}
+
+	return nil
+}
+
+// CreateMultipart starts a multipart upload of name. Parts
+// are written directly into a temporary file at their offset.
+func (b *FileBackend) CreateMultipart(ctx context.Context, name string) (string, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, directoryPerm); err != nil {
+		return "", fmt.Errorf("%w: unable to create directory %s", err, dir)
+	}
+
+	tmpPath := filepath.Join(dir, multipartBase(filepath.Base(p), id))
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, objectPerm)
+	if err != nil {
+		return "", fmt.Errorf("%w: unable to create %s", err, tmpPath)
+	}
+
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("%w: unable to close %s", err, tmpPath)
+	}
+
+	return id, nil
+}
+
+// openMultipart opens the temporary file of upload id.
+func (b *FileBackend) openMultipart(name string, id string) (*os.File, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(p), multipartBase(filepath.Base(p), id))
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY, objectPerm)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to open %s", err, tmpPath)
+	}
+
+	return f, nil
+}
+
+// PutPart writes the contents of r at part.Offset in the
+// temporary file of upload id.
+func (b *FileBackend) PutPart(
+	ctx context.Context,
+	name string,
+	id string,
+	part *Part,
+	r io.Reader,
+) (string, error) {
+	f, err := b.openMultipart(name, id)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := writePart(ctx, f, part, r); err != nil {
+		return "", err
+	}
+
+	if err := f.Sync(); err != nil {
+		return "", fmt.Errorf("%w: unable to sync %s", err, f.Name())
+	}
+
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("%w: unable to close %s", err, f.Name())
+	}
+
+	return "", nil
+}
+
+// CompleteMultipart truncates the temporary file of upload id
+// to the end of the last part and renames it to name.
+func (b *FileBackend) CompleteMultipart(ctx context.Context, name string, id string, parts []*Part) error {
+	f, err := b.openMultipart(name, id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var size int64
+	if len(parts) > 0 {
+		last := parts[len(parts)-1]
+		size = last.Offset + last.Size
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("%w: unable to truncate %s", err, f.Name())
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("%w: unable to sync %s", err, f.Name())
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: unable to close %s", err, f.Name())
+	}
+
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+
+	return rename(f.Name(), p)
+}
+
+// AbortMultipart removes the temporary file of upload id.
+func (b *FileBackend) AbortMultipart(ctx context.Context, name string, id string) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(p), multipartBase(filepath.Base(p), id))
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%w: unable to remove %s", err, tmpPath)
+	}
+
+	return nil
+}
+
+// Close is a no-op for a *FileBackend.
+func (b *FileBackend) Close() error {
+	return nil
+}
+
+// contextReader stops reading from r once ctx
+// is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(p)
+}
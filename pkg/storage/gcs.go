@@ -0,0 +1,272 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// gcsMaxComposeSources is the maximum number of objects
+// that can be composed in a single request.
+const gcsMaxComposeSources = 32
+
+// GCSBackend is a Backend that stores objects
+// in Google Cloud Storage.
+type GCSBackend struct {
+	client *storage.Client
+	bucket string
+	prefix string
+}
+
+// NewGCSBackend returns a new *GCSBackend for bucket. All
+// objects are stored under prefix. opts are passed to the
+// underlying storage client (ex: to use a different
+// endpoint).
+func NewGCSBackend(
+	ctx context.Context,
+	bucket string,
+	prefix string,
+	opts ...option.ClientOption,
+) (*GCSBackend, error) {
+	if len(bucket) == 0 {
+		return nil, errors.New("gcs bucket cannot be empty")
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not create new storage client", err)
+	}
+
+	return &GCSBackend{
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+	}, nil
+}
+
+func (b *GCSBackend) object(name string) *storage.ObjectHandle {
+	return b.client.Bucket(b.bucket).Object(objectName(b.prefix, name))
+}
+
+// Put writes the contents of r to name.
+func (b *GCSBackend) Put(ctx context.Context, name string, r io.Reader) error {
+	// Canceling the context before closing the writer
+	// discards the upload instead of committing a partial
+	// object.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wc := b.object(name).NewWriter(ctx)
+	if _, err := io.Copy(wc, r); err != nil {
+		cancel()
+		_ = wc.Close()
+		return fmt.Errorf("%w: io.Copy", err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("%w: Writer.Close", err)
+	}
+
+	return nil
+}
+
+// Get returns a reader over the contents of name.
+func (b *GCSBackend) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.object(name).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: Object(%q).NewReader", err, name)
+	}
+
+	return rc, nil
+}
+
+// GetRange returns a reader over length bytes of name
+// starting at offset.
+func (b *GCSBackend) GetRange(
+	ctx context.Context,
+	name string,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
+	rc, err := b.object(name).NewRangeReader(ctx, offset, length)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: Object(%q).NewRangeReader", err, name)
+	}
+
+	return rc, nil
+}
+
+// Stat returns the metadata of name.
+func (b *GCSBackend) Stat(ctx context.Context, name string) (*Object, error) {
+	attrs, err := b.object(name).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: Object(%q).Attrs", err, name)
+	}
+
+	return &Object{
+		Name:    name,
+		Size:    attrs.Size,
+		Updated: attrs.Updated,
+	}, nil
+}
+
+// List returns all objects with a name starting with prefix.
+func (b *GCSBackend) List(ctx context.Context, prefix string) ([]*Object, error) {
+	it := b.client.Bucket(b.bucket).Objects(ctx, &storage.Query{
+		Prefix: objectName(b.prefix, prefix),
+	})
+
+	objects := []*Object{}
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: unable to list objects", err)
+		}
+
+		// Skip the parts of incomplete multipart uploads.
+		if isTemporary(attrs.Name) {
+			continue
+		}
+
+		objects = append(objects, &Object{
+			Name:    relativeName(b.prefix, attrs.Name),
+			Size:    attrs.Size,
+			Updated: attrs.Updated,
+		})
+	}
+
+	return objects, nil
+}
+
+// Delete removes name.
+func (b *GCSBackend) Delete(ctx context.Context, name string) error {
+	err := b.object(name).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: Object(%q).Delete", err, name)
+	}
+
+	return nil
+}
+
+// CreateMultipart starts a multipart upload of name. Each
+// part is stored as a temporary object until the upload is
+// completed.
+func (b *GCSBackend) CreateMultipart(ctx context.Context, name string) (string, error) {
+	return newUploadID()
+}
+
+// partName returns the name of the temporary object
+// holding number of upload id.
+func partName(name string, id string, number int) string {
+	return fmt.Sprintf("%s-%05d", multipartName(name, id), number)
+}
+
+// PutPart stores part of upload id as a temporary object.
+func (b *GCSBackend) PutPart(
+	ctx context.Context,
+	name string,
+	id string,
+	part *Part,
+	r io.Reader,
+) (string, error) {
+	if err := b.Put(ctx, partName(name, id, part.Number), io.LimitReader(r, part.Size)); err != nil {
+		return "", err
+	}
+
+	return "", nil
+}
+
+// CompleteMultipart composes parts into name and then removes
+// them. GCS limits the number of sources of a compose request,
+// so large uploads are composed incrementally.
+func (b *GCSBackend) CompleteMultipart(ctx context.Context, name string, id string, parts []*Part) error {
+	accumulator := b.object(multipartName(name, id) + "-composed")
+	var composed bool
+	for start := 0; start < len(parts) || !composed; {
+		srcs := []*storage.ObjectHandle{}
+		if composed {
+			srcs = append(srcs, accumulator)
+		}
+
+		for ; start < len(parts) && len(srcs) < gcsMaxComposeSources; start++ {
+			srcs = append(srcs, b.object(partName(name, id, parts[start].Number)))
+		}
+
+		dst := accumulator
+		if start == len(parts) {
+			dst = b.object(name)
+		}
+
+		if _, err := dst.ComposerFrom(srcs...).Run(ctx); err != nil {
+			return fmt.Errorf("%w: unable to compose %s", err, name)
+		}
+		composed = true
+	}
+
+	return b.AbortMultipart(ctx, name, id)
+}
+
+// AbortMultipart removes all temporary objects of upload id.
+func (b *GCSBackend) AbortMultipart(ctx context.Context, name string, id string) error {
+	it := b.client.Bucket(b.bucket).Objects(ctx, &storage.Query{
+		Prefix: objectName(b.prefix, multipartName(name, id)),
+	})
+
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: unable to list parts of %s", err, name)
+		}
+
+		err = b.client.Bucket(b.bucket).Object(attrs.Name).Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("%w: unable to delete %s", err, attrs.Name)
+		}
+	}
+}
+
+// Close closes the underlying storage client.
+func (b *GCSBackend) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+)
+
+// uploadIDLength is the number of random bytes in the
+// ID of a multipart upload created by snowplow.
+const uploadIDLength = 16
+
+// ErrUploadNotFound is returned by a MultipartBackend when
+// a multipart upload no longer exists (ex: it expired or
+// its temporary data was removed).
+var ErrUploadNotFound = errors.New("multipart upload not found")
+
+// Part describes a part of a multipart upload.
+type Part struct {
+	// Number is the position of the part (starting at 1).
+	Number int
+
+	// Offset is the position of the first byte of the
+	// part in the assembled object.
+	Offset int64
+
+	// Size is the number of bytes in the part.
+	Size int64
+
+	// ETag identifies the stored part (only set by
+	// some backends).
+	ETag string
+}
+
+// MultipartBackend is a Backend that can assemble an object
+// from parts uploaded independently, which allows interrupted
+// uploads to be resumed. Parts are not visible under the name
+// of the object until CompleteMultipart is called.
+type MultipartBackend interface {
+	Backend
+
+	// CreateMultipart starts a multipart upload of name and
+	// returns its ID.
+	CreateMultipart(ctx context.Context, name string) (string, error)
+
+	// PutPart stores the contents of r as part of upload id,
+	// replacing any part with the same number. The ETag of
+	// the stored part is returned.
+	PutPart(ctx context.Context, name string, id string, part *Part, r io.Reader) (string, error)
+
+	// CompleteMultipart assembles parts (in order) into name.
+	CompleteMultipart(ctx context.Context, name string, id string, parts []*Part) error
+
+	// AbortMultipart discards upload id and all of its parts.
+	AbortMultipart(ctx context.Context, name string, id string) error
+}
+
+// newUploadID returns a random multipart upload ID.
+func newUploadID() (string, error) {
+	b := make([]byte, uploadIDLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("%w: could not generate upload ID", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// multipartBase returns the base name of the temporary object
+// used by upload id of an object with base name base. Like all
+// temporary objects, it is skipped when listing.
+func multipartBase(base string, id string) string {
+	return fmt.Sprintf(".%s%smultipart-%s", base, tmpMarker, id)
+}
+
+// multipartName returns the slash-separated name of the
+// temporary object used by upload id of name.
+func multipartName(name string, id string) string {
+	return path.Join(path.Dir(name), multipartBase(path.Base(name), id))
+}
+
+// limitedReadCloser limits the number of bytes read from
+// an io.ReadCloser.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// limitReadCloser returns rc limited to length bytes (or
+// rc if length is negative).
+func limitReadCloser(rc io.ReadCloser, length int64) io.ReadCloser {
+	if length < 0 {
+		return rc
+	}
+
+	return &limitedReadCloser{Reader: io.LimitReader(rc, length), Closer: rc}
+}
+
+// writePart copies part.Size bytes from r to w at part.Offset.
+func writePart(ctx context.Context, w io.WriteSeeker, part *Part, r io.Reader) error {
+	if _, err := w.Seek(part.Offset, io.SeekStart); err != nil {
+		return fmt.Errorf("%w: unable to seek to %d", err, part.Offset)
+	}
+
+	n, err := io.CopyN(w, &contextReader{ctx: ctx, r: r}, part.Size)
+	if err != nil {
+		return fmt.Errorf("%w: only wrote %d of %d bytes of part %d", err, n, part.Size, part.Number)
+	}
+
+	return nil
+}
@@ -0,0 +1,462 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/spf13/viper"
+)
+
+const (
+	s3Scheme = "s3"
+
+	defaultS3Endpoint = "s3.amazonaws.com"
+
+	// s3NoSuchKey is the error code returned by
+	// S3-compatible servers for missing objects.
+	s3NoSuchKey = "NoSuchKey"
+
+	// s3NoSuchUpload is the error code returned by
+	// S3-compatible servers for missing multipart uploads.
+	s3NoSuchUpload = "NoSuchUpload"
+
+	mebibyte = 1024 * 1024
+
+	// defaultS3PartSize is the size of each part of a
+	// multipart upload if S3Config.PartSize is 0. Without an
+	// explicit part size, the client derives it from the
+	// maximum object size (5 TiB / 10,000 parts) because the
+	// size of each upload is unknown.
+	defaultS3PartSize = 128 * mebibyte
+
+	// minS3PartSize is the minimum size of each part (except
+	// the last) of a multipart upload.
+	minS3PartSize = 5 * mebibyte
+
+	// s3SinglePutSize is the size below which objects are
+	// buffered and written with a single request instead of
+	// a multipart upload.
+	s3SinglePutSize = minS3PartSize
+)
+
+// S3Config configures an S3-compatible endpoint.
+type S3Config struct {
+	// Endpoint is the host (and optional port) of the
+	// S3-compatible server (ex: s3.amazonaws.com or
+	// localhost:9000).
+	Endpoint string
+
+	// Region is the region of the bucket. If empty, the
+	// region is discovered from the server.
+	Region string
+
+	// PathStyle forces path-style addressing
+	// (endpoint/bucket/object) instead of virtual-hosted
+	// style addressing (bucket.endpoint/object), which is
+	// required by most MinIO deployments.
+	PathStyle bool
+
+	// Insecure disables TLS.
+	Insecure bool
+
+	// PartSize is the size of each part of a multipart
+	// upload. Each upload holds one part in memory, so this
+	// bounds the memory used by each upload. If 0,
+	// defaultS3PartSize (128 MiB) is used.
+	PartSize uint64
+
+	// AccessKeyID and SecretAccessKey are static credentials
+	// to use instead of the environment, the shared AWS
+	// credentials file or the instance metadata service.
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// loadS3Config populates a *S3Config from the s3 section of the
+// config file, overridden by any query parameters present in
+// the destination (ex: s3://bucket/prefix?endpoint=localhost:9000&path-style=true).
+func loadS3Config(query url.Values) (*S3Config, error) {
+	config := &S3Config{
+		Endpoint:        viper.GetString("s3.endpoint"),
+		Region:          viper.GetString("s3.region"),
+		PathStyle:       viper.GetBool("s3.pathStyle"),
+		Insecure:        viper.GetBool("s3.insecure"),
+		PartSize:        uint64(viper.GetInt64("s3.partSizeMiB")) * mebibyte,
+		AccessKeyID:     viper.GetString("s3.accessKeyID"),
+		SecretAccessKey: viper.GetString("s3.secretAccessKey"),
+	}
+
+	if v := query.Get("endpoint"); len(v) > 0 {
+		config.Endpoint = v
+	}
+
+	if v := query.Get("region"); len(v) > 0 {
+		config.Region = v
+	}
+
+	if v := query.Get("path-style"); len(v) > 0 {
+		pathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid path-style %s", err, v)
+		}
+		config.PathStyle = pathStyle
+	}
+
+	if v := query.Get("insecure"); len(v) > 0 {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid insecure %s", err, v)
+		}
+		config.Insecure = insecure
+	}
+
+	if v := query.Get("part-size-mib"); len(v) > 0 {
+		partSize, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid part-size-mib %s", err, v)
+		}
+		config.PartSize = partSize * mebibyte
+	}
+
+	if len(config.Endpoint) == 0 {
+		config.Endpoint = defaultS3Endpoint
+	}
+
+	return config, nil
+}
+
+// S3Backend is a Backend that stores objects in
+// Amazon S3 or any S3-compatible server (ex: MinIO).
+type S3Backend struct {
+	client   *minio.Client
+	core     *minio.Core
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+// NewS3Backend returns a new *S3Backend for bucket. All
+// objects are stored under prefix.
+func NewS3Backend(bucket string, prefix string, config *S3Config) (*S3Backend, error) {
+	if len(bucket) == 0 {
+		return nil, errors.New("s3 bucket cannot be empty")
+	}
+
+	// Check if the part size is supported (the part size is
+	// always passed explicitly so the memory used by each
+	// upload is bounded)
+	partSize := config.PartSize
+	if partSize == 0 {
+		partSize = defaultS3PartSize
+	}
+	if partSize < minS3PartSize {
+		return nil, fmt.Errorf("s3 part size must be at least %d MiB", minS3PartSize/mebibyte)
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+	})
+	if len(config.AccessKeyID) > 0 {
+		creds = credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, "")
+	}
+
+	lookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       !config.Insecure,
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not create s3 client", err)
+	}
+
+	return &S3Backend{
+		client:   client,
+		core:     &minio.Core{Client: client},
+		bucket:   bucket,
+		prefix:   prefix,
+		partSize: partSize,
+	}, nil
+}
+
+// wrapS3Error converts S3 missing object and upload
+// errors into ErrObjectNotFound and ErrUploadNotFound.
+func wrapS3Error(err error, name string, op string) error {
+	switch minio.ToErrorResponse(err).Code {
+	case s3NoSuchKey:
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	case s3NoSuchUpload:
+		return fmt.Errorf("%w: %s", ErrUploadNotFound, name)
+	}
+
+	return fmt.Errorf("%w: %s(%q)", err, op, name)
+}
+
+// Put writes the contents of r to name. Objects smaller than
+// s3SinglePutSize (ex: checksums and manifests) are buffered
+// and written with a single request. Because the size of
+// larger objects is not known ahead of time, they are written
+// using a multipart upload (which holds a part in memory).
+func (b *S3Backend) Put(ctx context.Context, name string, r io.Reader) error {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, s3SinglePutSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: could not read %s", err, name)
+	}
+
+	// Check if the entire object was buffered
+	body := io.MultiReader(&buf, r)
+	size := int64(-1)
+	if n < s3SinglePutSize {
+		body = &buf
+		size = n
+	}
+
+	if _, err := b.client.PutObject(
+		ctx,
+		b.bucket,
+		objectName(b.prefix, name),
+		body,
+		size,
+		minio.PutObjectOptions{
+			PartSize:    b.partSize,
+			ContentType: "application/octet-stream",
+		},
+	); err != nil {
+		return fmt.Errorf("%w: PutObject(%q)", err, name)
+	}
+
+	return nil
+}
+
+// Get returns a reader over the contents of name.
+func (b *S3Backend) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	obj, err := b.client.GetObject(ctx, b.bucket, objectName(b.prefix, name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, wrapS3Error(err, name, "GetObject")
+	}
+
+	// GetObject is lazy, so we must stat the object to
+	// surface any errors before the first read.
+	if _, err := obj.Stat(); err != nil {
+		_ = obj.Close()
+		return nil, wrapS3Error(err, name, "GetObject")
+	}
+
+	return obj, nil
+}
+
+// GetRange returns a reader over length bytes of name
+// starting at offset.
+func (b *S3Backend) GetRange(
+	ctx context.Context,
+	name string,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
+	// S3 cannot return an empty range, so we only
+	// ensure the object exists.
+	if length == 0 {
+		if _, err := b.Stat(ctx, name); err != nil {
+			return nil, err
+		}
+
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+
+	opts := minio.GetObjectOptions{}
+	var err error
+	switch {
+	case length > 0:
+		err = opts.SetRange(offset, offset+length-1)
+	case offset > 0:
+		err = opts.SetRange(offset, 0) // read until the end
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid range of %s", err, name)
+	}
+
+	rc, _, _, err := b.core.GetObject(ctx, b.bucket, objectName(b.prefix, name), opts)
+	if err != nil {
+		return nil, wrapS3Error(err, name, "GetObject")
+	}
+
+	return limitReadCloser(rc, length), nil
+}
+
+// Stat returns the metadata of name.
+func (b *S3Backend) Stat(ctx context.Context, name string) (*Object, error) {
+	info, err := b.client.StatObject(ctx, b.bucket, objectName(b.prefix, name), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, wrapS3Error(err, name, "StatObject")
+	}
+
+	return &Object{
+		Name:    name,
+		Size:    info.Size,
+		Updated: info.LastModified,
+	}, nil
+}
+
+// List returns all objects with a name starting with prefix.
+func (b *S3Backend) List(ctx context.Context, prefix string) ([]*Object, error) {
+	objects := []*Object{}
+	for info := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{
+		Prefix:    objectName(b.prefix, prefix),
+		Recursive: true,
+	}) {
+		if info.Err != nil {
+			return nil, fmt.Errorf("%w: unable to list objects", info.Err)
+		}
+
+		// Skip directory markers and common prefixes.
+		if strings.HasSuffix(info.Key, "/") {
+			continue
+		}
+
+		objects = append(objects, &Object{
+			Name:    relativeName(b.prefix, info.Key),
+			Size:    info.Size,
+			Updated: info.LastModified,
+		})
+	}
+
+	return objects, nil
+}
+
+// Delete removes name.
+func (b *S3Backend) Delete(ctx context.Context, name string) error {
+	if err := b.client.RemoveObject(
+		ctx,
+		b.bucket,
+		objectName(b.prefix, name),
+		minio.RemoveObjectOptions{},
+	); err != nil {
+		return wrapS3Error(err, name, "RemoveObject")
+	}
+
+	return nil
+}
+
+// CreateMultipart starts a native S3 multipart upload of name.
+func (b *S3Backend) CreateMultipart(ctx context.Context, name string) (string, error) {
+	id, err := b.core.NewMultipartUpload(
+		ctx,
+		b.bucket,
+		objectName(b.prefix, name),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"},
+	)
+	if err != nil {
+		return "", wrapS3Error(err, name, "NewMultipartUpload")
+	}
+
+	return id, nil
+}
+
+// PutPart uploads part of upload id. All parts except the
+// last must be at least 5 MiB.
+func (b *S3Backend) PutPart(
+	ctx context.Context,
+	name string,
+	id string,
+	part *Part,
+	r io.Reader,
+) (string, error) {
+	info, err := b.core.PutObjectPart(
+		ctx,
+		b.bucket,
+		objectName(b.prefix, name),
+		id,
+		part.Number,
+		r,
+		part.Size,
+		"",
+		"",
+		nil,
+	)
+	if err != nil {
+		return "", wrapS3Error(err, name, "PutObjectPart")
+	}
+
+	return info.ETag, nil
+}
+
+// CompleteMultipart assembles parts into name.
+func (b *S3Backend) CompleteMultipart(ctx context.Context, name string, id string, parts []*Part) error {
+	completeParts := make([]minio.CompletePart, len(parts))
+	for i, part := range parts {
+		completeParts[i] = minio.CompletePart{
+			PartNumber: part.Number,
+			ETag:       part.ETag,
+		}
+	}
+
+	if _, err := b.core.CompleteMultipartUpload(
+		ctx,
+		b.bucket,
+		objectName(b.prefix, name),
+		id,
+		completeParts,
+	); err != nil {
+		return wrapS3Error(err, name, "CompleteMultipartUpload")
+	}
+
+	return nil
+}
+
+// AbortMultipart discards upload id.
+func (b *S3Backend) AbortMultipart(ctx context.Context, name string, id string) error {
+	if err := b.core.AbortMultipartUpload(
+		ctx,
+		b.bucket,
+		objectName(b.prefix, name),
+		id,
+	); err != nil {
+		return wrapS3Error(err, name, "AbortMultipartUpload")
+	}
+
+	return nil
+}
+
+// Close is a no-op because the S3 client does not
+// hold any long-lived connections.
+func (b *S3Backend) Close() error {
+	return nil
+}
@@ -0,0 +1,523 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sftpScheme = "sftp"
+
+	defaultSFTPPort = "22"
+)
+
+// SFTPConfig configures how a *SFTPBackend authenticates
+// with a server.
+type SFTPConfig struct {
+	// IdentityFile is the path of an unencrypted private key.
+	// If empty, keys are loaded from the running ssh-agent
+	// (SSH_AUTH_SOCK).
+	IdentityFile string
+
+	// KnownHostsFile is the path of the known_hosts file used
+	// to verify the server. Defaults to $HOME/.ssh/known_hosts.
+	KnownHostsFile string
+}
+
+// loadSFTPConfig populates a *SFTPConfig from the sftp section of the
+// config file, overridden by any query parameters present in
+// the destination (ex: sftp://user@nas/backups?identity=/root/.ssh/id_ed25519).
+func loadSFTPConfig(query url.Values) *SFTPConfig {
+	config := &SFTPConfig{
+		IdentityFile:   viper.GetString("sftp.identityFile"),
+		KnownHostsFile: viper.GetString("sftp.knownHostsFile"),
+	}
+
+	if v := query.Get("identity"); len(v) > 0 {
+		config.IdentityFile = v
+	}
+
+	if v := query.Get("known-hosts"); len(v) > 0 {
+		config.KnownHostsFile = v
+	}
+
+	if len(config.KnownHostsFile) == 0 {
+		config.KnownHostsFile = filepath.Join(os.ExpandEnv("$HOME"), ".ssh", "known_hosts")
+	}
+
+	return config
+}
+
+// SFTPBackend is a Backend that stores objects in a
+// directory on an SFTP server (ex: a home NAS).
+type SFTPBackend struct {
+	agentConn net.Conn
+	conn      *ssh.Client
+	client    *sftp.Client
+	root      string
+}
+
+// NewSFTPBackend returns a new *SFTPBackend that stores all
+// objects under root on the server at host (host[:port]).
+func NewSFTPBackend(
+	host string,
+	user *url.Userinfo,
+	root string,
+	config *SFTPConfig,
+) (*SFTPBackend, error) {
+	if len(host) == 0 {
+		return nil, errors.New("sftp host cannot be empty")
+	}
+
+	if user == nil || len(user.Username()) == 0 {
+		return nil, errors.New("sftp user cannot be empty")
+	}
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, defaultSFTPPort)
+	}
+
+	hostKeyCallback, err := knownhosts.New(config.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to load known hosts %s", err, config.KnownHostsFile)
+	}
+
+	b := &SFTPBackend{root: root}
+	methods, err := b.authMethods(user, config)
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+
+	b.conn, err = ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            user.Username(),
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		_ = b.Close()
+		return nil, fmt.Errorf("%w: unable to connect to %s", err, host)
+	}
+
+	b.client, err = sftp.NewClient(b.conn)
+	if err != nil {
+		_ = b.Close()
+		return nil, fmt.Errorf("%w: unable to start sftp session", err)
+	}
+
+	return b, nil
+}
+
+// authMethods returns the ssh.AuthMethods available
+// for a connection.
+func (b *SFTPBackend) authMethods(user *url.Userinfo, config *SFTPConfig) ([]ssh.AuthMethod, error) {
+	methods := []ssh.AuthMethod{}
+	if len(config.IdentityFile) > 0 {
+		key, err := ioutil.ReadFile(config.IdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unable to read identity %s", err, config.IdentityFile)
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unable to parse identity %s", err, config.IdentityFile)
+		}
+
+		methods = append(methods, ssh.PublicKeys(signer))
+	} else if sock := os.Getenv("SSH_AUTH_SOCK"); len(sock) > 0 {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unable to connect to ssh-agent", err)
+		}
+
+		b.agentConn = conn
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if password, ok := user.Password(); ok {
+		methods = append(methods, ssh.Password(password))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("no sftp identity file, ssh-agent or password available")
+	}
+
+	return methods, nil
+}
+
+func (b *SFTPBackend) path(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+
+	return path.Join(b.root, name), nil
+}
+
+// Put writes the contents of r to name. The object is first
+// written to a temporary file in the same directory and then
+// renamed into place, so a partially written object is never
+// visible under name.
+func (b *SFTPBackend) Put(ctx context.Context, name string, r io.Reader) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+
+	dir := path.Dir(p)
+	if err := b.client.MkdirAll(dir); err != nil {
+		return fmt.Errorf("%w: unable to create directory %s", err, dir)
+	}
+
+	tmpPath := path.Join(dir, fmt.Sprintf(
+		".%s%s%d-%d",
+		path.Base(p),
+		tmpMarker,
+		os.Getpid(),
+		time.Now().UnixNano(),
+	))
+	if err := b.writeTemporary(ctx, tmpPath, r); err != nil {
+		_ = b.client.Remove(tmpPath)
+		return err
+	}
+
+	return b.rename(tmpPath, p)
+}
+
+// rename moves the temporary file at tmpPath to p. tmpPath
+// is removed if it cannot be renamed.
+func (b *SFTPBackend) rename(tmpPath string, p string) error {
+	// posix-rename@openssh.com atomically replaces any existing
+	// object. Servers without the extension cannot rename over
+	// an existing file, so we fall back to removing it first.
+	if err := b.client.PosixRename(tmpPath, p); err != nil {
+		_ = b.client.Remove(p)
+		if err := b.client.Rename(tmpPath, p); err != nil {
+			_ = b.client.Remove(tmpPath)
+			return fmt.Errorf("%w: unable to rename %s to %s", err, tmpPath, p)
+		}
+	}
+
+	return nil
+}
+
+// writeTemporary copies r into a new file at tmpPath.
+func (b *SFTPBackend) writeTemporary(ctx context.Context, tmpPath string, r io.Reader) error {
+	f, err := b.client.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("%w: unable to create %s", err, tmpPath)
+	}
+	defer f.Close()
+
+	if err := f.Chmod(objectPerm); err != nil {
+		return fmt.Errorf("%w: unable to set permissions of %s", err, tmpPath)
+	}
+
+	if _, err := io.Copy(f, &contextReader{ctx: ctx, r: r}); err != nil {
+		return fmt.Errorf("%w: unable to write %s", err, tmpPath)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: unable to close %s", err, tmpPath)
+	}
+
+	return nil
+}
+
+// isNotExist returns true if err indicates a
+// missing file on the server.
+func isNotExist(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, os.ErrNotExist)
+}
+
+// Get returns a reader over the contents of name.
+func (b *SFTPBackend) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := b.client.Open(p)
+	if isNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to open %s", err, p)
+	}
+
+	return f, nil
+}
+
+// GetRange returns a reader over length bytes of name
+// starting at offset.
+func (b *SFTPBackend) GetRange(
+	ctx context.Context,
+	name string,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
+	rc, err := b.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := rc.(*sftp.File).Seek(offset, io.SeekStart); err != nil {
+		_ = rc.Close()
+		return nil, fmt.Errorf("%w: unable to seek to %d in %s", err, offset, name)
+	}
+
+	return limitReadCloser(rc, length), nil
+}
+
+// Stat returns the metadata of name.
+func (b *SFTPBackend) Stat(ctx context.Context, name string) (*Object, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := b.client.Stat(p)
+	if isNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to stat %s", err, p)
+	}
+
+	return &Object{
+		Name:    name,
+		Size:    info.Size(),
+		Updated: info.ModTime(),
+	}, nil
+}
+
+// List returns all objects with a name starting with prefix.
+func (b *SFTPBackend) List(ctx context.Context, prefix string) ([]*Object, error) {
+	objects := []*Object{}
+	walker := b.client.Walk(b.root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if isNotExist(err) && walker.Path() == b.root {
+				break
+			}
+
+			return nil, fmt.Errorf("%w: unable to list %s", err, b.root)
+		}
+
+		info := walker.Stat()
+		if info.IsDir() || isTemporary(walker.Path()) {
+			continue
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), b.root), "/")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		objects = append(objects, &Object{
+			Name:    name,
+			Size:    info.Size(),
+			Updated: info.ModTime(),
+		})
+	}
+
+	return objects, nil
+}
+
+// Delete removes name.
+func (b *SFTPBackend) Delete(ctx context.Context, name string) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = b.client.Remove(p)
+	if isNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, name)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: unable to remove %s", err, p)
+	}
+
+	return nil
+}
+
+// CreateMultipart starts a multipart upload of name. Parts
+// are written directly into a temporary file at their offset.
+func (b *SFTPBackend) CreateMultipart(ctx context.Context, name string) (string, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	dir := path.Dir(p)
+	if err := b.client.MkdirAll(dir); err != nil {
+		return "", fmt.Errorf("%w: unable to create directory %s", err, dir)
+	}
+
+	tmpPath := multipartName(p, id)
+	f, err := b.client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return "", fmt.Errorf("%w: unable to create %s", err, tmpPath)
+	}
+	defer f.Close()
+
+	if err := f.Chmod(objectPerm); err != nil {
+		return "", fmt.Errorf("%w: unable to set permissions of %s", err, tmpPath)
+	}
+
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("%w: unable to close %s", err, tmpPath)
+	}
+
+	return id, nil
+}
+
+// openMultipart opens the temporary file of upload id.
+func (b *SFTPBackend) openMultipart(name string, id string) (*sftp.File, error) {
+	p, err := b.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := multipartName(p, id)
+	f, err := b.client.OpenFile(tmpPath, os.O_WRONLY)
+	if isNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to open %s", err, tmpPath)
+	}
+
+	return f, nil
+}
+
+// PutPart writes the contents of r at part.Offset in the
+// temporary file of upload id.
+func (b *SFTPBackend) PutPart(
+	ctx context.Context,
+	name string,
+	id string,
+	part *Part,
+	r io.Reader,
+) (string, error) {
+	f, err := b.openMultipart(name, id)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := writePart(ctx, f, part, r); err != nil {
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("%w: unable to close %s", err, f.Name())
+	}
+
+	return "", nil
+}
+
+// CompleteMultipart truncates the temporary file of upload id
+// to the end of the last part and renames it to name.
+func (b *SFTPBackend) CompleteMultipart(ctx context.Context, name string, id string, parts []*Part) error {
+	f, err := b.openMultipart(name, id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var size int64
+	if len(parts) > 0 {
+		last := parts[len(parts)-1]
+		size = last.Offset + last.Size
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("%w: unable to truncate %s", err, f.Name())
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: unable to close %s", err, f.Name())
+	}
+
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+
+	return b.rename(f.Name(), p)
+}
+
+// AbortMultipart removes the temporary file of upload id.
+func (b *SFTPBackend) AbortMultipart(ctx context.Context, name string, id string) error {
+	p, err := b.path(name)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := multipartName(p, id)
+	if err := b.client.Remove(tmpPath); err != nil && !isNotExist(err) {
+		return fmt.Errorf("%w: unable to remove %s", err, tmpPath)
+	}
+
+	return nil
+}
+
+// Close closes the sftp session and underlying
+// ssh connection.
+func (b *SFTPBackend) Close() error {
+	var err error
+	if b.client != nil {
+		err = b.client.Close()
+	}
+
+	if b.conn != nil {
+		_ = b.conn.Close()
+	}
+
+	if b.agentConn != nil {
+		_ = b.agentConn.Close()
+	}
+
+	return err
+}
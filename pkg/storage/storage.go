@@ -22,139 +22,307 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/cheggaaa/pb/v3"
 	"github.com/machinebox/progress"
-
-	"github.com/patrick-ogrady/snowplow/pkg/integrity"
 )
 
 const (
 	progressSleepTime = 10 * time.Millisecond
+
+	gcsScheme = "gs"
 )
 
-// Upload puts a specified file in a bucket with
-// a given name.
-func Upload(ctx context.Context, bucket string, name string) error {
-	// Open local file.
-	f, err := os.Open(name)
-	if err != nil {
-		return fmt.Errorf("%w: could not open file %s", err, name)
+// ErrObjectNotFound is returned by a Backend when
+// the requested object does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// Object describes an object held by a Backend.
+type Object struct {
+	Name    string
+	Size    int64
+	Updated time.Time
+}
+
+// Backend is an object store that backups can be
+// written to and read from. All names are relative
+// to the root of the destination the Backend was
+// created from.
+type Backend interface {
+	// Put writes the contents of r to name, replacing
+	// any existing object.
+	Put(ctx context.Context, name string, r io.Reader) error
+
+	// Get returns a reader over the contents of name.
+	// The caller must close the returned reader.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// GetRange returns a reader over length bytes of name
+	// starting at offset. If length is negative, the reader
+	// continues until the end of name. The caller must close
+	// the returned reader.
+	GetRange(ctx context.Context, name string, offset int64, length int64) (io.ReadCloser, error)
+
+	// Stat returns the metadata of name.
+	Stat(ctx context.Context, name string) (*Object, error)
+
+	// List returns all objects with a name starting
+	// with prefix.
+	List(ctx context.Context, prefix string) ([]*Object, error)
+
+	// Delete removes name.
+	Delete(ctx context.Context, name string) error
+
+	// Close releases any resources held by the Backend.
+	Close() error
+}
+
+// NewBackend returns the Backend for a URL-style destination
+// (ex: gs://bucket/prefix, s3://bucket/prefix, file:///mnt/backups
+// or sftp://user@host/backups). A destination without a scheme
+// is treated as the name of a Google Cloud Storage bucket.
+func NewBackend(ctx context.Context, destination string) (Backend, error) {
+	if !strings.Contains(destination, "://") {
+		return NewGCSBackend(ctx, destination, "")
 	}
-	defer f.Close()
 
-	fInfo, err := f.Stat()
+	u, err := url.Parse(destination)
 	if err != nil {
-		return fmt.Errorf("%w: unable to get file stats for %s", err, name)
+		return nil, fmt.Errorf("%w: could not parse destination %s", err, destination)
 	}
 
-	checksum, err := integrity.Checksum(f)
-	if err != nil {
-		return fmt.Errorf("%w: could not get checksum of credentials", err)
+	switch u.Scheme {
+	case gcsScheme:
+		return NewGCSBackend(ctx, u.Host, u.Path)
+	case s3Scheme:
+		config, err := loadS3Config(u.Query())
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not load s3 config", err)
+		}
+
+		return NewS3Backend(u.Host, u.Path, config)
+	case fileScheme:
+		return NewFileBackend(filepath.Join(u.Host, filepath.FromSlash(u.Path)))
+	case sftpScheme:
+		return NewSFTPBackend(u.Host, u.User, u.Path, loadSFTPConfig(u.Query()))
+	default:
+		return nil, fmt.Errorf("destination scheme %s is not supported", u.Scheme)
+	}
+}
+
+// objectName joins a destination prefix and a name into
+// the key used by the underlying store.
+func objectName(prefix string, name string) string {
+	prefix = strings.Trim(prefix, "/")
+	if len(prefix) == 0 {
+		return name
+	}
+
+	if len(name) == 0 {
+		return prefix + "/"
+	}
+
+	return path.Join(prefix, name)
+}
+
+// relativeName strips a destination prefix from a
+// key returned by the underlying store.
+func relativeName(prefix string, key string) string {
+	prefix = strings.Trim(prefix, "/")
+	if len(prefix) == 0 {
+		return key
 	}
 
+	return strings.TrimPrefix(key, prefix+"/")
+}
+
+// ChecksumSuffix is appended to the name of an object to
+// get the name of its checksum.
+const ChecksumSuffix = ".checksum"
+
+// ErrChecksumMismatch is returned by Download when the
+// downloaded object does not match its checksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// UploadResult describes an object written by Upload.
+type UploadResult struct {
+	// Checksum is the hex-encoded SHA256 checksum of
+	// the object.
+	Checksum string
+
+	// Size is the number of bytes in the object.
+	Size int64
+}
+
+// Upload streams the contents of r to name in a Backend and
+// then stores the checksum of everything read from r next to
+// it. The checksum is computed on the fly, so r is only read
+// once.
+func Upload(ctx context.Context, backend Backend, name string, r io.Reader) (*UploadResult, error) {
+	h := sha256.New()
+	return UploadWithChecksum(ctx, backend, name, io.TeeReader(r, h), func() string {
+		return fmt.Sprintf("%x", h.Sum(nil))
+	})
+}
+
+// UploadWithChecksum is like Upload, but the checksum is not
+// computed. Instead, checksum is called once r has been read
+// to EOF (ex: when the same stream is uploaded to several
+// backends and hashed once).
+func UploadWithChecksum(
+	ctx context.Context,
+	backend Backend,
+	name string,
+	r io.Reader,
+	checksum func() string,
+) (*UploadResult, error) {
+	counter := &countingWriter{}
+	if err := upload(
+		ctx,
+		backend,
+		name,
+		-1,
+		io.TeeReader(r, counter),
+	); err != nil {
+		return nil, err
+	}
+
+	// The checksum is only written once the object has been
+	// fully uploaded, so a partial upload never looks valid.
+	sum := checksum()
+	if err := WriteChecksum(ctx, backend, name, sum); err != nil {
+		return nil, err
+	}
+
+	return &UploadResult{Checksum: sum, Size: counter.n}, nil
+}
+
+// WriteChecksum stores the checksum of name next to it.
+func WriteChecksum(ctx context.Context, backend Backend, name string, checksum string) error {
 	if err := uploadString(
 		ctx,
-		bucket,
-		fmt.Sprintf("%s.checksum", name),
+		backend,
+		name+ChecksumSuffix,
 		checksum,
 	); err != nil {
 		return fmt.Errorf("%w: unable to upload checksum", err)
 	}
 
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("%w: unable to reset file pointer", err)
+	return nil
+}
+
+// ReadChecksum returns the checksum stored next to name.
+func ReadChecksum(ctx context.Context, backend Backend, name string) (string, error) {
+	checksum, err := downloadString(ctx, backend, name+ChecksumSuffix)
+	if err != nil {
+		return "", fmt.Errorf("%w: unable to download checksum", err)
 	}
 
-	return upload(ctx, bucket, name, fInfo.Size(), f)
+	return strings.TrimSpace(checksum), nil
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
 }
 
 // uploadString uploads a string to name.
-func uploadString(ctx context.Context, bucket string, name string, blob string) error {
+func uploadString(ctx context.Context, backend Backend, name string, blob string) error {
 	size := int64(len(blob))
-	return upload(ctx, bucket, name, size, bytes.NewReader([]byte(blob)))
+	return upload(ctx, backend, name, size, bytes.NewReader([]byte(blob)))
 }
 
-func logUploadProgress(ctx context.Context, name string, size int64, blob *progress.Reader) {
+// logProgress renders a progress bar for blob until the
+// returned function is called. If size is unknown (< 0),
+// only the number of bytes read is shown.
+func logProgress(action string, name string, size int64, blob *progress.Reader) func() {
+	fmt.Printf("%s %s...\n", action, name)
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
 	go func() {
-		fmt.Printf("uploading %s...\n", name)
+		defer close(finished)
 
-		bar := pb.Start64(size)
+		bar := pb.New64(size).Set(pb.Bytes, true)
 		bar.SetRefreshRate(progressSleepTime)
-		for ctx.Err() == nil && (size-blob.N()) > 0 {
+		bar.Start()
+		for {
 			bar.SetCurrent(blob.N())
-			time.Sleep(progressSleepTime)
+			select {
+			case <-done:
+				bar.SetCurrent(blob.N())
+				bar.Finish()
+				return
+			case <-time.After(progressSleepTime):
+			}
 		}
-		bar.SetCurrent(size)
-		bar.Finish()
 	}()
-}
 
-func upload(ctx context.Context, bucket string, name string, size int64, blob io.Reader) error {
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return fmt.Errorf("%w: could not create new storage client", err)
+	return func() {
+		close(done)
+		<-finished
 	}
-	defer client.Close()
+}
 
+func upload(ctx context.Context, backend Backend, name string, size int64, blob io.Reader) error {
 	blobProgress := progress.NewReader(blob)
-	logUploadProgress(ctx, name, size, blobProgress)
+	stop := logProgress("uploading", name, size, blobProgress)
+	defer stop()
 
-	// Upload an object with storage.Writer.
-	wc := client.Bucket(bucket).Object(name).NewWriter(ctx)
-	if _, err = io.Copy(wc, blobProgress); err != nil {
-		return fmt.Errorf("%w: io.Copy", err)
-	}
-	if err := wc.Close(); err != nil {
-		return fmt.Errorf("%w: Writer.Close", err)
+	if err := backend.Put(ctx, name, blobProgress); err != nil {
+		return fmt.Errorf("%w: unable to put %s", err, name)
 	}
 
 	return nil
 }
 
-// Download retrieves a file from a bucket with a
-// given name.
-func Download(ctx context.Context, bucket string, name string) error {
-	dChecksum, err := downloadString(
-		ctx,
-		bucket,
-		fmt.Sprintf("%s.checksum", name),
-	)
+// Download streams name from a Backend to w, verifying it
+// against its stored checksum. The checksum can only be
+// verified once the entire object has been read, so callers
+// must discard everything written to w if an error is
+// returned.
+func Download(ctx context.Context, backend Backend, name string, w io.Writer) error {
+	dChecksum, err := ReadChecksum(ctx, backend, name)
 	if err != nil {
-		return fmt.Errorf("%w: unable to download checksum", err)
+		return err
 	}
 
-	if err := downloadFile(ctx, bucket, name); err != nil {
+	h := sha256.New()
+	if err := download(ctx, backend, name, io.MultiWriter(w, h)); err != nil {
 		return fmt.Errorf("%w: unable to download %s", err, name)
 	}
 
-	f, err := os.Open(name)
-	if err != nil {
-		return fmt.Errorf("%w: could not open file %s", err, name)
-	}
-	defer f.Close()
-
-	checksum, err := integrity.Checksum(f)
-	if err != nil {
-		return fmt.Errorf("%w: could not get checksum of credentials", err)
-	}
-
+	checksum := fmt.Sprintf("%x", h.Sum(nil))
 	if checksum != dChecksum {
-		return fmt.Errorf("expected checksum %s but got %s", dChecksum, checksum)
+		return fmt.Errorf(
+			"%w: expected checksum %s but got %s",
+			ErrChecksumMismatch,
+			dChecksum,
+			checksum,
+		)
 	}
 
 	return nil
 }
 
 // downloadString downloads a string from name.
-func downloadString(ctx context.Context, bucket string, name string) (string, error) {
-	rc, err := download(ctx, bucket, name)
+func downloadString(ctx context.Context, backend Backend, name string) (string, error) {
+	rc, err := backend.Get(ctx, name)
 	if err != nil {
 		return "", fmt.Errorf("%w: unable to download %s", err, name)
 	}
@@ -162,63 +330,35 @@ func downloadString(ctx context.Context, bucket string, name string) (string, er
 
 	data, err := ioutil.ReadAll(rc)
 	if err != nil {
-		return "", fmt.Errorf("ioutil.ReadAll: %v", err)
+		return "", fmt.Errorf("%w: unable to read %s", err, name)
 	}
 
 	return string(data), nil
 }
 
-func logDownloadProgress(ctx context.Context, name string, rc *storage.Reader) {
-	go func() {
-		fmt.Printf("downloading %s...\n", name)
-
-		size := rc.Attrs.Size
-		bar := pb.Start64(size)
-		bar.SetRefreshRate(progressSleepTime)
-		for ctx.Err() == nil && rc.Remain() > 0 {
-			bar.SetCurrent(size - rc.Remain())
-			time.Sleep(progressSleepTime)
-		}
-		bar.SetCurrent(size)
-		bar.Finish()
-	}()
-}
+// download copies name to w without loading it all into
+// memory at once.
+func download(ctx context.Context, backend Backend, name string, w io.Writer) error {
+	obj, err := backend.Stat(ctx, name)
+	if err != nil {
+		return fmt.Errorf("%w: unable to stat %s", err, name)
+	}
 
-// downloadFile downloads a file from name without loading
-// it all into memory at once.
-func downloadFile(ctx context.Context, bucket string, name string) error {
-	rc, err := download(ctx, bucket, name)
+	rc, err := backend.Get(ctx, name)
 	if err != nil {
 		return fmt.Errorf("%w: unable to download %s", err, name)
 	}
 	defer rc.Close()
 
-	w, err := os.Create(name)
-	if err != nil {
-		return fmt.Errorf("%w: unable to create file %s", err, name)
-	}
-	defer w.Close()
+	rcProgress := progress.NewReader(rc)
+	stop := logProgress("downloading", name, obj.Size, rcProgress)
+	defer stop()
 
-	if _, err := io.Copy(w, rc); err != nil {
-		return fmt.Errorf("%w: unable to download to %s", err, name)
+	// Not every Backend stops reading when ctx is done (ex:
+	// FileBackend), so we stop between reads.
+	if _, err := io.Copy(w, &contextReader{ctx: ctx, r: rcProgress}); err != nil {
+		return fmt.Errorf("%w: unable to download %s", err, name)
 	}
 
 	return nil
 }
-
-// download is the core of the download process.
-func download(ctx context.Context, bucket string, name string) (*storage.Reader, error) {
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not create new storage client", err)
-	}
-	defer client.Close()
-
-	rc, err := client.Bucket(bucket).Object(name).NewReader(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("Object(%q).NewReader: %v", name, err)
-	}
-
-	logDownloadProgress(ctx, name, rc)
-	return rc, nil
-}
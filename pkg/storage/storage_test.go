@@ -0,0 +1,310 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBucket = "bucket"
+
+// testBackend is a Backend under test and the store that
+// holds its objects (nil if it is not served by a fake).
+type testBackend struct {
+	backend Backend
+	store   *fakeStore
+}
+
+// testBackends returns a Backend of every kind that can be
+// tested without external services.
+func testBackends(t *testing.T) map[string]*testBackend {
+	gcsStore := newFakeStore()
+	s3Store := newFakeStore()
+	file, err := NewFileBackend(t.TempDir())
+	assert.NoError(t, err)
+
+	return map[string]*testBackend{
+		"gcs":  {backend: newFakeGCSBackend(t, gcsStore, testBucket, "backups"), store: gcsStore},
+		"s3":   {backend: newFakeS3Backend(t, s3Store, testBucket, "backups"), store: s3Store},
+		"file": {backend: file},
+	}
+}
+
+func randomData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestUploadDownload(t *testing.T) {
+	tests := map[string]int{
+		"empty": 0,
+		"small": 1024,
+		// Uploaded as several chunks (GCS) or parts (S3)
+		"large": 10*mebibyte + 1,
+	}
+
+	for kind, b := range testBackends(t) {
+		for name, size := range tests {
+			t.Run(fmt.Sprintf("%s %s", kind, name), func(t *testing.T) {
+				ctx := context.Background()
+				data := randomData(t, size)
+
+				result, err := Upload(ctx, b.backend, "db/backup.tar.gz", bytes.NewReader(data))
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(data)), result.Checksum)
+				assert.Equal(t, int64(size), result.Size)
+
+				obj, err := b.backend.Stat(ctx, "db/backup.tar.gz")
+				assert.NoError(t, err)
+				assert.Equal(t, int64(size), obj.Size)
+
+				checksum, err := ReadChecksum(ctx, b.backend, "db/backup.tar.gz")
+				assert.NoError(t, err)
+				assert.Equal(t, result.Checksum, checksum)
+
+				var buf bytes.Buffer
+				assert.NoError(t, Download(ctx, b.backend, "db/backup.tar.gz", &buf))
+				assert.True(t, bytes.Equal(data, buf.Bytes()))
+
+				objects, err := b.backend.List(ctx, "db/")
+				assert.NoError(t, err)
+				assert.Len(t, objects, 2) // nolint:gomnd
+
+				assert.NoError(t, b.backend.Delete(ctx, "db/backup.tar.gz"))
+				assert.NoError(t, b.backend.Delete(ctx, "db/backup.tar.gz"+ChecksumSuffix))
+			})
+		}
+	}
+}
+
+// cancelingWriter cancels a context once it has been
+// written to.
+type cancelingWriter struct {
+	cancel context.CancelFunc
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return len(p), nil
+}
+
+func TestDownloadFailures(t *testing.T) {
+	const name = "backup.tar.gz"
+	tests := map[string]struct {
+		// httpOnly tests can only be run against fakes
+		httpOnly bool
+		setup    func(t *testing.T, b *testBackend, cancel context.CancelFunc) io.Writer
+		err      error
+	}{
+		"checksum mismatch": {
+			setup: func(t *testing.T, b *testBackend, cancel context.CancelFunc) io.Writer {
+				assert.NoError(t, WriteChecksum(context.Background(), b.backend, name, strings.Repeat("0", 64)))
+				return &bytes.Buffer{}
+			},
+			err: ErrChecksumMismatch,
+		},
+		"corrupted object": {
+			setup: func(t *testing.T, b *testBackend, cancel context.CancelFunc) io.Writer {
+				assert.NoError(t, b.backend.Put(context.Background(), name, bytes.NewReader(randomData(t, 4096))))
+				return &bytes.Buffer{}
+			},
+			err: ErrChecksumMismatch,
+		},
+		"missing checksum": {
+			setup: func(t *testing.T, b *testBackend, cancel context.CancelFunc) io.Writer {
+				assert.NoError(t, b.backend.Delete(context.Background(), name+ChecksumSuffix))
+				return &bytes.Buffer{}
+			},
+			err: ErrObjectNotFound,
+		},
+		"missing object": {
+			setup: func(t *testing.T, b *testBackend, cancel context.CancelFunc) io.Writer {
+				assert.NoError(t, b.backend.Delete(context.Background(), name))
+				return &bytes.Buffer{}
+			},
+			err: ErrObjectNotFound,
+		},
+		"truncated download": {
+			httpOnly: true,
+			setup: func(t *testing.T, b *testBackend, cancel context.CancelFunc) io.Writer {
+				// Checksums are smaller than this, so only the
+				// object is truncated.
+				b.store.setTruncate(1024)
+				return &bytes.Buffer{}
+			},
+		},
+		"canceled download": {
+			setup: func(t *testing.T, b *testBackend, cancel context.CancelFunc) io.Writer {
+				return &cancelingWriter{cancel: cancel}
+			},
+		},
+	}
+
+	for kind := range testBackends(t) {
+		for testName, test := range tests {
+			t.Run(fmt.Sprintf("%s %s", kind, testName), func(t *testing.T) {
+				b := testBackends(t)[kind]
+				if test.httpOnly && b.store == nil {
+					t.Skip("not served by a fake")
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				// Large enough to be read in several chunks
+				data := randomData(t, 4*mebibyte)
+				_, err := Upload(ctx, b.backend, name, bytes.NewReader(data))
+				assert.NoError(t, err)
+
+				w := test.setup(t, b, cancel)
+				err = Download(ctx, b.backend, name, w)
+				assert.Error(t, err)
+				if test.err != nil {
+					assert.True(t, errors.Is(err, test.err), err.Error())
+				}
+			})
+		}
+	}
+}
+
+// cancelingReader cancels a context once after bytes have
+// been read from r and then fails.
+type cancelingReader struct {
+	r      io.Reader
+	after  int
+	cancel context.CancelFunc
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	if c.after <= 0 {
+		c.cancel()
+		return 0, context.Canceled
+	}
+
+	if len(p) > c.after {
+		p = p[:c.after]
+	}
+	n, err := c.r.Read(p)
+	c.after -= n
+	return n, err
+}
+
+func TestUploadCanceled(t *testing.T) {
+	for kind, b := range testBackends(t) {
+		t.Run(kind, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			data := randomData(t, 4*mebibyte)
+			_, err := Upload(ctx, b.backend, "backup.tar.gz", &cancelingReader{
+				r:      bytes.NewReader(data),
+				after:  mebibyte,
+				cancel: cancel,
+			})
+			assert.Error(t, err)
+
+			// Neither a partial object nor a checksum is
+			// stored
+			for _, name := range []string{"backup.tar.gz", "backup.tar.gz" + ChecksumSuffix} {
+				_, err := b.backend.Stat(context.Background(), name)
+				assert.True(t, errors.Is(err, ErrObjectNotFound))
+			}
+
+			objects, err := b.backend.List(context.Background(), "")
+			assert.NoError(t, err)
+			assert.Len(t, objects, 0)
+		})
+	}
+}
+
+func TestS3PartSize(t *testing.T) {
+	// The part size is always explicit
+	backend, err := NewS3Backend("bucket", "", &S3Config{Endpoint: "localhost:9000"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(defaultS3PartSize), backend.partSize)
+
+	// The part size is read from the config file (and can
+	// be overridden in the destination)
+	viper.Set("s3.partSizeMiB", 256) // nolint:gomnd
+	defer viper.Set("s3.partSizeMiB", nil)
+	config, err := loadS3Config(url.Values{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(256*mebibyte), config.PartSize)
+
+	backend, err = NewS3Backend("bucket", "", config)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(256*mebibyte), backend.partSize)
+
+	config, err = loadS3Config(url.Values{"part-size-mib": []string{"64"}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(64*mebibyte), config.PartSize)
+
+	_, err = loadS3Config(url.Values{"part-size-mib": []string{"-1"}})
+	assert.Error(t, err)
+
+	// Part sizes below the S3 minimum are rejected
+	_, err = NewBackend(context.Background(), "s3://bucket/prefix?part-size-mib=1")
+	assert.Error(t, err)
+
+	backend, err = NewS3Backend("bucket", "", &S3Config{Endpoint: "localhost:9000", PartSize: minS3PartSize})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(minS3PartSize), backend.partSize)
+}
+
+func TestS3Put(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeStore()
+	backend := newFakeS3Backend(t, store, testBucket, "backups")
+
+	// Small objects are written with a single request
+	for _, size := range []int{0, 64, s3SinglePutSize - 1} {
+		assert.NoError(t, backend.Put(ctx, "small", bytes.NewReader(randomData(t, size))))
+		obj, err := backend.Stat(ctx, "small")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), obj.Size)
+	}
+	assert.Equal(t, 0, store.nextID)
+
+	// Larger objects are written with a multipart upload
+	data := randomData(t, s3SinglePutSize+1)
+	assert.NoError(t, backend.Put(ctx, "large", bytes.NewReader(data)))
+	assert.Equal(t, 1, store.nextID)
+
+	var buf bytes.Buffer
+	rc, err := backend.Get(ctx, "large")
+	assert.NoError(t, err)
+	_, err = io.Copy(&buf, rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.True(t, bytes.Equal(data, buf.Bytes()))
+}
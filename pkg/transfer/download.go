@@ -0,0 +1,452 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+// downloadState is the progress of a resumable download.
+type downloadState struct {
+	Name     string       `json:"name"`
+	Checksum string       `json:"checksum"`
+	Size     int64        `json:"size"`
+	Parts    map[int]bool `json:"parts"`
+}
+
+// Download copies name from backend to a local file at path
+// using opts.Workers workers. If opts.StateDir is set, each
+// downloaded part is recorded in a state file so that an
+// interrupted download of name from destination resumes from
+// the last confirmed part. If name was uploaded by Upload,
+// each part is verified against its checksum as soon as it
+// is downloaded. The entire file is always verified against
+// opts.Expected (or the checksum stored next to name).
+func Download(
+	ctx context.Context,
+	backend storage.Backend,
+	destination string,
+	name string,
+	path string,
+	opts *Options,
+) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	expected, size, index, err := loadObject(ctx, backend, name, opts)
+	if err != nil {
+		return err
+	}
+
+	// Resume any previous download of the same object
+	statePath := statePath(opts, "download", destination, name)
+	state := &downloadState{}
+	exists, err := loadState(statePath, state)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if !exists || state.Name != name || state.Checksum != expected || state.Size != size {
+		state = &downloadState{
+			Name:     name,
+			Checksum: expected,
+			Size:     size,
+			Parts:    map[int]bool{},
+		}
+		flags |= os.O_TRUNC
+	} else {
+		fmt.Printf("resuming download of %s (%d parts already downloaded)\n", name, len(state.Parts))
+	}
+
+	f, err := os.OpenFile(path, flags, statePerm)
+	if err != nil {
+		return fmt.Errorf("%w: could not open %s", err, path)
+	}
+	defer f.Close()
+
+	if err := saveState(statePath, state); err != nil {
+		return err
+	}
+
+	// Download missing parts
+	missing := []*PartIndex{}
+	for _, part := range index.Parts {
+		if !state.Parts[part.Number] {
+			missing = append(missing, part)
+		}
+	}
+
+	var mu sync.Mutex
+	if err := forEachPart(ctx, missing, opts.Workers, func(ctx context.Context, part *PartIndex) error {
+		buf, err := fetchPart(ctx, backend, name, part, opts)
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.WriteAt(buf, part.Offset); err != nil {
+			return fmt.Errorf("%w: could not write part %d", err, part.Number)
+		}
+
+		// The part is only recorded as downloaded once it
+		// is on stable storage.
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("%w: could not sync part %d", err, part.Number)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		state.Parts[part.Number] = true
+		return saveState(statePath, state)
+	}); err != nil {
+		if len(statePath) == 0 {
+			return err
+		}
+
+		return fmt.Errorf("%w: run again to resume from the last downloaded part", err)
+	}
+
+	// Verify the entire file
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("%w: could not truncate %s", err, path)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return fmt.Errorf("%w: could not read %s", err, path)
+	}
+
+	if err := removeState(statePath); err != nil {
+		return err
+	}
+
+	if err := verifyChecksum(expected, h.Sum(nil)); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return err
+	}
+
+	return f.Close()
+}
+
+// Stream writes name from backend to w, downloading up to
+// opts.Workers parts concurrently (but writing them in order).
+// Parts are verified as in Download. The entire object is
+// verified once it has been written, so nothing written to w
+// should be trusted until Stream returns.
+func Stream(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	w io.Writer,
+	opts *Options,
+) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	expected, _, index, err := loadObject(ctx, backend, name, opts)
+	if err != nil {
+		return err
+	}
+
+	// The result of each part is sent to the writer in order.
+	// The writer holds one result while waiting for it, so at
+	// most opts.Workers parts are in memory.
+	g, gctx := errgroup.WithContext(ctx)
+	pending := make(chan chan []byte, opts.Workers-1)
+	g.Go(func() error {
+		defer close(pending)
+
+		for _, part := range index.Parts {
+			part := part
+			result := make(chan []byte, 1)
+			select {
+			case pending <- result:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+
+			g.Go(func() error {
+				buf, err := fetchPart(gctx, backend, name, part, opts)
+				if err != nil {
+					return err
+				}
+
+				result <- buf
+				return nil
+			})
+		}
+
+		return nil
+	})
+
+	h := sha256.New()
+	g.Go(func() error {
+		mw := io.MultiWriter(w, h)
+		for result := range pending {
+			select {
+			case buf := <-result:
+				if _, err := mw.Write(buf); err != nil {
+					return err
+				}
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+		}
+
+		return nil
+	})
+
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("%w: unable to download %s", err, name)
+	}
+
+	return verifyChecksum(expected, h.Sum(nil))
+}
+
+// loadObject returns the checksum (opts.Expected if set),
+// size and index of name.
+func loadObject(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	opts *Options,
+) (string, int64, *Index, error) {
+	// Check if the checksum must be downloaded
+	expected := opts.Expected
+	if len(expected) == 0 {
+		if err := retry(ctx, opts, "download checksum", func() error {
+			var err error
+			expected, err = storage.ReadChecksum(ctx, backend, name)
+			return err
+		}); err != nil {
+			return "", -1, nil, err
+		}
+	}
+
+	var obj *storage.Object
+	if err := retry(ctx, opts, "stat "+name, func() error {
+		var err error
+		obj, err = backend.Stat(ctx, name)
+		return err
+	}); err != nil {
+		return "", -1, nil, err
+	}
+
+	index, err := loadIndex(ctx, backend, name, expected, obj.Size, opts)
+	if err != nil {
+		return "", -1, nil, err
+	}
+
+	return expected, obj.Size, index, nil
+}
+
+// verifyChecksum returns storage.ErrChecksumMismatch if sum
+// is not expected.
+func verifyChecksum(expected string, sum []byte) error {
+	checksum := fmt.Sprintf("%x", sum)
+	if checksum != expected {
+		return fmt.Errorf(
+			"%w: expected checksum %s but got %s",
+			storage.ErrChecksumMismatch,
+			expected,
+			checksum,
+		)
+	}
+
+	return nil
+}
+
+// loadIndex returns the index stored next to name or, if
+// there is none (ex: the object was not uploaded with Upload),
+// it describes a different version of name or it is not a
+// valid index of size bytes, an index of unverified parts of
+// size opts.PartSize.
+func loadIndex(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	expected string,
+	size int64,
+	opts *Options,
+) (*Index, error) {
+	var data []byte
+	err := retry(ctx, opts, "download index", func() error {
+		rc, err := backend.Get(ctx, name+PartsSuffix)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		data, err = ioutil.ReadAll(rc)
+		return err
+	})
+	if err == nil {
+		index := &Index{}
+		if err := json.Unmarshal(data, index); err != nil {
+			return nil, fmt.Errorf("%w: could not parse index of %s", err, name)
+		}
+
+		if index.Checksum == expected && validIndex(index, size) {
+			return index, nil
+		}
+	}
+	if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, err
+	}
+
+	index := &Index{PartSize: opts.PartSize, Parts: []*PartIndex{}}
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+opts.PartSize, number+1 {
+		partSize := opts.PartSize
+		if size-offset < partSize {
+			partSize = size - offset
+		}
+
+		index.Parts = append(index.Parts, &PartIndex{
+			Number: number,
+			Offset: offset,
+			Size:   partSize,
+		})
+	}
+
+	return index, nil
+}
+
+// validIndex returns true if index describes parts of an
+// object of size bytes in the same way Upload does (parts
+// numbered from 1 that are contiguous from offset 0 and all
+// of size index.PartSize except the last). The index is
+// stored next to the object, so it is checked before it is
+// used to allocate buffers or write to a file.
+func validIndex(index *Index, size int64) bool {
+	if index.PartSize < MinPartSize || index.PartSize > MaxPartSize || len(index.Parts) == 0 {
+		return false
+	}
+
+	var offset int64
+	for i, part := range index.Parts {
+		if part == nil || part.Number != i+1 || part.Offset != offset {
+			return false
+		}
+
+		// Only the last part may be smaller than the part
+		// size (and it is only empty if the object is)
+		last := i == len(index.Parts)-1
+		if part.Size < 0 || part.Size > index.PartSize || (!last && part.Size != index.PartSize) {
+			return false
+		}
+		if last && part.Size == 0 && i > 0 {
+			return false
+		}
+
+		offset += part.Size
+	}
+
+	return offset == size
+}
+
+// forEachPart calls f for each of parts using workers
+// goroutines. It stops at the first error.
+func forEachPart(
+	ctx context.Context,
+	parts []*PartIndex,
+	workers int,
+	f func(context.Context, *PartIndex) error,
+) error {
+	g, gctx := errgroup.WithContext(ctx)
+	queue := make(chan *PartIndex)
+	g.Go(func() error {
+		defer close(queue)
+
+		for _, part := range parts {
+			select {
+			case queue <- part:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+		}
+
+		return nil
+	})
+
+	for i := 0; i < workers; i++ {
+		g.Go(func() error {
+			for part := range queue {
+				if err := f(gctx, part); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// fetchPart returns the contents of part of name, verifying
+// its checksum (if known).
+func fetchPart(
+	ctx context.Context,
+	backend storage.Backend,
+	name string,
+	part *PartIndex,
+	opts *Options,
+) ([]byte, error) {
+	buf := make([]byte, part.Size)
+	if err := retry(ctx, opts, fmt.Sprintf("download part %d", part.Number), func() error {
+		rc, err := backend.GetRange(ctx, name, part.Offset, part.Size)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		if _, err := io.ReadFull(opts.Limiter.Reader(ctx, rc), buf); err != nil {
+			return err
+		}
+
+		if len(part.Checksum) > 0 && checksum(buf) != part.Checksum {
+			return fmt.Errorf("%w: part %d of %s", ErrPartMismatch, part.Number, name)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("downloaded part %d of %s (%d bytes)\n", part.Number, name, part.Size)
+	return buf, nil
+}
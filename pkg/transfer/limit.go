@@ -0,0 +1,134 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// maxBurst is the most bytes a Limiter allows to be
+// transferred at once.
+const maxBurst = 1024 * 1024
+
+// bandwidthUnits are the units accepted by ParseBandwidth.
+var bandwidthUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+// ParseBandwidth parses a bandwidth (ex: 50MiB/s) and returns
+// the number of bytes per second it represents.
+func ParseBandwidth(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(value)
+	}
+
+	unit, ok := bandwidthUnits[strings.TrimSpace(value[i:])]
+	if !ok {
+		return 0, fmt.Errorf("%s has an unknown unit", s)
+	}
+
+	n, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: could not parse %s", err, s)
+	}
+
+	bytesPerSecond := n * unit
+	if bytesPerSecond < 1 || bytesPerSecond > math.MaxInt64 {
+		return 0, fmt.Errorf("%s is not a valid bandwidth", s)
+	}
+
+	return int64(bytesPerSecond), nil
+}
+
+// Limiter is a token bucket that caps the combined
+// bandwidth of all the workers of a transfer.
+type Limiter struct {
+	limiter *rate.Limiter
+	burst   int
+}
+
+// NewLimiter returns a *Limiter that allows bytesPerSecond
+// bytes to be transferred each second.
+func NewLimiter(bytesPerSecond int64) (*Limiter, error) {
+	if bytesPerSecond <= 0 {
+		return nil, errors.New("bandwidth must be positive")
+	}
+
+	burst := maxBurst
+	if bytesPerSecond < maxBurst {
+		burst = int(bytesPerSecond)
+	}
+
+	return &Limiter{
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+		burst:   burst,
+	}, nil
+}
+
+// Reader returns a reader over r that waits for l before
+// returning any bytes. If l is nil, r is returned.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+// limitedReader is the io.Reader returned by Limiter.Reader.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.l.burst {
+		p = p[:r.l.burst]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.limiter.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
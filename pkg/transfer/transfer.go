@@ -0,0 +1,281 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+	"github.com/patrick-ogrady/snowplow/pkg/utils"
+)
+
+const (
+	mebibyte = 1024 * 1024
+
+	// DefaultPartSize is the size of each part of a
+	// transfer if none is provided.
+	DefaultPartSize = 64 * mebibyte
+
+	// MinPartSize is the smallest part size supported by
+	// all backends (S3 requires all parts but the last to
+	// be at least 5 MiB).
+	MinPartSize = 5 * mebibyte
+
+	// MaxPartSize is the largest part size supported by all
+	// backends (S3 limits parts to 5 GiB).
+	MaxPartSize = 5 * 1024 * mebibyte
+
+	// DefaultMaxAttempts is the number of times each
+	// request is attempted if none is provided.
+	DefaultMaxAttempts = 5
+
+	// DefaultWorkers is the number of parts transferred
+	// concurrently if none is provided.
+	DefaultWorkers = 4
+
+	// PartsSuffix is appended to the name of an object to
+	// get the name of the index of its parts.
+	PartsSuffix = ".parts"
+
+	initialBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+
+	statePerm = 0600
+)
+
+// ErrPartMismatch is returned when a downloaded part does
+// not match the checksum recorded when it was uploaded.
+var ErrPartMismatch = errors.New("part checksum mismatch")
+
+// Options configures a transfer.
+type Options struct {
+	// PartSize is the size of each part. Defaults to
+	// DefaultPartSize.
+	PartSize int64
+
+	// MaxAttempts is the number of times each request is
+	// attempted before giving up. Defaults to
+	// DefaultMaxAttempts.
+	MaxAttempts int
+
+	// Workers is the number of parts transferred
+	// concurrently. Each worker holds an entire part in
+	// memory. Defaults to DefaultWorkers.
+	Workers int
+
+	// Limiter caps the bandwidth of the transfer. If nil,
+	// the bandwidth is not limited.
+	Limiter *Limiter
+
+	// StateDir is the directory the progress of each
+	// transfer is recorded in (so it can be resumed). If
+	// empty, progress is not recorded.
+	StateDir string
+
+	// Checksum returns the checksum of an uploaded object
+	// once it has been read to EOF. If nil, the checksum
+	// is computed while the object is uploaded.
+	Checksum func() string
+
+	// Expected is the checksum a downloaded object must
+	// match (ex: from a signed manifest). If empty, the
+	// checksum stored next to the object is used.
+	Expected string
+}
+
+// withDefaults returns a copy of opts with all
+// unset fields populated.
+func (opts *Options) withDefaults() (*Options, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.PartSize == 0 {
+		o.PartSize = DefaultPartSize
+	}
+	if o.PartSize < MinPartSize {
+		return nil, fmt.Errorf("part size must be at least %d bytes", MinPartSize)
+	}
+	if o.PartSize > MaxPartSize {
+		return nil, fmt.Errorf("part size cannot be more than %d bytes", MaxPartSize)
+	}
+
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = DefaultMaxAttempts
+	}
+	if o.MaxAttempts < 0 {
+		return nil, errors.New("max attempts cannot be negative")
+	}
+
+	if o.Workers == 0 {
+		o.Workers = DefaultWorkers
+	}
+	if o.Workers < 0 {
+		return nil, errors.New("workers cannot be negative")
+	}
+
+	return &o, nil
+}
+
+// Index is stored next to an object uploaded by Upload so
+// that each part can be verified when it is downloaded.
+type Index struct {
+	// Checksum is the checksum of the entire object, which
+	// is used to detect an index left behind by an earlier
+	// version of the object.
+	Checksum string       `json:"checksum"`
+	PartSize int64        `json:"partSize"`
+	Parts    []*PartIndex `json:"parts"`
+}
+
+// PartIndex describes a part of an object.
+type PartIndex struct {
+	Number   int    `json:"number"`
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// checksum returns the hex-encoded SHA256 checksum of b.
+func checksum(b []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// statePath returns the path of the state file of a
+// transfer of name to or from destination (or an empty path
+// if progress is not recorded).
+func statePath(opts *Options, kind string, destination string, name string) string {
+	if len(opts.StateDir) == 0 {
+		return ""
+	}
+
+	id := checksum([]byte(destination + "\x00" + name))
+	return filepath.Join(opts.StateDir, fmt.Sprintf(".snowplow-%s-%s.json", kind, id[:16]))
+}
+
+// loadState populates state from path. It returns false if
+// there is no state at path.
+func loadState(path string, state interface{}) (bool, error) {
+	if len(path) == 0 {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: could not read %s", err, path)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return false, fmt.Errorf("%w: could not parse %s", err, path)
+	}
+
+	return true, nil
+}
+
+// saveState atomically writes state to path so that a crash
+// never leaves a partially written state file behind.
+func saveState(path string, state interface{}) error {
+	if len(path) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("%w: could not marshal state", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, statePerm); err != nil {
+		return fmt.Errorf("%w: could not write %s", err, tmpPath)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("%w: could not rename %s", err, tmpPath)
+	}
+
+	return nil
+}
+
+// retryable returns false for errors that cannot be
+// fixed by trying again.
+func retryable(err error) bool {
+	return !errors.Is(err, storage.ErrObjectNotFound) &&
+		!errors.Is(err, storage.ErrUploadNotFound) &&
+		!errors.Is(err, context.Canceled)
+}
+
+// retry calls f until it succeeds, returns an error that is
+// not retryable or has been called opts.MaxAttempts times.
+// The delay between attempts doubles after every failure.
+func retry(ctx context.Context, opts *Options, action string, f func() error) error {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil || !retryable(err) || attempt >= opts.MaxAttempts {
+			return fmt.Errorf("%w: unable to %s after %d attempts", err, action, attempt)
+		}
+
+		fmt.Printf(
+			"unable to %s (attempt %d of %d), retrying in %s: %s\n",
+			action,
+			attempt,
+			opts.MaxAttempts,
+			backoff,
+			err.Error(),
+		)
+		if err := utils.ContextSleep(ctx, utils.RealClock{}, backoff); err != nil {
+			return err
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// removeState removes the state file at path.
+func removeState(path string) error {
+	if len(path) == 0 {
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("%w: could not remove %s", err, path)
+	}
+
+	return nil
+}
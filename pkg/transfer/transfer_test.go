@@ -0,0 +1,422 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/patrick-ogrady/snowplow/pkg/integrity"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+// countingBackend counts the parts written to
+// a *storage.FileBackend.
+type countingBackend struct {
+	*storage.FileBackend
+
+	root  string
+	mu    sync.Mutex
+	parts []int
+
+	// uploaded is called after each part is written (if
+	// not nil).
+	uploaded func(number int)
+}
+
+func (b *countingBackend) PutPart(
+	ctx context.Context,
+	name string,
+	id string,
+	part *storage.Part,
+	r io.Reader,
+) (string, error) {
+	b.mu.Lock()
+	b.parts = append(b.parts, part.Number)
+	b.mu.Unlock()
+
+	etag, err := b.FileBackend.PutPart(ctx, name, id, part, r)
+	if err == nil && b.uploaded != nil {
+		b.uploaded(part.Number)
+	}
+
+	return etag, err
+}
+
+// failingReader returns an error after n bytes.
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func setup(t *testing.T) (*countingBackend, *Options, []byte) {
+	root := t.TempDir()
+	fileBackend, err := storage.NewFileBackend(root)
+	assert.NoError(t, err)
+
+	data := make([]byte, 2*MinPartSize+1024)
+	_, err = rand.Read(data)
+	assert.NoError(t, err)
+
+	return &countingBackend{FileBackend: fileBackend, root: root}, &Options{
+		PartSize:    MinPartSize,
+		MaxAttempts: 1,
+		Workers:     1,
+		StateDir:    t.TempDir(),
+	}, data
+}
+
+func TestUploadDownload(t *testing.T) {
+	ctx := context.Background()
+	backend, opts, data := setup(t)
+
+	result, err := Upload(ctx, backend, "file:///test", "db.tar.gz", bytes.NewReader(data), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), result.Size)
+	assert.Equal(t, []int{1, 2, 3}, backend.parts)
+
+	// Only the object and its sidecars are visible
+	objects, err := backend.List(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 3)
+
+	// No state is left behind
+	states, err := ioutil.ReadDir(opts.StateDir)
+	assert.NoError(t, err)
+	assert.Len(t, states, 0)
+
+	// The object can also be downloaded in a single stream
+	var buf bytes.Buffer
+	assert.NoError(t, storage.Download(ctx, backend, "db.tar.gz", &buf))
+	assert.Equal(t, data, buf.Bytes())
+
+	local := filepath.Join(t.TempDir(), "db.tar.gz")
+	assert.NoError(t, Download(ctx, backend, "file:///test", "db.tar.gz", local, opts))
+	downloaded, err := ioutil.ReadFile(local)
+	assert.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+}
+
+func TestUploadResume(t *testing.T) {
+	ctx := context.Background()
+	backend, opts, data := setup(t)
+
+	// Fail partway through the second part
+	_, err := Upload(
+		ctx,
+		backend,
+		"file:///test",
+		"db.tar.gz",
+		&failingReader{r: bytes.NewReader(data), n: MinPartSize + 1024},
+		opts,
+	)
+	assert.Error(t, err)
+	assert.Equal(t, []int{1}, backend.parts)
+
+	// The partial upload is not visible
+	_, err = backend.Stat(ctx, "db.tar.gz")
+	assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+
+	// Resuming skips the uploaded part
+	result, err := Upload(ctx, backend, "file:///test", "db.tar.gz", bytes.NewReader(data), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, backend.parts)
+
+	var buf bytes.Buffer
+	assert.NoError(t, storage.Download(ctx, backend, "db.tar.gz", &buf))
+	assert.Equal(t, data, buf.Bytes())
+	assert.Equal(t, int64(len(data)), result.Size)
+
+	// Changed parts are uploaded again when resuming
+	backend.parts = nil
+	_, err = Upload(
+		ctx,
+		backend,
+		"file:///test",
+		"db2.tar.gz",
+		&failingReader{r: bytes.NewReader(data), n: 2*MinPartSize + 10},
+		opts,
+	)
+	assert.Error(t, err)
+	assert.Equal(t, []int{1, 2}, backend.parts)
+
+	changed := append([]byte{}, data...)
+	changed[MinPartSize] ^= 0xff
+	_, err = Upload(ctx, backend, "file:///test", "db2.tar.gz", bytes.NewReader(changed), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 2, 3}, backend.parts)
+
+	buf.Reset()
+	assert.NoError(t, storage.Download(ctx, backend, "db2.tar.gz", &buf))
+	assert.Equal(t, changed, buf.Bytes())
+}
+
+func TestUploadCanceled(t *testing.T) {
+	backend, opts, data := setup(t)
+
+	// Cancel between parts (once the first part has been
+	// uploaded)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend.uploaded = func(int) {
+		cancel()
+	}
+	_, err := Upload(ctx, backend, "file:///test", "db.tar.gz", bytes.NewReader(data), opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []int{1}, backend.parts)
+
+	// The truncated object is never completed
+	_, err = backend.Stat(context.Background(), "db.tar.gz")
+	assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+	_, err = storage.ReadChecksum(context.Background(), backend, "db.tar.gz")
+	assert.ErrorIs(t, err, storage.ErrObjectNotFound)
+}
+
+func TestDownloadCorrupt(t *testing.T) {
+	ctx := context.Background()
+	backend, opts, data := setup(t)
+
+	result, err := Upload(ctx, backend, "file:///test", "db.tar.gz", bytes.NewReader(data), opts)
+	assert.NoError(t, err)
+
+	// Corrupt the second part
+	corrupt := append([]byte{}, data...)
+	corrupt[MinPartSize+1] ^= 0xff
+	assert.NoError(t, backend.Put(ctx, "db.tar.gz", bytes.NewReader(corrupt)))
+
+	local := filepath.Join(t.TempDir(), "db.tar.gz")
+	err = Download(ctx, backend, "file:///test", "db.tar.gz", local, opts)
+	assert.ErrorIs(t, err, ErrPartMismatch)
+
+	// Resuming after the object is fixed only downloads
+	// the remaining parts
+	assert.NoError(t, backend.Put(ctx, "db.tar.gz", bytes.NewReader(data)))
+	assert.NoError(t, Download(ctx, backend, "file:///test", "db.tar.gz", local, opts))
+	downloaded, err := ioutil.ReadFile(local)
+	assert.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+
+	// Without an index, corruption is detected by the
+	// checksum of the entire object
+	assert.NoError(t, backend.Delete(ctx, "db.tar.gz"+PartsSuffix))
+	assert.NoError(t, backend.Put(ctx, "db.tar.gz", bytes.NewReader(corrupt)))
+	assert.NoError(t, os.Remove(local))
+	err = Download(ctx, backend, "file:///test", "db.tar.gz", local, opts)
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+	_, err = os.Stat(local)
+	assert.True(t, os.IsNotExist(err))
+
+	// Replacing the stored checksum is detected when the
+	// expected checksum is provided
+	corruptSum, err := integrity.Checksum(bytes.NewReader(corrupt))
+	assert.NoError(t, err)
+	assert.NoError(t, storage.WriteChecksum(ctx, backend, "db.tar.gz", corruptSum))
+	var buf bytes.Buffer
+	assert.NoError(t, Stream(ctx, backend, "db.tar.gz", &buf, opts))
+
+	opts.Expected = result.Checksum
+	buf.Reset()
+	err = Stream(ctx, backend, "db.tar.gz", &buf, opts)
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+	err = Download(ctx, backend, "file:///test", "db.tar.gz", local, opts)
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+}
+
+func TestInvalidIndex(t *testing.T) {
+	ctx := context.Background()
+	backend, opts, data := setup(t)
+
+	result, err := Upload(ctx, backend, "file:///test", "db.tar.gz", bytes.NewReader(data), opts)
+	assert.NoError(t, err)
+
+	size := int64(len(data))
+
+	// Indexes created by Upload are valid (including the
+	// index of an empty object)
+	index, err := loadIndex(ctx, backend, "db.tar.gz", result.Checksum, size, opts)
+	assert.NoError(t, err)
+	assert.Len(t, index.Parts[0].Checksum, 64) // nolint:gomnd
+	assert.True(t, validIndex(index, size))
+	assert.True(t, validIndex(&Index{PartSize: MinPartSize, Parts: []*PartIndex{
+		{Number: 1, Offset: 0, Size: 0},
+	}}, 0))
+
+	tests := map[string]*Index{
+		"huge part": {PartSize: MaxPartSize, Parts: []*PartIndex{
+			{Number: 1, Offset: 0, Size: MaxPartSize + 1},
+		}},
+		"negative size": {PartSize: MinPartSize, Parts: []*PartIndex{
+			{Number: 1, Offset: 0, Size: -1},
+			{Number: 2, Offset: -1, Size: size + 1},
+		}},
+		"part size too large": {PartSize: MaxPartSize + 1, Parts: []*PartIndex{
+			{Number: 1, Offset: 0, Size: size},
+		}},
+		"gap": {PartSize: MinPartSize, Parts: []*PartIndex{
+			{Number: 1, Offset: 0, Size: MinPartSize},
+			{Number: 2, Offset: MinPartSize + 1, Size: size - MinPartSize - 1},
+		}},
+		"renumbered": {PartSize: 2 * MinPartSize, Parts: []*PartIndex{
+			{Number: 2, Offset: 0, Size: 2 * MinPartSize},
+			{Number: 3, Offset: 2 * MinPartSize, Size: size - 2*MinPartSize},
+		}},
+		"short": {PartSize: 2 * MinPartSize, Parts: []*PartIndex{
+			{Number: 1, Offset: 0, Size: 2 * MinPartSize},
+		}},
+		"empty": {PartSize: MinPartSize, Parts: []*PartIndex{}},
+	}
+	for name, index := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.False(t, validIndex(index, size))
+
+			// Invalid indexes are ignored (even if they
+			// describe the expected object)
+			index.Checksum = result.Checksum
+			raw, err := json.Marshal(index)
+			assert.NoError(t, err)
+			assert.NoError(t, backend.Put(ctx, "db.tar.gz"+PartsSuffix, bytes.NewReader(raw)))
+
+			var buf bytes.Buffer
+			assert.NoError(t, Stream(ctx, backend, "db.tar.gz", &buf, opts))
+			assert.Equal(t, data, buf.Bytes())
+
+			local := filepath.Join(t.TempDir(), "db.tar.gz")
+			assert.NoError(t, Download(ctx, backend, "file:///test", "db.tar.gz", local, opts))
+			downloaded, err := ioutil.ReadFile(local)
+			assert.NoError(t, err)
+			assert.Equal(t, data, downloaded)
+		})
+	}
+
+}
+
+func TestParallel(t *testing.T) {
+	ctx := context.Background()
+	backend, opts, data := setup(t)
+	opts.Workers = 3
+	opts.StateDir = ""
+
+	result, err := Upload(ctx, backend, "file:///test", "db.tar.gz", bytes.NewReader(data), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), result.Size)
+	sort.Ints(backend.parts)
+	assert.Equal(t, []int{1, 2, 3}, backend.parts)
+
+	var buf bytes.Buffer
+	assert.NoError(t, Stream(ctx, backend, "db.tar.gz", &buf, opts))
+	assert.Equal(t, data, buf.Bytes())
+
+	local := filepath.Join(t.TempDir(), "db.tar.gz")
+	assert.NoError(t, Download(ctx, backend, "file:///test", "db.tar.gz", local, opts))
+	downloaded, err := ioutil.ReadFile(local)
+	assert.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+
+	// A failed upload is removed if it cannot be resumed
+	_, err = Upload(
+		ctx,
+		backend,
+		"file:///test",
+		"db2.tar.gz",
+		&failingReader{r: bytes.NewReader(data), n: MinPartSize + 1024},
+		opts,
+	)
+	assert.Error(t, err)
+	entries, err := ioutil.ReadDir(backend.root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	// Corrupt parts are detected while streaming
+	corrupt := append([]byte{}, data...)
+	corrupt[2*MinPartSize+1] ^= 0xff
+	assert.NoError(t, backend.Put(ctx, "db.tar.gz", bytes.NewReader(corrupt)))
+	buf.Reset()
+	assert.ErrorIs(t, Stream(ctx, backend, "db.tar.gz", &buf, opts), ErrPartMismatch)
+}
+
+func TestParseBandwidth(t *testing.T) {
+	tests := map[string]int64{
+		"50MiB/s": 50 * 1024 * 1024,
+		"10 MB/s": 10 * 1000 * 1000,
+		"1.5KiB":  1536,
+		"100":     100,
+		"2gib/s":  2 * 1024 * 1024 * 1024,
+	}
+	for s, expected := range tests {
+		t.Run(s, func(t *testing.T) {
+			bytesPerSecond, err := ParseBandwidth(s)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, bytesPerSecond)
+		})
+	}
+
+	for _, s := range []string{"", "MiB/s", "10 parsecs", "0", "-5MB/s"} {
+		t.Run(s, func(t *testing.T) {
+			_, err := ParseBandwidth(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	limiter, err := NewLimiter(64 * 1024)
+	assert.NoError(t, err)
+
+	// The first 64 KiB are allowed immediately (the bucket
+	// starts full) and the next 32 KiB take half a second.
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, limiter.Reader(context.Background(), bytes.NewReader(make([]byte, 96*1024))))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(96*1024), n)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+
+	// Canceling the context stops the transfer
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = io.Copy(ioutil.Discard, limiter.Reader(ctx, bytes.NewReader(make([]byte, 1024))))
+	assert.ErrorIs(t, err, context.Canceled)
+}
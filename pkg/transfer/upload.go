@@ -0,0 +1,335 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+// uploadState is the progress of a resumable upload.
+type uploadState struct {
+	Name     string                `json:"name"`
+	UploadID string                `json:"uploadID"`
+	PartSize int64                 `json:"partSize"`
+	Parts    map[int]*uploadedPart `json:"parts"`
+}
+
+// uploadedPart is a part confirmed by the backend.
+type uploadedPart struct {
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	ETag     string `json:"etag"`
+}
+
+// upload is a multipart upload in progress.
+type upload struct {
+	backend storage.MultipartBackend
+	path    string
+	opts    *Options
+
+	// mu guards state, which is updated by every worker.
+	mu    sync.Mutex
+	state *uploadState
+}
+
+// Upload streams r to name in backend as a series of parts,
+// which are uploaded by opts.Workers workers. If opts.StateDir
+// is set, each confirmed part is recorded in a state file. If
+// an upload of name to destination was interrupted, r is read
+// from the beginning again and any part that was already
+// uploaded with identical contents is skipped, so r must be
+// reproducible (ex: an archive of files that have not
+// changed). Parts that differ are uploaded again.
+//
+// An index of the parts (used to verify downloads) and the
+// checksum of the object are stored next to it once the
+// upload is completed. Backends that do not support multipart
+// uploads fall back to storage.Upload.
+func Upload(
+	ctx context.Context,
+	backend storage.Backend,
+	destination string,
+	name string,
+	r io.Reader,
+	opts *Options,
+) (*storage.UploadResult, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	mb, ok := backend.(storage.MultipartBackend)
+	if !ok {
+		fmt.Printf("%s does not support multipart uploads\n", destination)
+		if opts.Checksum != nil {
+			return storage.UploadWithChecksum(ctx, backend, name, opts.Limiter.Reader(ctx, r), opts.Checksum)
+		}
+
+		return storage.Upload(ctx, backend, name, opts.Limiter.Reader(ctx, r))
+	}
+
+	u, err := startUpload(ctx, mb, statePath(opts, "upload", destination, name), name, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	index, result, err := u.uploadParts(ctx, r)
+	if errors.Is(err, storage.ErrUploadNotFound) {
+		// The upload can never be completed, so the next
+		// attempt must start over.
+		_ = removeState(u.path)
+		return nil, fmt.Errorf("%w: run again to start a new upload", err)
+	}
+	if err != nil && len(u.path) == 0 {
+		// The upload can never be resumed, so we remove any
+		// parts that were uploaded (even if ctx is canceled).
+		_ = mb.AbortMultipart(context.Background(), name, u.state.UploadID)
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: run again to resume from the last uploaded part", err)
+	}
+
+	// The index and checksum are only written once the
+	// object is complete.
+	data, err := json.Marshal(index)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not marshal index", err)
+	}
+	if err := retry(ctx, opts, "upload index", func() error {
+		return backend.Put(ctx, name+PartsSuffix, bytes.NewReader(data))
+	}); err != nil {
+		return nil, err
+	}
+	if err := retry(ctx, opts, "upload checksum", func() error {
+		return storage.WriteChecksum(ctx, backend, name, result.Checksum)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := removeState(u.path); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// startUpload resumes the upload recorded at path or, if there
+// is none (or it was started with a different part size),
+// starts a new upload.
+func startUpload(
+	ctx context.Context,
+	backend storage.MultipartBackend,
+	path string,
+	name string,
+	opts *Options,
+) (*upload, error) {
+	u := &upload{
+		backend: backend,
+		path:    path,
+		opts:    opts,
+		state:   &uploadState{},
+	}
+	exists, err := loadState(path, u.state)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists && u.state.Name == name && u.state.PartSize == opts.PartSize {
+		fmt.Printf("resuming upload of %s (%d parts already uploaded)\n", name, len(u.state.Parts))
+		return u, nil
+	}
+
+	if exists {
+		_ = backend.AbortMultipart(ctx, u.state.Name, u.state.UploadID)
+	}
+
+	var id string
+	if err := retry(ctx, opts, "start upload", func() error {
+		var err error
+		id, err = backend.CreateMultipart(ctx, name)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	u.state = &uploadState{
+		Name:     name,
+		UploadID: id,
+		PartSize: opts.PartSize,
+		Parts:    map[int]*uploadedPart{},
+	}
+	if err := saveState(path, u.state); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// uploadParts reads r one part at a time, uploads each part
+// that has not already been uploaded (with up to
+// u.opts.Workers parts in flight) and completes the upload.
+func (u *upload) uploadParts(ctx context.Context, r io.Reader) (*Index, *storage.UploadResult, error) {
+	g, gctx := errgroup.WithContext(ctx)
+
+	// Buffers are only allocated once they are needed so
+	// that small objects do not allocate a buffer for each
+	// worker.
+	buffers := make(chan []byte, u.opts.Workers)
+	for i := 0; i < u.opts.Workers; i++ {
+		buffers <- nil
+	}
+
+	checksumFunc := u.opts.Checksum
+	if checksumFunc == nil {
+		h := sha256.New()
+		r = io.TeeReader(r, h)
+		checksumFunc = func() string {
+			return fmt.Sprintf("%x", h.Sum(nil))
+		}
+	}
+
+	index := &Index{PartSize: u.opts.PartSize, Parts: []*PartIndex{}}
+	parts := []*storage.Part{}
+	var (
+		offset  int64
+		readErr error
+	)
+	for number := 1; ; number++ {
+		var buf []byte
+		select {
+		case buf = <-buffers:
+		case <-gctx.Done():
+		}
+		if gctx.Err() != nil {
+			break
+		}
+		if buf == nil {
+			buf = make([]byte, u.opts.PartSize)
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			readErr = fmt.Errorf("%w: could not read part %d", err, number)
+			break
+		}
+
+		// An empty object is uploaded as a single empty part
+		// because every upload must have at least one part.
+		if n == 0 && number > 1 {
+			break
+		}
+
+		data := buf[:n]
+		part := &storage.Part{Number: number, Offset: offset, Size: int64(n)}
+		sum := checksum(data)
+		parts = append(parts, part)
+		index.Parts = append(index.Parts, &PartIndex{
+			Number:   number,
+			Offset:   offset,
+			Size:     part.Size,
+			Checksum: sum,
+		})
+		offset += part.Size
+
+		g.Go(func() error {
+			defer func() { buffers <- buf }()
+
+			return u.uploadPart(gctx, part, data, sum)
+		})
+
+		if int64(n) < u.opts.PartSize {
+			break
+		}
+	}
+
+	// Parts that were already read are always recorded
+	// before returning (even if reading r failed).
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+	if readErr != nil {
+		return nil, nil, readErr
+	}
+
+	// Check if reading stopped early because ctx was canceled
+	// (so a truncated object is never completed)
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if err := retry(ctx, u.opts, "complete upload", func() error {
+		return u.backend.CompleteMultipart(ctx, u.state.Name, u.state.UploadID, parts)
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	index.Checksum = checksumFunc()
+	return index, &storage.UploadResult{
+		Checksum: index.Checksum,
+		Size:     offset,
+	}, nil
+}
+
+// uploadPart uploads data as part unless an identical part
+// was already uploaded.
+func (u *upload) uploadPart(ctx context.Context, part *storage.Part, data []byte, sum string) error {
+	u.mu.Lock()
+	uploaded, ok := u.state.Parts[part.Number]
+	u.mu.Unlock()
+	if ok && uploaded.Offset == part.Offset && uploaded.Size == part.Size && uploaded.Checksum == sum {
+		part.ETag = uploaded.ETag
+		return nil
+	}
+
+	if err := retry(ctx, u.opts, fmt.Sprintf("upload part %d", part.Number), func() error {
+		r := u.opts.Limiter.Reader(ctx, bytes.NewReader(data))
+		etag, err := u.backend.PutPart(ctx, u.state.Name, u.state.UploadID, part, r)
+		part.ETag = etag
+		return err
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("uploaded part %d of %s (%d bytes)\n", part.Number, u.state.Name, part.Size)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.state.Parts[part.Number] = &uploadedPart{
+		Offset:   part.Offset,
+		Size:     part.Size,
+		Checksum: sum,
+		ETag:     part.ETag,
+	}
+
+	return saveState(u.path, u.state)
+}
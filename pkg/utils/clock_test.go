@@ -0,0 +1,64 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewFakeClock(start)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slept := make(chan error)
+	go func() {
+		slept <- ContextSleep(ctx, clock, time.Minute)
+	}()
+
+	// Timers only fire once the clock reaches them
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), clock.Now())
+	select {
+	case <-slept:
+		t.Fatal("slept before the timer was due")
+	default:
+	}
+
+	clock.Advance(time.Minute)
+	assert.NoError(t, <-slept)
+
+	// Canceled sleeps stop their timer
+	go func() {
+		slept <- ContextSleep(ctx, clock, time.Minute)
+	}()
+	clock.BlockUntil(1)
+	cancel()
+	assert.ErrorIs(t, <-slept, context.Canceled)
+	assert.Empty(t, clock.timers)
+
+	// Non-positive durations fire immediately
+	assert.NoError(t, ContextSleep(context.Background(), clock, 0))
+}
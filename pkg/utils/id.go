@@ -22,6 +22,7 @@ package utils
 import (
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 
@@ -39,12 +40,31 @@ func LoadNodeID(stakingCertPath string) (ids.ShortID, error) {
 		return ids.ShortID{}, fmt.Errorf("%w: problem reading staking certificate", err)
 	}
 
+	cert, err := ParseStakingCertificate(stakeCert)
+	if err != nil {
+		return ids.ShortID{}, err
+	}
+
+	return CertificateNodeID(cert)
+}
+
+// ParseStakingCertificate parses a PEM-encoded staker cert.
+func ParseStakingCertificate(stakeCert []byte) (*x509.Certificate, error) {
 	block, _ := pem.Decode(stakeCert)
+	if block == nil {
+		return nil, errors.New("staking certificate is not PEM-encoded")
+	}
+
 	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		return ids.ShortID{}, fmt.Errorf("%w: problem parsing staking certificate", err)
+		return nil, fmt.Errorf("%w: problem parsing staking certificate", err)
 	}
 
+	return cert, nil
+}
+
+// CertificateNodeID returns the ID associated with cert.
+func CertificateNodeID(cert *x509.Certificate) (ids.ShortID, error) {
 	id, err := ids.ToShortID(hashing.PubkeyBytesToAddress(cert.Raw))
 	if err != nil {
 		return ids.ShortID{}, fmt.Errorf("%w: problem deriving staker ID from certificate", err)
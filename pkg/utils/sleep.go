@@ -24,10 +24,10 @@ import (
 	"time"
 )
 
-// ContextSleep sleeps for the provided duration and returns
-// an error if context is canceled.
-func ContextSleep(ctx context.Context, duration time.Duration) error {
-	timer := time.NewTimer(duration)
+// ContextSleep sleeps for the provided duration (according
+// to clock) and returns an error if context is canceled.
+func ContextSleep(ctx context.Context, clock Clock, duration time.Duration) error {
+	timer := clock.NewTimer(duration)
 	defer timer.Stop()
 
 	for {
@@ -35,7 +35,7 @@ func ContextSleep(ctx context.Context, duration time.Duration) error {
 		case <-ctx.Done():
 			return ctx.Err()
 
-		case <-timer.C:
+		case <-timer.C():
 			return nil
 		}
 	}
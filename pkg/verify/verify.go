@@ -0,0 +1,243 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package verify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+
+	"github.com/patrick-ogrady/snowplow/pkg/integrity"
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+const (
+	sandboxPattern = "snowplow-verify-"
+
+	// levelDBCurrent is the file present in every LevelDB
+	// directory.
+	levelDBCurrent = "CURRENT"
+)
+
+// Check is the result of a single verification step.
+type Check struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report describes the verification of a backup. It is
+// passed only if every check passed.
+type Report struct {
+	Destination string    `json:"destination"`
+	Object      string    `json:"object"`
+	Kind        string    `json:"kind"`
+	NodeID      string    `json:"nodeID,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+	Duration    string    `json:"duration"`
+	Passed      bool      `json:"passed"`
+	Checks      []*Check  `json:"checks"`
+}
+
+// NewReport returns a new *Report of object in destination.
+func NewReport(destination string, object string) *Report {
+	return &Report{
+		Destination: destination,
+		Object:      object,
+		StartedAt:   time.Now().UTC(),
+		Passed:      true,
+		Checks:      []*Check{},
+	}
+}
+
+// Add records the check name, which passed if err is nil,
+// and returns true if it passed.
+func (r *Report) Add(name string, err error, detail string) bool {
+	check := &Check{Name: name, Passed: err == nil, Detail: detail}
+	if err != nil {
+		check.Detail = err.Error()
+		r.Passed = false
+	}
+
+	r.Checks = append(r.Checks, check)
+	return check.Passed
+}
+
+// Finish records how long verification took.
+func (r *Report) Finish() {
+	r.Duration = time.Since(r.StartedAt).String()
+}
+
+// Sandbox creates a new directory in dir to verify a backup
+// in. dir must not be inside any of protected (ex:
+// .avalanchego), so verification never modifies a node.
+func Sandbox(dir string, protected ...string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range protected {
+		absProtected, err := filepath.Abs(p)
+		if err != nil {
+			return "", err
+		}
+
+		rel, err := filepath.Rel(absProtected, absDir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("sandbox %s cannot be inside %s", absDir, absProtected)
+		}
+	}
+
+	sandbox, err := ioutil.TempDir(absDir, sandboxPattern)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not create sandbox", err)
+	}
+
+	return sandbox, nil
+}
+
+// Download copies name from backend to the file at path
+// (without verifying it) and returns its size.
+func Download(ctx context.Context, backend storage.Backend, name string, path string) (int64, error) {
+	rc, err := backend.Get(ctx, name)
+	if err != nil {
+		return 0, fmt.Errorf("%w: unable to download %s", err, name)
+	}
+	defer rc.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("%w: could not create %s", err, path)
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, rc)
+	if err != nil {
+		return 0, fmt.Errorf("%w: unable to download %s", err, name)
+	}
+
+	return n, f.Close()
+}
+
+// Checksum returns the checksum of the file at path if it
+// matches the checksum stored next to name in backend.
+func Checksum(ctx context.Context, backend storage.Backend, name string, path string) (string, error) {
+	expected, err := storage.ReadChecksum(ctx, backend, name)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not open %s", err, path)
+	}
+	defer f.Close()
+
+	checksum, err := integrity.Checksum(f)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not compute checksum of %s", err, path)
+	}
+
+	if checksum != expected {
+		return "", fmt.Errorf(
+			"%w: expected checksum %s but got %s",
+			storage.ErrChecksumMismatch,
+			expected,
+			checksum,
+		)
+	}
+
+	return checksum, nil
+}
+
+// LevelDB opens every LevelDB database in root (read-only)
+// and reads all of their entries (verifying the checksum of
+// every block). It returns the number of entries read in each
+// database (relative to root).
+func LevelDB(root string) (map[string]int, error) {
+	databases := []string{}
+	if err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && info.Name() == levelDBCurrent {
+			databases = append(databases, filepath.Dir(p))
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("%w: could not find databases in %s", err, root)
+	}
+
+	if len(databases) == 0 {
+		return nil, fmt.Errorf("no databases found in %s", root)
+	}
+
+	entries := map[string]int{}
+	for _, path := range databases {
+		n, err := readLevelDB(path)
+		if err != nil {
+			return nil, err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil, err
+		}
+		entries[rel] = n
+	}
+
+	return entries, nil
+}
+
+// readLevelDB reads every entry in the database at path.
+func readLevelDB(path string) (int, error) {
+	db, err := leveldb.OpenFile(path, &opt.Options{
+		ErrorIfMissing: true,
+		ReadOnly:       true,
+		Strict:         opt.StrictAll,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%w: could not open database %s", err, path)
+	}
+	defer db.Close()
+
+	var n int
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		n++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("%w: could not read database %s", err, path)
+	}
+
+	return n, nil
+}
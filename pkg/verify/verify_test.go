@@ -0,0 +1,91 @@
+// Copyright (c) 2021 patrick-ogrady
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/patrick-ogrady/snowplow/pkg/storage"
+)
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	protected := filepath.Join(dir, ".avalanchego")
+	assert.NoError(t, os.Mkdir(protected, 0700))
+
+	sandbox, err := Sandbox(dir, protected)
+	assert.NoError(t, err)
+	assert.Equal(t, dir, filepath.Dir(sandbox))
+
+	_, err = Sandbox(protected, protected)
+	assert.Error(t, err)
+
+	_, err = Sandbox(filepath.Join(protected, "db"), filepath.Join(dir, "other"), protected)
+	assert.Error(t, err)
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	ctx := context.Background()
+	backend, err := storage.NewFileBackend(t.TempDir())
+	assert.NoError(t, err)
+	_, err = storage.Upload(ctx, backend, "backup.tar.gz", strings.NewReader("backup"))
+	assert.NoError(t, err)
+
+	local := filepath.Join(t.TempDir(), "object")
+	size, err := Download(ctx, backend, "backup.tar.gz", local)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), size)
+
+	_, err = Checksum(ctx, backend, "backup.tar.gz", local)
+	assert.NoError(t, err)
+
+	// Modified objects are detected
+	assert.NoError(t, ioutil.WriteFile(local, []byte("tampered"), 0600))
+	_, err = Checksum(ctx, backend, "backup.tar.gz", local)
+	assert.True(t, errors.Is(err, storage.ErrChecksumMismatch))
+}
+
+func TestLevelDB(t *testing.T) {
+	root := t.TempDir()
+	_, err := LevelDB(root)
+	assert.Error(t, err)
+
+	path := filepath.Join(root, "mainnet", "v1.0.0")
+	db, err := leveldb.OpenFile(path, nil)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value"), nil))
+	}
+	assert.NoError(t, db.Close())
+
+	entries, err := LevelDB(root)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{filepath.Join("mainnet", "v1.0.0"): 10}, entries)
+}